@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/catalog"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ErrInvalidStatus = errors.New("Status must be uploaded, failed or dead-lettered")
+	ErrInvalidTime   = errors.New("Times must be a date like 2006-01-02, an RFC 3339 time or a duration ago like 24h")
+)
+
+func newCatalogCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "catalog",
+		Short: "Inspect the local catalog of handled files",
+	}
+	cmd.AddCommand(newCatalogQueryCommand())
+	return cmd
+}
+
+func newCatalogQueryCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "query",
+		Short: "List or summarize the files in the catalog",
+		Long: `List the files the uploader has handled from the local catalog, without
+touching S3. Files are selected by their FITS headers, the night they were
+taken, their status and when they were last handled. With --group-by the
+matching files are summed up per distinct header value instead.`,
+		Example: `  # Total Ha integration on NGC 7000 this month
+  nina-s3-uploader catalog query --target "NGC 7000" --filter Ha --type LIGHT --since 2026-10-01 --group-by OBJECT,FILTER
+
+  # Which frames failed last night
+  nina-s3-uploader catalog query --status failed --since 24h`,
+		Args:         cobra.NoArgs,
+		RunE:         runCatalogQuery,
+		SilenceUsage: true,
+	}
+	addHeaderFlags(cmd)
+	cmd.Flags().String("status", "", "Only files whose last attempt uploaded, failed or dead-lettered them")
+	cmd.Flags().String("since", "", "Only files handled since a date, time or duration ago")
+	cmd.Flags().String("until", "", "Only files handled before a date, time or duration ago")
+	cmd.Flags().StringSlice("group-by", nil, "Header keywords to sum up the matching files by")
+	return cmd
+}
+
+func runCatalogQuery(cmd *cobra.Command, _ []string) error {
+	cfg, err := config.LoadConfig(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return fmt.Errorf("config validation failed: %w", err)
+	}
+	logging.Configure(cfg)
+
+	filter, err := catalogFilter(cmd, time.Now())
+	if err != nil {
+		return err
+	}
+	entries, err := catalog.Query(cfg.Catalog.Path, filter)
+	if err != nil {
+		return err
+	}
+
+	groupBy, _ := cmd.Flags().GetStringSlice("group-by")
+	if len(groupBy) > 0 {
+		printCatalogSummary(cmd.OutOrStdout(), entries, groupBy)
+	} else {
+		printCatalogEntries(cmd.OutOrStdout(), entries)
+	}
+	return nil
+}
+
+// catalogFilter builds the filter from the query flags.
+func catalogFilter(cmd *cobra.Command, now time.Time) (catalog.Filter, error) {
+	var filter catalog.Filter
+	var err error
+	filter.Headers, filter.Night, err = headerFlags(cmd)
+	if err != nil {
+		return filter, err
+	}
+
+	status, _ := cmd.Flags().GetString("status")
+	switch catalog.Status(status) {
+	case "", catalog.StatusUploaded, catalog.StatusFailed, catalog.StatusDeadLettered:
+		filter.Status = catalog.Status(status)
+	default:
+		return filter, fmt.Errorf("%w: %s", ErrInvalidStatus, status)
+	}
+
+	since, _ := cmd.Flags().GetString("since")
+	filter.Since, err = parseQueryTime(since, now)
+	if err != nil {
+		return filter, err
+	}
+	until, _ := cmd.Flags().GetString("until")
+	filter.Until, err = parseQueryTime(until, now)
+	return filter, err
+}
+
+// parseQueryTime accepts a local date, an RFC 3339 time or a duration
+// before now. An empty value is the zero time.
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidTime, value)
+}
+
+func printCatalogEntries(w io.Writer, entries []catalog.Entry) {
+	var size int64
+	var exposure time.Duration
+	if len(entries) > 0 {
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "TIME\tSTATUS\tOBJECT\tFILTER\tEXPOSURE\tSIZE\tKEY\tERROR")
+		for _, entry := range entries {
+			size += entry.Size
+			exposure += entry.Exposure()
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				entry.UpdatedAt.Local().Format(time.DateTime), entry.Status, entry.Header["OBJECT"], entry.Header["FILTER"],
+				formatExposure(entry.Exposure()), formatSize(entry.Size), cmp.Or(entry.Key, entry.Path), entry.Error)
+		}
+		table.Flush()
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d files, %s integration, %s\n", len(entries), formatExposure(exposure), formatSize(size))
+}
+
+// catalogGroup sums up the entries sharing the values of the group-by
+// keywords.
+type catalogGroup struct {
+	values   []string
+	files    int
+	exposure time.Duration
+	size     int64
+}
+
+func printCatalogSummary(w io.Writer, entries []catalog.Entry, groupBy []string) {
+	groups := make(map[string]*catalogGroup)
+	for _, entry := range entries {
+		values := make([]string, len(groupBy))
+		for i, keyword := range groupBy {
+			values[i] = entry.Header[strings.ToUpper(keyword)]
+		}
+		id := strings.Join(values, "\x00")
+		group, ok := groups[id]
+		if !ok {
+			group = &catalogGroup{values: values}
+			groups[id] = group
+		}
+		group.files++
+		group.exposure += entry.Exposure()
+		group.size += entry.Size
+	}
+	sorted := make([]*catalogGroup, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, group)
+	}
+	slices.SortFunc(sorted, func(a, b *catalogGroup) int { return slices.Compare(a.values, b.values) })
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, keyword := range groupBy {
+		fmt.Fprintf(table, "%s\t", strings.ToUpper(keyword))
+	}
+	fmt.Fprintln(table, "FILES\tINTEGRATION\tSIZE")
+	for _, group := range sorted {
+		for _, value := range group.values {
+			fmt.Fprintf(table, "%s\t", cmp.Or(value, "-"))
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\n", group.files, formatExposure(group.exposure), formatSize(group.size))
+	}
+	table.Flush()
+}
+
+// formatExposure rounds an integration time to the second, i.e. 2h5m30s.
+func formatExposure(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Second).String()
+}
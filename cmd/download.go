@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/batch"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// ErrDownloadFailed is returned when some of the objects failed to download
+	ErrDownloadFailed = errors.New("Some objects failed to download")
+	ErrInvalidHeader  = errors.New("Header filters must be KEYWORD=GLOB")
+	ErrInvalidNight   = errors.New("Night must be a date like 2006-01-02")
+)
+
+func newDownloadCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "download <dest>",
+		Aliases: []string{"restore"},
+		Short:   "Download the objects matching a filter",
+		Long: `Download the objects below the configured prefix that match the filters into
+dest, keeping their path below the prefix. Objects are selected by a key
+prefix and by the FITS header values stored with them at upload or, for
+older objects, written into their key by the key template. Sidecars are
+downloaded with their frames.
+
+Downloads resume where an interrupted run stopped, objects already present
+with the same checksum are skipped, and each file is checked against the
+checksum recorded at upload.
+
+Exits with 2 if any object failed to download and 1 on any other error.`,
+		Example: `  nina-s3-uploader download --target M31 --filter Ha --night 2026-09-12 ./M31`,
+		Args:    cobra.ExactArgs(1),
+		RunE:    runDownload,
+
+		SilenceUsage: true,
+	}
+	addHeaderFlags(cmd)
+	cmd.Flags().String("prefix", "", "Only consider keys below the configured prefix starting with this")
+	cmd.Flags().Bool("dry-run", false, "Print the selected objects without downloading")
+	cmd.Flags().Int("concurrency", defaultUploadConcurrency, "Number of objects to download at once")
+	cmd.Flags().String("profile", "", "Profile whose destination to download from")
+	return cmd
+}
+
+func runDownload(cmd *cobra.Command, args []string) error {
+	cfg, err := loadProfileConfig(cmd)
+	if err != nil {
+		return err
+	}
+	sel, err := downloadSelector(cmd)
+	if err != nil {
+		return err
+	}
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+
+	ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	objects, err := batch.Select(ctx, cfg, sel, concurrency)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		err = batch.Download(ctx, cfg, objects, args[0], concurrency)
+		if err != nil {
+			return err
+		}
+	}
+
+	failed := printDownloads(cmd.OutOrStdout(), objects, dryRun)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", ErrDownloadFailed, failed, len(objects))
+	}
+	return nil
+}
+
+// downloadSelector builds the selector from the filter flags.
+func downloadSelector(cmd *cobra.Command) (batch.Selector, error) {
+	var sel batch.Selector
+	var err error
+	sel.Headers, sel.Night, err = headerFlags(cmd)
+	if err != nil {
+		return sel, err
+	}
+	sel.Prefix, _ = cmd.Flags().GetString("prefix")
+	return sel, nil
+}
+
+// addHeaderFlags registers the flags that select frames by their FITS
+// headers, read back with headerFlags.
+func addHeaderFlags(cmd *cobra.Command) {
+	cmd.Flags().String("target", "", "Glob the OBJECT header must match")
+	cmd.Flags().String("filter", "", "Glob the FILTER header must match")
+	cmd.Flags().String("type", "", "Glob the IMAGETYP header must match, i.e. LIGHT")
+	cmd.Flags().String("night", "", "Date the night of the observation began, i.e. 2026-09-12")
+	cmd.Flags().StringArray("header", nil, "KEYWORD=GLOB a header must match, may be repeated")
+}
+
+// headerFlags returns the header globs and the night selected with the
+// flags of addHeaderFlags.
+func headerFlags(cmd *cobra.Command) (map[string]string, string, error) {
+	night, _ := cmd.Flags().GetString("night")
+	if night != "" {
+		if _, err := time.Parse(time.DateOnly, night); err != nil {
+			return nil, "", fmt.Errorf("%w: %s", ErrInvalidNight, night)
+		}
+	}
+
+	globs := make(map[string]string)
+	headers, _ := cmd.Flags().GetStringArray("header")
+	for _, header := range headers {
+		keyword, glob, ok := strings.Cut(header, "=")
+		if !ok || keyword == "" {
+			return nil, "", fmt.Errorf("%w: %s", ErrInvalidHeader, header)
+		}
+		globs[strings.ToUpper(keyword)] = glob
+	}
+	for flag, keyword := range map[string]string{"target": "OBJECT", "filter": "FILTER", "type": "IMAGETYP"} {
+		if glob, _ := cmd.Flags().GetString(flag); glob != "" {
+			globs[keyword] = glob
+		}
+	}
+	return globs, night, nil
+}
+
+// printDownloads writes a table of the objects and returns how many failed.
+func printDownloads(w io.Writer, objects []batch.Object, dryRun bool) int {
+	var failed, skipped int
+	var size int64
+	if len(objects) > 0 {
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "KEY\tSIZE\tSTATUS")
+		for _, object := range objects {
+			status := "downloaded"
+			switch {
+			case dryRun:
+				status = "dry run"
+			case object.Err != nil:
+				failed++
+				status = fmt.Sprintf("failed: %v", object.Err)
+			case object.Skipped:
+				skipped++
+				status = "up to date"
+			default:
+				size += object.Size
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\n", object.Key, formatSize(object.Size), status)
+		}
+		table.Flush()
+		fmt.Fprintln(w)
+	}
+
+	if dryRun {
+		fmt.Fprintf(w, "%d to download\n", len(objects))
+	} else {
+		fmt.Fprintf(w, "%d downloaded (%s), %d up to date, %d failed\n", len(objects)-failed-skipped, formatSize(size), skipped, failed)
+	}
+	return failed
+}
@@ -0,0 +1,309 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/bandwidth"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/catalog"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/manager"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/metrics"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/quiet"
+	"github.com/spf13/cobra"
+)
+
+const metricsShutdownTimeout = 5 * time.Second
+
+// daemon holds a running manager for each profile and swaps them for ones
+// built from the new config on reload, so every component sees either the
+// old or the new config but never a mix of both.
+type daemon struct {
+	cmd     *cobra.Command
+	metrics *metrics.Registry
+	// quiet outlives reloads, so a quiet window stays open across them
+	quiet   *quiet.Gate
+	lock    sync.Mutex
+	config  *config.Config
+	limiter *bandwidth.Limiter
+	// catalog is shared by the profiles and stays open while they are
+	// replaced, as the database cannot be opened twice
+	catalog       *catalog.Catalog
+	profiles      []*profile
+	metricsServer *http.Server
+	stopped       bool
+}
+
+// profile is the running manager of a profile and the config it was built
+// from.
+type profile struct {
+	name    string
+	config  *config.Config
+	manager *manager.Manager
+}
+
+// start applies cfg. It builds a manager for each profile that is new or
+// whose config changed, or for every profile if force is set, and only once
+// all of them are built stops the managers they replace and starts them. The
+// managers share one bandwidth budget and the quiet gate, and metrics are
+// served if configured. On error the running managers are left untouched.
+func (d *daemon) start(cfg *config.Config, force bool) error {
+	limiter := d.limiter
+	if d.config == nil || cfg.Bandwidth != d.config.Bandwidth {
+		// Every manager shares the limiter, so all of them are replaced
+		limiter = bandwidth.NewLimiter(int64(cfg.Bandwidth))
+		force = true
+	}
+	catalog := d.catalog
+	if d.config == nil || cfg.Catalog != d.config.Catalog || (catalog == nil && !cfg.Catalog.Disabled) {
+		// Likewise the catalog, the old one stays open until their
+		// managers have stopped
+		catalog = openCatalog(cfg.Catalog)
+		force = true
+	}
+
+	running := make(map[string]*profile, len(d.profiles))
+	for _, p := range d.profiles {
+		running[p.name] = p
+	}
+	var next, built []*profile
+	discard := func() {
+		for _, p := range built {
+			if err := p.manager.Stop(); err != nil {
+				slog.Error("failed to discard manager", "profile", p.name, "error", err)
+			}
+		}
+		if catalog != d.catalog {
+			closeCatalog(catalog)
+		}
+	}
+	for _, named := range cfg.ProfileConfigs() {
+		if p, ok := running[named.Name]; ok && !force && sameProfile(p.config, named.Config) {
+			next = append(next, p)
+			delete(running, named.Name)
+			continue
+		}
+		err := prepareDirectories(named.Config)
+		if err != nil {
+			discard()
+			return fmt.Errorf("profile %s: %w", named.Name, err)
+		}
+		manager, err := manager.NewManager(named.Config, named.Name, limiter, d.quiet, catalog, d.metrics.Profile(named.Name))
+		if err != nil {
+			discard()
+			return fmt.Errorf("failed to create manager for profile %s: %w", named.Name, err)
+		}
+		p := &profile{name: named.Name, config: named.Config, manager: manager}
+		next = append(next, p)
+		built = append(built, p)
+	}
+
+	// What is left running was replaced or removed
+	stale := make([]*profile, 0, len(running))
+	for _, p := range running {
+		stale = append(stale, p)
+	}
+	err := stopProfiles(stale)
+	if err != nil {
+		slog.Error("failed to stop managers cleanly", "error", err)
+	}
+	if catalog != d.catalog {
+		closeCatalog(d.catalog)
+	}
+	for _, p := range built {
+		p.manager.Start()
+	}
+	d.quiet.SetTimeout(cfg.Uploader.Quiet.Timeout)
+	d.profiles = next
+	d.limiter = limiter
+	d.catalog = catalog
+	d.config = cfg
+	d.serveMetrics(cfg.Metrics.Listen)
+	if len(built) > 0 || len(stale) > 0 {
+		slog.Info("applied profiles", "started", len(built), "stopped", len(stale), "unchanged", len(next)-len(built))
+	}
+	return nil
+}
+
+// openCatalog opens the catalog the profiles record to, nil if disabled. A
+// catalog that cannot be opened, i.e. because an upload command holds it,
+// does not keep uploads from running, and is tried again on reload.
+func openCatalog(cfg config.Catalog) *catalog.Catalog {
+	c, err := catalog.Open(cfg)
+	if err != nil {
+		slog.Error("failed to open catalog, files are not recorded", "path", cfg.Path, "error", err)
+	}
+	return c
+}
+
+func closeCatalog(c *catalog.Catalog) {
+	if err := c.Close(); err != nil {
+		slog.Error("failed to close catalog", "error", err)
+	}
+}
+
+// sameProfile reports whether a profile's manager built from a can keep
+// running under b. The log config is applied in place and the metrics
+// endpoint is served by the daemon, neither needs a new manager.
+func sameProfile(a, b *config.Config) bool {
+	x, y := *a, *b
+	x.LogLevel, x.Log, x.Metrics, x.Profiles = y.LogLevel, y.Log, y.Metrics, y.Profiles
+	return reflect.DeepEqual(&x, &y)
+}
+
+// serveMetrics starts, moves or stops the metrics endpoint to match listen.
+// The quiet window endpoint is served beside it.
+func (d *daemon) serveMetrics(listen string) {
+	if d.metricsServer != nil {
+		if d.metricsServer.Addr == listen {
+			return
+		}
+		d.stopMetrics()
+	}
+	if listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", d.metrics)
+	mux.Handle("/quiet", d.quiet)
+	server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	d.metricsServer = server
+	go func() {
+		slog.Info("serving metrics", "address", listen)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "address", listen, "error", err)
+		}
+	}()
+}
+
+func (d *daemon) stopMetrics() {
+	if d.metricsServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	err := d.metricsServer.Shutdown(ctx)
+	if err != nil {
+		slog.Error("failed to stop metrics server", "error", err)
+	}
+	d.metricsServer = nil
+}
+
+// stopProfiles stops the managers of profiles at once, so their drain
+// timeouts run alongside each other.
+func stopProfiles(profiles []*profile) error {
+	errs := make([]error, len(profiles))
+	var wg sync.WaitGroup
+	for i, p := range profiles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = p.manager.Stop()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (d *daemon) reloadOnSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("received SIGHUP, reloading config")
+			// Forced, as files the config points to, such as credentials,
+			// may have changed while the config did not
+			d.reload(true)
+		}
+	}
+}
+
+// reload loads and validates the config, rejecting it if invalid. The log
+// config is applied in place. The managers of profiles whose config changed,
+// or all of them if force is set, are replaced, which re-registers their
+// watched directories and rebuilds their S3 clients. Uploads in flight on a
+// replaced manager are drained or cancelled as on shutdown and resume under
+// the new one, the other profiles keep uploading throughout.
+func (d *daemon) reload(force bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return
+	}
+
+	cfg, err := config.LoadConfig(d.cmd)
+	if err != nil {
+		slog.Error("rejected config reload, keeping the running config", "error", err)
+		return
+	}
+	err = cfg.Validate()
+	if err != nil {
+		slog.Error("rejected config reload, keeping the running config", "error", err)
+		return
+	}
+
+	if cfg.LogLevel != d.config.LogLevel || !reflect.DeepEqual(cfg.Log, d.config.Log) {
+		logging.Configure(cfg)
+		slog.Info("applied log config", "level", cfg.LogLevel, "format", cfg.Log.Format)
+	}
+	current := *d.config
+	current.LogLevel = cfg.LogLevel
+	current.Log = cfg.Log
+	if !force && reflect.DeepEqual(&current, cfg) {
+		d.config = cfg
+		slog.Debug("config reloaded without changes to uploads")
+		return
+	}
+
+	slog.Info("config changed, applying it")
+	err = d.start(cfg, force)
+	if err != nil {
+		slog.Error("rejected config reload, keeping the running config", "error", err)
+		return
+	}
+	slog.Info("reloaded config")
+}
+
+func (d *daemon) stop() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stopped = true
+	d.stopMetrics()
+	err := stopProfiles(d.profiles)
+	d.profiles = nil
+	closeCatalog(d.catalog)
+	d.catalog = nil
+	return err
+}
+
+// prepareDirectories creates the watched and local directories if missing.
+func prepareDirectories(cfg *config.Config) error {
+	if _, err := os.Stat(cfg.Uploader.Directory); os.IsNotExist(err) {
+		os.MkdirAll(cfg.Uploader.Directory, os.ModePerm)
+	} else if err != nil {
+		return fmt.Errorf("failed to check uploader directory: %w", err)
+	}
+
+	if _, err := os.Stat(cfg.Uploader.Local.Directory); os.IsNotExist(err) {
+		os.MkdirAll(cfg.Uploader.Local.Directory, os.ModePerm)
+	} else if err != nil {
+		return fmt.Errorf("failed to check local directory: %w", err)
+	}
+	return nil
+}
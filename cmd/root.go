@@ -1,21 +1,31 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
 	"syscall"
 
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
-	"github.com/USA-RedDragon/nina-s3-uploader/internal/manager"
-	"github.com/lmittmann/tint"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/metrics"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/quiet"
 	"github.com/spf13/cobra"
 	"github.com/ztrue/shutdown"
 )
 
 func NewCommand(version, commit string) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:     "nina-s3-uploader",
+		Use:   "nina-s3-uploader",
+		Short: "Upload the frames N.I.N.A. saves to S3",
+		Long: `Watch the configured directories and upload the frames saved there, with
+their sidecars, to S3.
+
+With metrics.listen set, the daemon serves Prometheus metrics on /metrics
+and the quiet window on /quiet, i.e. POST /quiet?duration=45s pauses
+uploads. Without it, quiet windows are only opened by N.I.N.A. events and
+the flag file.`,
 		Version: fmt.Sprintf("%s - %s", version, commit),
 		Annotations: map[string]string{
 			"version": version,
@@ -26,6 +36,7 @@ func NewCommand(version, commit string) *cobra.Command {
 		DisableAutoGenTag: true,
 	}
 	config.RegisterFlags(cmd)
+	cmd.AddCommand(newUploadCommand(), newSyncCommand(), newDownloadCommand(), newCatalogCommand())
 	return cmd
 }
 
@@ -37,55 +48,48 @@ func runRoot(cmd *cobra.Command, _ []string) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	var logger *slog.Logger
-	switch cfg.LogLevel {
-	case config.LogLevelDebug:
-		logger = slog.New(tint.NewHandler(os.Stdout, &tint.Options{Level: slog.LevelDebug}))
-	case config.LogLevelInfo:
-		logger = slog.New(tint.NewHandler(os.Stdout, &tint.Options{Level: slog.LevelInfo}))
-	case config.LogLevelWarn:
-		logger = slog.New(tint.NewHandler(os.Stderr, &tint.Options{Level: slog.LevelWarn}))
-	case config.LogLevelError:
-		logger = slog.New(tint.NewHandler(os.Stderr, &tint.Options{Level: slog.LevelError}))
-	}
-	slog.SetDefault(logger)
-
 	err = cfg.Validate()
 	if err != nil {
 		return fmt.Errorf("config validation failed: %w", err)
 	}
+	logging.Configure(cfg)
 
-	if _, err := os.Stat(cfg.Uploader.Directory); os.IsNotExist(err) {
-		os.MkdirAll(cfg.Uploader.Directory, os.ModePerm)
-	} else if err != nil {
-		return fmt.Errorf("failed to check uploader directory: %w", err)
+	daemon := &daemon{
+		cmd:     cmd,
+		metrics: metrics.NewRegistry(),
+		quiet:   quiet.NewGate(),
 	}
-
-	if _, err := os.Stat(cfg.Uploader.Local.Directory); os.IsNotExist(err) {
-		os.MkdirAll(cfg.Uploader.Local.Directory, os.ModePerm)
-	} else if err != nil {
-		return fmt.Errorf("failed to check local directory: %w", err)
-	}
-
-	manager, err := manager.NewManager(cfg)
+	err = daemon.start(cfg, true)
 	if err != nil {
-		return fmt.Errorf("failed to create manager: %w", err)
+		return err
 	}
-	err = manager.Start()
-	if err != nil {
-		return fmt.Errorf("failed to start manager: %w", err)
+
+	ctx, cancel := context.WithCancel(cmd.Context())
+	defer cancel()
+	configPath, err := cmd.Flags().GetString("config")
+	if err == nil && configPath != "" {
+		err = config.Watch(ctx, configPath, func() { daemon.reload(false) })
+		if err != nil {
+			slog.Warn("not watching config file for changes", "path", configPath, "error", err)
+		}
 	}
+	go daemon.reloadOnSIGHUP(ctx)
 
 	stop := func(_ os.Signal) {
 		// Skip a line so the control characters don't mess up the output
 		fmt.Println("")
 		slog.Info("Shutting down")
 
-		err := manager.Stop()
+		cancel()
+		err := daemon.stop()
 		if err != nil {
 			slog.Error("Shutdown error", "error", err.Error())
 		}
 		slog.Info("Shutdown complete")
+		err = logging.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to close log file: %v\n", err)
+		}
 	}
 	shutdown.AddWithParam(stop)
 	shutdown.Listen(syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGQUIT)
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/batch"
+	"github.com/spf13/cobra"
+)
+
+// ErrSyncFailed is returned when some changes of a sync failed
+var ErrSyncFailed = errors.New("Some changes failed to sync")
+
+func newSyncCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync <dir>",
+		Short: "Make the bucket prefix match a local directory",
+		Long: `Compare a local directory with the objects below the configured prefix and
+upload what is missing or differs, i.e. to reconcile archive disks that were
+copied around by hand. Files are picked as the watcher would pick them, with
+their sidecars, and keyed by their path below dir. Objects are compared by
+key, size and the checksum recorded when they were uploaded.
+
+The plan is printed before anything is changed. Objects with no local file
+are only deleted with --delete.
+
+Exits with 2 if any change failed and 1 on any other error.`,
+		Args:         cobra.ExactArgs(1),
+		RunE:         runSync,
+		SilenceUsage: true,
+	}
+	cmd.Flags().Bool("delete", false, "Delete objects below the prefix that have no local file")
+	cmd.Flags().Bool("dry-run", false, "Print the plan without changing anything")
+	cmd.Flags().Int("concurrency", defaultUploadConcurrency, "Number of files to compare or upload at once")
+	cmd.Flags().String("profile", "", "Profile whose destination to sync to")
+	return cmd
+}
+
+func runSync(cmd *cobra.Command, args []string) error {
+	cfg, err := loadProfileConfig(cmd)
+	if err != nil {
+		return err
+	}
+	deleteRemote, _ := cmd.Flags().GetBool("delete")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+
+	ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	plan, err := batch.PlanSync(ctx, cfg, args[0], deleteRemote, concurrency)
+	if err != nil {
+		return err
+	}
+
+	out := cmd.OutOrStdout()
+	printPlan(out, plan)
+	if dryRun || len(plan.Changes) == 0 {
+		return nil
+	}
+
+	err = batch.Sync(ctx, cfg, plan, concurrency)
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, change := range plan.Changes {
+		if change.Err != nil {
+			failed++
+			fmt.Fprintf(out, "failed to %s %s: %v\n", changeAction(change), change.Key, change.Err)
+		}
+	}
+	fmt.Fprintf(out, "%d changed, %d failed\n", len(plan.Changes)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", ErrSyncFailed, failed, len(plan.Changes))
+	}
+	return nil
+}
+
+func printPlan(w io.Writer, plan *batch.SyncPlan) {
+	var uploads, deletes int
+	if len(plan.Changes) > 0 {
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "ACTION\tKEY\tSIZE\tREASON")
+		for _, change := range plan.Changes {
+			if change.Delete {
+				deletes++
+			} else {
+				uploads++
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", changeAction(change), change.Key, formatSize(change.Size), change.Reason)
+		}
+		table.Flush()
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d to upload, %d to delete, %d unchanged\n", uploads, deletes, plan.Unchanged)
+}
+
+func changeAction(change batch.Change) string {
+	if change.Delete {
+		return "delete"
+	}
+	return "upload"
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/batch"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/spf13/cobra"
+)
+
+const (
+	exitCodeError         = 1
+	exitCodePartialFailed = 2
+
+	defaultUploadConcurrency = 4
+)
+
+var (
+	// ErrUploadFailed is returned when some of the files failed to upload
+	ErrUploadFailed    = errors.New("Some files failed to upload")
+	ErrUnknownProfile  = errors.New("Unknown profile")
+	ErrProfileRequired = errors.New("The config has profiles, choose one with --profile")
+)
+
+// ExitCode maps an error returned by the command to the process exit code:
+// 2 if any file failed to upload, sync or download, 1 for any other error.
+func ExitCode(err error) int {
+	if errors.Is(err, ErrUploadFailed) || errors.Is(err, ErrSyncFailed) || errors.Is(err, ErrDownloadFailed) {
+		return exitCodePartialFailed
+	}
+	return exitCodeError
+}
+
+func newUploadCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "upload <paths...>",
+		Short: "Upload files, directories or globs once and exit",
+		Long: `Upload files, directories or globs once and exit, i.e. to backfill old
+nights or from a script. Files are keyed as the daemon would key them if they
+are below the watched or local directory, otherwise by their path below the
+parent of the argument that named them.
+
+Exits with 2 if any file failed to upload and 1 on any other error.`,
+		Args:         cobra.MinimumNArgs(1),
+		RunE:         runUpload,
+		SilenceUsage: true,
+	}
+	cmd.Flags().BoolP("recursive", "r", false, "Upload the contents of subdirectories")
+	cmd.Flags().Bool("dry-run", false, "Print the object keys without uploading")
+	cmd.Flags().Bool("delete-after", false, "Remove each file once it has been uploaded")
+	cmd.Flags().Int("concurrency", defaultUploadConcurrency, "Number of files to upload at once")
+	cmd.Flags().String("profile", "", "Profile whose destination to upload to")
+	return cmd
+}
+
+func runUpload(cmd *cobra.Command, args []string) error {
+	cfg, err := loadProfileConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	recursive, _ := cmd.Flags().GetBool("recursive")
+	opts := batch.Options{}
+	opts.DryRun, _ = cmd.Flags().GetBool("dry-run")
+	opts.DeleteAfter, _ = cmd.Flags().GetBool("delete-after")
+	opts.Concurrency, _ = cmd.Flags().GetInt("concurrency")
+
+	files, err := batch.Collect(cfg, args, recursive)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	results, err := batch.Upload(ctx, cfg, files, opts)
+	if err != nil {
+		return err
+	}
+
+	failed := printSummary(cmd.OutOrStdout(), results, opts.DryRun)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", ErrUploadFailed, failed, len(results))
+	}
+	return nil
+}
+
+// loadProfileConfig loads and validates the config, applies its logging and
+// returns the config of the profile chosen with --profile.
+func loadProfileConfig(cmd *cobra.Command) (*config.Config, error) {
+	cfg, err := config.LoadConfig(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+	logging.Configure(cfg)
+
+	name, _ := cmd.Flags().GetString("profile")
+	profiles := cfg.ProfileConfigs()
+	if name == "" {
+		if len(cfg.Profiles) > 0 {
+			return nil, ErrProfileRequired
+		}
+		return profiles[0].Config, nil
+	}
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile.Config, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+}
+
+// printSummary writes a table of the results and returns how many failed.
+func printSummary(w io.Writer, results []batch.Result, dryRun bool) int {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "FILE\tKEY\tSIDECARS\tSIZE\tSTATUS")
+	var failed int
+	var size int64
+	for _, result := range results {
+		status := "uploaded"
+		switch {
+		case result.Err != nil:
+			failed++
+			status = fmt.Sprintf("failed: %v", result.Err)
+		case dryRun:
+			status = "dry run"
+		default:
+			size += result.Size
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\n", result.Rel, result.Key, result.Sidecars, formatSize(result.Size), status)
+	}
+	table.Flush()
+
+	if dryRun {
+		fmt.Fprintf(w, "\n%d to upload, %d failed\n", len(results)-failed, failed)
+	} else {
+		fmt.Fprintf(w, "\n%d uploaded (%s), %d failed\n", len(results)-failed, formatSize(size), failed)
+	}
+	return failed
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,225 @@
+package analysis
+
+import (
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+)
+
+const (
+	// maxSamples bounds the pixels sorted for the median and noise
+	maxSamples = 1 << 20
+	// starRadius is the radius in pixels a star is measured within
+	starRadius = 10
+	// madToSigma scales the median absolute deviation to the standard
+	// deviation of normally distributed noise
+	madToSigma = 1.4826
+	// sigmaToFWHM scales the standard deviation of a Gaussian profile to its
+	// full width at half maximum
+	sigmaToFWHM = 2.3548
+
+	// MetadataPrefix starts the object metadata keys of the statistics
+	MetadataPrefix = "stats-"
+	MetadataMedian = MetadataPrefix + "median"
+	MetadataMean   = MetadataPrefix + "mean"
+	MetadataNoise  = MetadataPrefix + "noise"
+	MetadataStars  = MetadataPrefix + "stars"
+	MetadataHFR    = MetadataPrefix + "hfr"
+	MetadataFWHM   = MetadataPrefix + "fwhm"
+)
+
+// Stats are the statistics of one frame. HFR and FWHM are medians over the
+// detected stars in pixels, zero if none were found.
+type Stats struct {
+	Median float64
+	Mean   float64
+	// Noise is the standard deviation of the background
+	Noise float64
+	Stars int
+	HFR   float64
+	FWHM  float64
+}
+
+// Metadata returns the statistics as object metadata.
+func (s Stats) Metadata() map[string]string {
+	format := func(value float64) string { return strconv.FormatFloat(value, 'f', 2, 64) }
+	return map[string]string{
+		MetadataMedian: format(s.Median),
+		MetadataMean:   format(s.Mean),
+		MetadataNoise:  format(s.Noise),
+		MetadataStars:  strconv.Itoa(s.Stars),
+		MetadataHFR:    format(s.HFR),
+		MetadataFWHM:   format(s.FWHM),
+	}
+}
+
+// Wanted reports whether frames with header are analyzed. Capture programs
+// differ in the case of IMAGETYP, so it is matched regardless.
+func Wanted(cfg config.Analysis, header fits.Header) bool {
+	return cfg.Enabled && header != nil && slices.ContainsFunc(cfg.ImageTypes, func(imageType string) bool {
+		return strings.EqualFold(imageType, header["IMAGETYP"])
+	})
+}
+
+// Analyze reads the image of the FITS file r, positioned right after the
+// header, and measures it.
+func Analyze(cfg config.Analysis, r io.Reader, header fits.Header) (Stats, error) {
+	image, err := fits.ReadImage(r, header)
+	if err != nil {
+		return Stats{}, err
+	}
+	return Measure(cfg, image), nil
+}
+
+// Measure computes the statistics of image. The background and its noise
+// are estimated robustly from the median and the median absolute deviation,
+// and stars are the local maxima peaking the star threshold times the noise
+// above the background.
+func Measure(cfg config.Analysis, image *fits.Image) Stats {
+	var stats Stats
+	samples := make([]float64, 0, min(len(image.Pixels), maxSamples))
+	stride := max(1, len(image.Pixels)/maxSamples)
+	var sum float64
+	var count int
+	for i, pixel := range image.Pixels {
+		value := float64(pixel)
+		if math.IsNaN(value) {
+			continue
+		}
+		sum += value
+		count++
+		if i%stride == 0 {
+			samples = append(samples, value)
+		}
+	}
+	if count == 0 {
+		return stats
+	}
+	stats.Mean = sum / float64(count)
+	stats.Median = median(samples)
+	for i, value := range samples {
+		samples[i] = math.Abs(value - stats.Median)
+	}
+	stats.Noise = madToSigma * median(samples)
+	if stats.Noise == 0 {
+		// A flat image has no stars to tell from the background
+		return stats
+	}
+
+	stars := detect(image, stats.Median, stats.Noise, cfg.StarThreshold)
+	stats.Stars = len(stars)
+	if len(stars) > 0 {
+		hfr := make([]float64, len(stars))
+		fwhm := make([]float64, len(stars))
+		for i, star := range stars {
+			hfr[i], fwhm[i] = star.hfr, star.fwhm
+		}
+		stats.HFR = median(hfr)
+		stats.FWHM = median(fwhm)
+	}
+	return stats
+}
+
+type star struct {
+	hfr  float64
+	fwhm float64
+}
+
+// detect finds the stars in image and measures each. A star is a pixel
+// above the threshold that is the brightest around it, with enough of its
+// neighbors lit to not be a hot pixel.
+func detect(image *fits.Image, background, noise, threshold float64) []star {
+	peak := background + threshold*noise
+	lit := background + threshold*noise/2
+	var stars []star
+	for y := starRadius; y < image.Height-starRadius; y++ {
+		for x := starRadius; x < image.Width-starRadius; x++ {
+			value := image.At(x, y)
+			if float64(value) <= peak || !isPeak(image, x, y) || litNeighbors(image, x, y, lit) < 4 {
+				continue
+			}
+			if s, ok := measure(image, x, y, background, noise); ok {
+				stars = append(stars, s)
+			}
+		}
+	}
+	return stars
+}
+
+// isPeak reports whether the pixel at x, y is the brightest within two
+// pixels, ties going to the first in scan order.
+func isPeak(image *fits.Image, x, y int) bool {
+	value := image.At(x, y)
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			if dx == 0 && dy == 0 {
+				continue
+			}
+			neighbor := image.At(x+dx, y+dy)
+			before := dy < 0 || (dy == 0 && dx < 0)
+			if neighbor > value || (before && neighbor == value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func litNeighbors(image *fits.Image, x, y int, lit float64) int {
+	var count int
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			if (dx != 0 || dy != 0) && float64(image.At(x+dx, y+dy)) > lit {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// measure computes the half flux radius, the flux-weighted mean distance
+// from the peak as N.I.N.A. reports it, and the FWHM from the second moment
+// of the flux. Only pixels clearly above the noise count towards the flux.
+func measure(image *fits.Image, x, y int, background, noise float64) (star, bool) {
+	var flux, first, second float64
+	for dy := -starRadius; dy <= starRadius; dy++ {
+		for dx := -starRadius; dx <= starRadius; dx++ {
+			r := math.Hypot(float64(dx), float64(dy))
+			if r > starRadius {
+				continue
+			}
+			f := float64(image.At(x+dx, y+dy)) - background
+			if f <= noise || math.IsNaN(f) {
+				continue
+			}
+			flux += f
+			first += f * r
+			second += f * r * r
+		}
+	}
+	if flux == 0 {
+		return star{}, false
+	}
+	return star{
+		hfr:  first / flux,
+		fwhm: sigmaToFWHM * math.Sqrt(second/(2*flux)),
+	}, true
+}
+
+// median sorts values and returns their median.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	slices.Sort(values)
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
@@ -0,0 +1,97 @@
+package analysis_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/analysis"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+)
+
+// starField writes a 16-bit FITS frame as N.I.N.A. saves it, with a noisy
+// background and Gaussian stars of the given sigma on a grid.
+func starField(width, height, stars int, sigma float64) []byte {
+	random := rand.New(rand.NewPCG(1, 2))
+	pixels := make([]float64, width*height)
+	for i := range pixels {
+		pixels[i] = 1000 + 10*random.NormFloat64()
+	}
+	for n := range stars {
+		cx, cy := float64(30+(n%8)*40), float64(30+(n/8)*40)
+		for y := int(cy) - 12; y <= int(cy)+12; y++ {
+			for x := int(cx) - 12; x <= int(cx)+12; x++ {
+				r2 := (float64(x)-cx)*(float64(x)-cx) + (float64(y)-cy)*(float64(y)-cy)
+				pixels[y*width+x] += 5000 * math.Exp(-r2/(2*sigma*sigma))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	cards := []string{
+		"SIMPLE  =                    T",
+		"BITPIX  =                   16",
+		"NAXIS   =                    2",
+		fmt.Sprintf("NAXIS1  = %20d", width),
+		fmt.Sprintf("NAXIS2  = %20d", height),
+		"BZERO   =                32768",
+		"IMAGETYP= 'LIGHT'",
+		"END",
+	}
+	for _, card := range cards {
+		buf.WriteString(card + strings.Repeat(" ", 80-len(card)))
+	}
+	buf.Write(bytes.Repeat([]byte(" "), 2880-buf.Len()))
+	for _, pixel := range pixels {
+		binary.Write(&buf, binary.BigEndian, int16(math.Round(pixel)-32768))
+	}
+	return buf.Bytes()
+}
+
+func TestAnalyze(t *testing.T) {
+	t.Parallel()
+	cfg := config.Analysis{Enabled: true, ImageTypes: []string{"LIGHT"}, StarThreshold: 5}
+	sigma := 1.5
+
+	file := bytes.NewReader(starField(340, 260, 48, sigma))
+	header, err := fits.ReadHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !analysis.Wanted(cfg, header) {
+		t.Fatal("light frame not wanted for analysis")
+	}
+	for imageType, want := range map[string]bool{"Light": true, "light": true, "DARK": false} {
+		if got := analysis.Wanted(cfg, fits.Header{"IMAGETYP": imageType}); got != want {
+			t.Errorf("IMAGETYP %q wanted %v, want %v", imageType, got, want)
+		}
+	}
+	stats, err := analysis.Analyze(cfg, file, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Stars != 48 {
+		t.Errorf("found %d stars, want 48", stats.Stars)
+	}
+	if math.Abs(stats.Median-1000) > 5 || math.Abs(stats.Noise-10) > 1 {
+		t.Errorf("background %.1f with noise %.1f, want 1000 and 10", stats.Median, stats.Noise)
+	}
+	// A Gaussian's flux-weighted mean radius is sigma times sqrt(pi/2)
+	if want := sigma * math.Sqrt(math.Pi/2); math.Abs(stats.HFR-want) > 0.25 {
+		t.Errorf("HFR %.2f, want about %.2f", stats.HFR, want)
+	}
+	if want := 2.3548 * sigma; math.Abs(stats.FWHM-want) > 0.5 {
+		t.Errorf("FWHM %.2f, want about %.2f", stats.FWHM, want)
+	}
+
+	metadata := stats.Metadata()
+	if metadata[analysis.MetadataStars] != "48" {
+		t.Errorf("stars metadata %q", metadata[analysis.MetadataStars])
+	}
+}
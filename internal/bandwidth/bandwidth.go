@@ -0,0 +1,74 @@
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter is an upload rate shared by every client wrapped with it. A nil
+// Limiter does not limit.
+type Limiter struct {
+	limiter *rate.Limiter
+}
+
+// NewLimiter limits to bytesPerSecond, or returns nil for zero.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	// A second's worth of burst keeps small requests from waiting while
+	// bounding how far ahead a large one can get
+	return &Limiter{limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))}
+}
+
+// HTTPClient is the client interface used by the AWS SDK.
+type HTTPClient interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Client wraps client so the bodies of its requests are sent no faster than
+// the limit.
+func (l *Limiter) Client(client HTTPClient) HTTPClient {
+	if l == nil {
+		return client
+	}
+	return &limitedClient{client: client, limiter: l.limiter}
+}
+
+type limitedClient struct {
+	client  HTTPClient
+	limiter *rate.Limiter
+}
+
+func (c *limitedClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &limitedBody{ctx: req.Context(), body: req.Body, limiter: c.limiter}
+	}
+	return c.client.Do(req)
+}
+
+type limitedBody struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	limiter *rate.Limiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if burst := b.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := b.body.Read(p)
+	if n > 0 {
+		if waitErr := b.limiter.WaitN(b.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,272 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/bandwidth"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/catalog"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/sidecar"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/watcher"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("batch")
+
+var (
+	ErrNoMatch            = errors.New("No such file or matching glob")
+	ErrInvalidConcurrency = errors.New("Concurrency must be at least 1")
+)
+
+// File is a file to upload once.
+type File struct {
+	Path string
+	// Rel is the slash-separated path the object key is derived from
+	Rel string
+}
+
+// Collect expands each of paths, a file, a directory or a glob, into the
+// files to upload. Files named directly are always included, those found in
+// a directory only if the watcher would upload them, and subdirectories are
+// only entered if recursive.
+//
+// Files below the watched or local directory keep the key the daemon would
+// give them, others are keyed by their path below the parent of the
+// argument that named them, i.e. night1/frame.fits for the directory night1.
+func Collect(cfg *config.Config, paths []string, recursive bool) ([]File, error) {
+	seen := make(map[string]bool)
+	var files []File
+	add := func(root, filePath string) {
+		if seen[filePath] {
+			return
+		}
+		seen[filePath] = true
+		files = append(files, File{Path: filePath, Rel: relativePath(cfg, root, filePath)})
+	}
+
+	for _, arg := range paths {
+		matches, err := expand(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(filepath.Dir(match), match)
+				continue
+			}
+			root := filepath.Dir(match)
+			err = filepath.WalkDir(match, func(filePath string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if entry.IsDir() {
+					if filePath != match && !recursive {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if entry.Type().IsRegular() && watcher.Watched(cfg, match, filePath) {
+					add(root, filePath)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to walk %s: %w", match, err)
+			}
+		}
+	}
+	return files, nil
+}
+
+// expand returns the path itself if it exists, otherwise the files matching
+// it as a glob, as absolute paths.
+func expand(arg string) ([]string, error) {
+	arg, err := filepath.Abs(arg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(arg); err == nil {
+		return []string{arg}, nil
+	}
+	matches, err := filepath.Glob(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrNoMatch, arg, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoMatch, arg)
+	}
+	return matches, nil
+}
+
+func relativePath(cfg *config.Config, root, filePath string) string {
+	if rel, ok := cfg.Uploader.RelativePath(filePath); ok {
+		return rel
+	}
+	rel, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return filepath.Base(filePath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Options controls an Upload.
+type Options struct {
+	Concurrency int
+	// DryRun only resolves the object keys
+	DryRun bool
+	// DeleteAfter removes each group of files once it has been uploaded
+	DeleteAfter bool
+}
+
+// Result is the outcome of uploading a file and its sidecars.
+type Result struct {
+	File
+	Key      string
+	Sidecars int
+	Size     int64
+	Err      error
+}
+
+// Upload uploads each file together with its sidecars, concurrency groups at
+// a time, and returns the results in the order of files. It fails as a whole
+// only if no uploader can be created.
+func Upload(ctx context.Context, cfg *config.Config, files []File, opts Options) ([]Result, error) {
+	results := make([]Result, len(files))
+	var done sync.Map
+	var record *catalog.Catalog
+	if !opts.DryRun {
+		record = openCatalog(cfg)
+		defer record.Close()
+	}
+	err := forEach(cfg, record, len(files), opts.Concurrency, func(worker *uploader.Uploader, i int) {
+		results[i] = uploadGroup(ctx, cfg, worker, files[i], opts, &done)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// openCatalog opens the catalog to record the files of a command in. The
+// daemon keeps it open while it runs, and the files are not recorded then.
+func openCatalog(cfg *config.Config) *catalog.Catalog {
+	c, err := catalog.Open(cfg.Catalog)
+	if err != nil {
+		logger.Warn("failed to open catalog, files are not recorded", "error", err)
+	}
+	return c
+}
+
+// forEach calls fn with each of n jobs, concurrency at a time. An uploader
+// runs one upload at a time, so each worker has its own, and the workers
+// share one bandwidth limit and record to catalog, which may be nil. It
+// fails only if an uploader cannot be created.
+func forEach(cfg *config.Config, catalog *catalog.Catalog, n, concurrency int, fn func(worker *uploader.Uploader, i int)) error {
+	if concurrency < 1 {
+		return ErrInvalidConcurrency
+	}
+	limiter := bandwidth.NewLimiter(int64(cfg.Bandwidth))
+	workers := make([]*uploader.Uploader, min(concurrency, max(n, 1)))
+	for i := range workers {
+		var err error
+		workers[i], err = uploader.NewUploader(cfg, limiter, nil, catalog)
+		if err != nil {
+			return fmt.Errorf("failed to create uploader: %w", err)
+		}
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for _, worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(worker, i)
+			}
+		}()
+	}
+	for i := range n {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return nil
+}
+
+// uploadGroup uploads file and its sidecars. A sidecar shared by several
+// files, such as one matched by directory, is only uploaded once.
+func uploadGroup(ctx context.Context, cfg *config.Config, worker *uploader.Uploader, file File, opts Options, done *sync.Map) Result {
+	result := Result{File: file}
+	group := sidecar.Group(file.Path, cfg.Uploader.Sidecars)
+	result.Sidecars = len(group) - 1
+	result.Size = sidecar.Size(group)
+
+	result.Key, result.Err = worker.ObjectKey(file.Path, file.Rel)
+	if result.Err != nil || opts.DryRun {
+		return result
+	}
+
+	log := logger.With(logging.File(cfg.Uploader, file.Path))
+	uploaded := make([]string, 0, len(group))
+	// Sidecars go beside the frame, and a shared one beside the first frame
+	// that uploads it
+	var loc uploader.Location
+	for i, groupPath := range group {
+		if _, loaded := done.LoadOrStore(groupPath, true); loaded {
+			if i == 0 {
+				// The frame was reached before, i.e. listed twice, and its
+				// sidecars went with it
+				return result
+			}
+			continue
+		}
+		if i > 0 {
+			if _, err := os.Stat(groupPath); errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+		}
+		rel := path.Join(path.Dir(file.Rel), filepath.Base(groupPath))
+		var err error
+		if i == 0 {
+			var frame uploader.Result
+			frame, err = worker.UploadAs(ctx, groupPath, rel)
+			loc = frame.Location()
+		} else {
+			err = worker.UploadInto(ctx, groupPath, rel, loc)
+		}
+		if err != nil {
+			done.Delete(groupPath)
+			log.Error("failed to upload", "path", groupPath, "error", err)
+			result.Err = err
+			return result
+		}
+		log.Info("uploaded", "path", groupPath)
+		uploaded = append(uploaded, groupPath)
+	}
+
+	if opts.DeleteAfter {
+		// Shared sidecars are removed by the group that uploaded them
+		for _, groupPath := range uploaded {
+			err := os.Remove(groupPath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Error("failed to remove uploaded file", "path", groupPath, "error", err)
+				result.Err = fmt.Errorf("uploaded but failed to remove: %w", err)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,131 @@
+package batch_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/batch"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/s3test"
+)
+
+func TestCollect(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	watched := filepath.Join(root, "watched")
+	night := filepath.Join(root, "old", "night1")
+	for _, path := range []string{
+		filepath.Join(watched, "n1", "a.fits"),
+		filepath.Join(night, "b.fits"),
+		filepath.Join(night, "b.json"),
+		filepath.Join(night, "flats", "c.fits"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config.Config{Uploader: config.Uploader{
+		Directory:  watched,
+		Extensions: []string{".fits"},
+		Local:      config.Local{Directory: filepath.Join(root, "local")},
+	}}
+
+	tests := []struct {
+		name      string
+		paths     []string
+		recursive bool
+		want      []string
+	}{
+		{"directory", []string{night}, false, []string{"night1/b.fits"}},
+		{"recursive", []string{night}, true, []string{"night1/b.fits", "night1/flats/c.fits"}},
+		{"file", []string{filepath.Join(night, "b.json")}, false, []string{"b.json"}},
+		{"glob", []string{filepath.Join(root, "old", "*", "flats")}, false, []string{"flats/c.fits"}},
+		{"watched", []string{filepath.Join(watched, "n1", "a.fits")}, false, []string{"n1/a.fits"}},
+		{"duplicates", []string{night, filepath.Join(night, "*.fits")}, false, []string{"night1/b.fits"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			files, err := batch.Collect(cfg, tt.paths, tt.recursive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(files))
+			for _, file := range files {
+				got = append(got, file.Rel)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	_, err := batch.Collect(cfg, []string{filepath.Join(root, "missing*")}, false)
+	if !errors.Is(err, batch.ErrNoMatch) {
+		t.Errorf("expected ErrNoMatch, got %v", err)
+	}
+}
+
+func TestUploadDuplicate(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	root := t.TempDir()
+	cfg := &config.Config{
+		S3: server.S3("bucket"),
+		Uploader: config.Uploader{
+			Directory:      filepath.Join(root, "watched"),
+			Local:          config.Local{Directory: filepath.Join(root, "local")},
+			StateDirectory: filepath.Join(root, "state"),
+			Extensions:     []string{".fits"},
+			Sidecars:       []config.Sidecar{{Extensions: []string{".json"}, Match: config.SidecarMatchBasename}},
+			Conflict:       config.ConflictOverwrite,
+			Multipart:      config.Multipart{PartSize: 5 * 1024 * 1024, Concurrency: 1},
+		},
+		Catalog:  config.Catalog{Disabled: true},
+		RuleMode: config.RuleModeFirst,
+	}
+	cfg.S3.KeyTemplate = "frames/{{ .Name }}"
+	night := filepath.Join(root, "night")
+	if err := os.MkdirAll(night, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.fits", "a.json"} {
+		if err := os.WriteFile(filepath.Join(night, name), []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The frame is held up so the second listing reaches it while the first
+	// is still uploading it
+	server.FailWhen(func(op string, r *http.Request) int {
+		if op == s3test.OpPutObject && strings.HasSuffix(r.URL.Path, ".fits") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return 0
+	})
+
+	// A frame listed twice is uploaded once, with its sidecar beside it
+	file := batch.File{Path: filepath.Join(night, "a.fits"), Rel: "night/a.fits"}
+	results, err := batch.Upload(context.Background(), cfg, []batch.File{file, file}, batch.Options{Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	if got, want := server.Keys("bucket"), []string{"frames/a.fits", "frames/a.json"}; !slices.Equal(got, want) {
+		t.Fatalf("keys %v, want %v", got, want)
+	}
+}
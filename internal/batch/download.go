@@ -0,0 +1,209 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/rules"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/sidecar"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrUnsafeKey is returned for object keys that would be written outside the
+// destination directory.
+var ErrUnsafeKey = errors.New("Object key leaves the destination directory")
+
+// Selector picks the objects to download. Empty fields match every object.
+type Selector struct {
+	// Prefix is matched against the key below the configured prefix
+	Prefix string
+	// Headers maps FITS keywords to globs their values must match
+	Headers map[string]string
+	// Night is the date the night of the observation began, see fits.Night
+	Night string
+}
+
+// filtered reports whether the selector needs the header of each object.
+func (s Selector) filtered() bool {
+	return len(s.Headers) > 0 || s.Night != ""
+}
+
+// Object is an object to download and the outcome of downloading it.
+type Object struct {
+	Key string
+	// Rel is the key below the configured prefix and the path the object is
+	// downloaded to below the destination
+	Rel     string
+	Size    int64
+	Skipped bool
+	Err     error
+}
+
+// Select lists the objects below the prefix that match sel. Header values
+// come from the metadata stored at upload and, for objects uploaded
+// without it, from the path segments the key template wrote them to.
+// Sidecars are selected along with the frames they belong to, and objects
+// whose metadata cannot be read are skipped.
+func Select(ctx context.Context, cfg *config.Config, sel Selector, concurrency int) ([]Object, error) {
+	if concurrency < 1 {
+		return nil, ErrInvalidConcurrency
+	}
+	client, err := uploader.NewUploader(cfg, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create uploader: %w", err)
+	}
+	listed, err := client.ListObjects(ctx, cfg.S3.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(cfg.S3.Prefix, "/")
+	var candidates []Object
+	for _, object := range listed {
+		rel := object.Key
+		if prefix != "" {
+			var ok bool
+			rel, ok = strings.CutPrefix(object.Key, prefix+"/")
+			if !ok {
+				continue
+			}
+		}
+		if !strings.HasPrefix(rel, sel.Prefix) || isMarker(cfg, object.Key) {
+			continue
+		}
+		candidates = append(candidates, Object{Key: object.Key, Rel: rel, Size: object.Size})
+	}
+	if !sel.filtered() {
+		return candidates, nil
+	}
+
+	selected := make([]bool, len(candidates))
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrency)
+	for i, object := range candidates {
+		if sidecar.IsSidecar(path.Base(object.Rel), cfg.Uploader.Sidecars) {
+			continue
+		}
+		group.Go(func() error {
+			header, err := objectHeader(groupCtx, cfg, client, sel, object)
+			if err != nil {
+				if groupCtx.Err() != nil {
+					return err
+				}
+				// One unreadable object, i.e. one deleted since the
+				// listing, does not stop the rest
+				logger.Warn("failed to read metadata, skipping object", "key", object.Key, "error", err)
+				return nil
+			}
+			selected[i] = sel.matches(header)
+			return nil
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	for i, object := range candidates {
+		if selected[i] || belongsToSelected(cfg, object, candidates, selected) {
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// objectHeader returns the header values of object the selector needs, only
+// asking for its metadata if the key does not already hold them.
+func objectHeader(ctx context.Context, cfg *config.Config, client *uploader.Uploader, sel Selector, object Object) (fits.Header, error) {
+	header := fits.Header{}
+	if cfg.S3.KeyTemplate != "" {
+		for keyword, value := range rules.KeyFields(cfg.S3.KeyTemplate, object.Rel) {
+			header[keyword] = value
+		}
+	}
+	complete := sel.Night == ""
+	if complete {
+		for keyword := range sel.Headers {
+			if _, ok := header[strings.ToUpper(keyword)]; !ok {
+				complete = false
+				break
+			}
+		}
+	}
+	if complete {
+		return header, nil
+	}
+
+	info, err := client.Head(ctx, object.Key)
+	if err != nil {
+		return nil, err
+	}
+	for keyword, value := range fits.FromMetadata(info.Metadata) {
+		header[keyword] = value
+	}
+	return header, nil
+}
+
+// matches reports whether header satisfies every filter of the selector.
+func (s Selector) matches(header fits.Header) bool {
+	if !rules.MatchHeaders(s.Headers, header) {
+		return false
+	}
+	if s.Night != "" {
+		night, ok := fits.Night(header)
+		if !ok || night != s.Night {
+			return false
+		}
+	}
+	return true
+}
+
+// belongsToSelected reports whether object is a sidecar of a selected frame,
+// by the same rules the uploader grouped them with.
+func belongsToSelected(cfg *config.Config, object Object, candidates []Object, selected []bool) bool {
+	name := path.Base(object.Rel)
+	for _, rule := range cfg.Uploader.Sidecars {
+		if !slices.Contains(rule.Extensions, path.Ext(name)) {
+			continue
+		}
+		for i, frame := range candidates {
+			if !selected[i] || path.Dir(frame.Rel) != path.Dir(object.Rel) {
+				continue
+			}
+			stem := strings.TrimSuffix(path.Base(frame.Rel), path.Ext(frame.Rel)) + "."
+			if rule.Match == config.SidecarMatchDirectory || strings.HasPrefix(name, stem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Download downloads objects below dest, concurrency at a time, and sets
+// the outcome of each. Objects already present with the same checksum are
+// skipped and interrupted downloads are resumed.
+func Download(ctx context.Context, cfg *config.Config, objects []Object, dest string, concurrency int) error {
+	return forEach(cfg, nil, len(objects), concurrency, func(worker *uploader.Uploader, i int) {
+		object := &objects[i]
+		if !filepath.IsLocal(filepath.FromSlash(object.Rel)) {
+			object.Err = fmt.Errorf("%w: %s", ErrUnsafeKey, object.Key)
+			return
+		}
+		dst := filepath.Join(dest, filepath.FromSlash(object.Rel))
+		downloaded, err := worker.Download(ctx, object.Key, dst)
+		object.Skipped = err == nil && !downloaded
+		object.Err = err
+		if err != nil {
+			logger.Error("failed to download object", "key", object.Key, "path", dst, "error", err)
+		}
+	})
+}
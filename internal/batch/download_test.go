@@ -0,0 +1,83 @@
+package batch_test
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/batch"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/s3test"
+)
+
+func TestSelect(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	root := t.TempDir()
+	cfg := &config.Config{
+		S3: server.S3("bucket"),
+		Uploader: config.Uploader{
+			Directory:      filepath.Join(root, "watched"),
+			StateDirectory: filepath.Join(root, "state"),
+			Sidecars:       []config.Sidecar{{Extensions: []string{".json"}, Match: config.SidecarMatchBasename}},
+			CompleteMarker: config.CompleteMarker{Enabled: true, Name: "_COMPLETE"},
+		},
+		Catalog: config.Catalog{Disabled: true},
+	}
+	cfg.S3.Prefix = "archive"
+
+	for key, metadata := range map[string]map[string]string{
+		// Taken at 21:00 local solar time on the 13th, 11:00 UTC
+		"archive/n1/a.fits":    {"fits-object": "M31", "fits-date-obs": "2026-09-13T11:00:00.5", "fits-sitelong": "150"},
+		"archive/n1/a.json":    nil,
+		"archive/n1/b.fits":    {"fits-object": "M31", "fits-date-loc": "2026-09-13T01:00:00"},
+		"archive/n1/c.fits":    {"fits-object": "M31", "fits-date-loc": "2026-09-13T22:00:00"},
+		"archive/n2/d.fits":    {"fits-object": "M42", "fits-date-loc": "2026-09-13T22:00:00"},
+		"archive/n1/_COMPLETE": nil,
+		"archive-old/x.fits":   {"fits-object": "M31", "fits-date-loc": "2026-09-13T22:00:00"},
+	} {
+		server.Put("bucket", key, s3test.Object{Data: []byte(key), Metadata: metadata})
+	}
+	// An object whose metadata cannot be read is skipped
+	server.FailWhen(func(op string, r *http.Request) int {
+		if op == s3test.OpHeadObject && strings.HasSuffix(r.URL.Path, "/c.fits") {
+			return http.StatusForbidden
+		}
+		return 0
+	})
+
+	tests := []struct {
+		name string
+		sel  batch.Selector
+		want []string
+	}{
+		{"all", batch.Selector{}, []string{"n1/a.fits", "n1/a.json", "n1/b.fits", "n1/c.fits", "n2/d.fits"}},
+		{"prefix", batch.Selector{Prefix: "n2/"}, []string{"n2/d.fits"}},
+		{"night", batch.Selector{Headers: map[string]string{"OBJECT": "M31"}, Night: "2026-09-13"}, []string{"n1/a.fits", "n1/a.json"}},
+		{"previous night", batch.Selector{Night: "2026-09-12"}, []string{"n1/b.fits"}},
+		{"header", batch.Selector{Headers: map[string]string{"OBJECT": "M4*"}}, []string{"n2/d.fits"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			objects, err := batch.Select(context.Background(), cfg, tt.sel, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(objects))
+			for _, object := range objects {
+				if object.Key != path.Join("archive", object.Rel) {
+					t.Errorf("object %s has path %s", object.Key, object.Rel)
+				}
+				got = append(got, object.Rel)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package batch
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/sidecar"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/watcher"
+	"golang.org/x/sync/errgroup"
+)
+
+// Reasons a change is part of a sync plan
+const (
+	ReasonMissing         = "missing"
+	ReasonSizeDiffers     = "size differs"
+	ReasonChecksumDiffers = "checksum differs"
+	ReasonNotFoundLocally = "not found locally"
+)
+
+// Change is an object a sync writes or deletes.
+type Change struct {
+	// File is the local file to upload, empty for a delete
+	File
+	Bucket string
+	Key    string
+	Size   int64
+	// Sidecar is set for a sidecar, which is uploaded beside its frame
+	Sidecar bool
+	Delete  bool
+	Reason  string
+	Err     error
+}
+
+// SyncPlan lists the changes that make the prefix match a local tree.
+type SyncPlan struct {
+	Changes   []Change
+	Unchanged int
+}
+
+// PlanSync compares the files below dir, as the watcher would pick them and
+// with their sidecars, to the objects below the prefix. Each file is
+// compared to the object the daemon would upload it to, in the bucket the
+// rules choose and with sidecars beside their frames. Objects are matched
+// by key, then by size unless they are stored encoded and, if they were
+// uploaded with one, by checksum. Objects in the configured bucket with no
+// local file are only deleted if deleteRemote is set.
+func PlanSync(ctx context.Context, cfg *config.Config, dir string, deleteRemote bool, concurrency int) (*SyncPlan, error) {
+	if concurrency < 1 {
+		return nil, ErrInvalidConcurrency
+	}
+	frames, sidecars, err := collectTree(cfg, dir)
+	if err != nil {
+		return nil, err
+	}
+	client, err := uploader.NewUploader(cfg, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create uploader: %w", err)
+	}
+
+	targets, err := planTargets(ctx, cfg, client, frames, sidecars, concurrency)
+	if err != nil {
+		return nil, err
+	}
+	remote := map[string]map[string]int64{cfg.S3.Bucket: nil}
+	for _, target := range targets {
+		remote[target.Bucket] = nil
+	}
+	var objects []uploader.Object
+	for bucket := range remote {
+		listed, err := client.ListObjects(ctx, bucket)
+		if err != nil {
+			return nil, err
+		}
+		remote[bucket] = make(map[string]int64, len(listed))
+		for _, object := range listed {
+			remote[bucket][object.Key] = object.Size
+		}
+		if bucket == cfg.S3.Bucket {
+			objects = listed
+		}
+	}
+
+	plan := &SyncPlan{}
+	var lock sync.Mutex
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrency)
+	for _, target := range targets {
+		group.Go(func() error {
+			change, err := planFile(groupCtx, client, remote[target.Bucket], target)
+			if err != nil {
+				return fmt.Errorf("failed to compare %s: %w", target.Path, err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if change.Reason == "" {
+				plan.Unchanged++
+			} else {
+				plan.Changes = append(plan.Changes, change)
+			}
+			return nil
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	if deleteRemote {
+		local := make(map[string]bool, len(targets))
+		for _, target := range targets {
+			if target.Bucket == cfg.S3.Bucket {
+				local[target.Key] = true
+			}
+		}
+		for _, object := range objects {
+			if local[object.Key] || isMarker(cfg, object.Key) {
+				continue
+			}
+			plan.Changes = append(plan.Changes, Change{Bucket: cfg.S3.Bucket, Key: object.Key, Size: object.Size, Delete: true, Reason: ReasonNotFoundLocally})
+		}
+	}
+	slices.SortFunc(plan.Changes, func(a, b Change) int {
+		return cmp.Or(cmp.Compare(a.Bucket, b.Bucket), cmp.Compare(a.Key, b.Key))
+	})
+	return plan, nil
+}
+
+// target is a local file and the object it would be uploaded to.
+type target struct {
+	File
+	uploader.Target
+	Sidecar bool
+}
+
+// planTargets resolves the objects frames and sidecars would be uploaded to.
+// A sidecar goes beside every frame it belongs to, or to the key of its own
+// if it belongs to none.
+func planTargets(ctx context.Context, cfg *config.Config, client *uploader.Uploader, frames, sidecars []File, concurrency int) ([]target, error) {
+	resolve := func(files []File) ([]uploader.Target, error) {
+		resolved := make([]uploader.Target, len(files))
+		group, _ := errgroup.WithContext(ctx)
+		group.SetLimit(concurrency)
+		for i, file := range files {
+			group.Go(func() error {
+				var err error
+				resolved[i], err = client.Destination(file.Path, file.Rel)
+				if err != nil {
+					return fmt.Errorf("failed to resolve object key of %s: %w", file.Path, err)
+				}
+				return nil
+			})
+		}
+		return resolved, group.Wait()
+	}
+	frameTargets, err := resolve(frames)
+	if err != nil {
+		return nil, err
+	}
+	sidecarTargets, err := resolve(sidecars)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]target, 0, len(frames)+len(sidecars))
+	locations := make(map[string][]uploader.Location)
+	for i, frame := range frames {
+		targets = append(targets, target{File: frame, Target: frameTargets[i]})
+		for _, groupPath := range sidecar.Group(frame.Path, cfg.Uploader.Sidecars)[1:] {
+			if loc := frameTargets[i].Location(); !slices.Contains(locations[groupPath], loc) {
+				locations[groupPath] = append(locations[groupPath], loc)
+			}
+		}
+	}
+	for i, file := range sidecars {
+		if len(locations[file.Path]) == 0 {
+			targets = append(targets, target{File: file, Target: sidecarTargets[i]})
+			continue
+		}
+		for _, loc := range locations[file.Path] {
+			beside := sidecarTargets[i]
+			beside.Bucket, beside.Key = loc.Bucket, loc.Key(filepath.Base(file.Path))
+			targets = append(targets, target{File: file, Target: beside, Sidecar: true})
+		}
+	}
+	return targets, nil
+}
+
+// planFile returns the change target needs against the sizes of the objects
+// in its bucket, with an empty reason if it is already up to date.
+func planFile(ctx context.Context, client *uploader.Uploader, remote map[string]int64, target target) (Change, error) {
+	info, err := os.Stat(target.Path)
+	if err != nil {
+		return Change{}, err
+	}
+	change := Change{File: target.File, Bucket: target.Bucket, Key: target.Key, Size: info.Size(), Sidecar: target.Sidecar}
+	remoteSize, ok := remote[target.Key]
+	switch {
+	case !ok:
+		change.Reason = ReasonMissing
+	case !target.Staged && remoteSize != info.Size():
+		change.Reason = ReasonSizeDiffers
+	default:
+		_, identical, err := client.Compare(ctx, target.Bucket, target.Key, target.Path)
+		if err != nil {
+			return Change{}, err
+		}
+		if !identical {
+			change.Reason = ReasonChecksumDiffers
+		}
+	}
+	return change, nil
+}
+
+// isMarker reports whether key is a complete marker, which has no local file.
+func isMarker(cfg *config.Config, key string) bool {
+	return cfg.Uploader.CompleteMarker.Enabled && path.Base(key) == cfg.Uploader.CompleteMarker.Name
+}
+
+// collectTree returns the files below dir the watcher would upload and the
+// sidecars besides them, keyed by their path below dir.
+func collectTree(cfg *config.Config, dir string) ([]File, []File, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var frames, sidecars []File
+	err = filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		frame := watcher.Watched(cfg, dir, filePath)
+		if !frame && !sidecar.IsSidecar(entry.Name(), cfg.Uploader.Sidecars) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		file := File{Path: filePath, Rel: filepath.ToSlash(rel)}
+		if frame {
+			frames = append(frames, file)
+		} else {
+			sidecars = append(sidecars, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to walk %s: %w", dir, err)
+	}
+	return frames, sidecars, nil
+}
+
+// Sync carries out plan, uploading concurrency files at a time, and sets the
+// error of each change that failed. Objects are replaced regardless of the
+// conflict policy, as the plan already decided they differ.
+func Sync(ctx context.Context, cfg *config.Config, plan *SyncPlan, concurrency int) error {
+	overwrite := *cfg
+	overwrite.Uploader.Conflict = config.ConflictOverwrite
+
+	var deletes []string
+	for _, change := range plan.Changes {
+		if change.Delete {
+			deletes = append(deletes, change.Key)
+		}
+	}
+	record := openCatalog(cfg)
+	defer record.Close()
+	err := forEach(&overwrite, record, len(plan.Changes), concurrency, func(worker *uploader.Uploader, i int) {
+		change := &plan.Changes[i]
+		switch {
+		case change.Delete:
+		case change.Sidecar:
+			loc := uploader.Location{Bucket: change.Bucket, Dir: path.Dir(change.Key)}
+			change.Err = worker.UploadInto(ctx, change.Path, change.Rel, loc)
+		default:
+			_, change.Err = worker.UploadAs(ctx, change.Path, change.Rel)
+		}
+	})
+	if err != nil || len(deletes) == 0 {
+		return err
+	}
+
+	client, err := uploader.NewUploader(&overwrite, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create uploader: %w", err)
+	}
+	errs := client.DeleteObjects(ctx, deletes)
+	for i := range plan.Changes {
+		if plan.Changes[i].Delete {
+			plan.Changes[i].Err = errs[plan.Changes[i].Key]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package batch_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/batch"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/s3test"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+)
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket", "flats")
+	root := t.TempDir()
+	tree := filepath.Join(root, "tree")
+	cfg := &config.Config{
+		S3: server.S3("bucket"),
+		Uploader: config.Uploader{
+			Directory:      filepath.Join(root, "watched"),
+			Local:          config.Local{Directory: filepath.Join(root, "local")},
+			StateDirectory: filepath.Join(root, "state"),
+			Extensions:     []string{".fits"},
+			Sidecars:       []config.Sidecar{{Extensions: []string{".json"}, Match: config.SidecarMatchBasename}},
+			CompleteMarker: config.CompleteMarker{Enabled: true, Name: "_COMPLETE"},
+			Conflict:       config.ConflictOverwrite,
+			Multipart:      config.Multipart{PartSize: 5 * 1024 * 1024, Concurrency: 1},
+		},
+		Catalog:  config.Catalog{Disabled: true},
+		RuleMode: config.RuleModeFirst,
+		Rules: []config.Rule{
+			{Match: config.RuleMatch{Paths: []string{"flats/**"}}, Object: config.ObjectOptions{Bucket: "flats"}},
+			{Match: config.RuleMatch{Paths: []string{"darks/**"}}, Object: config.ObjectOptions{Compression: config.CompressionGzip}},
+		},
+	}
+	cfg.S3.Prefix = "archive"
+
+	files := map[string]string{
+		"n1/a.fits":    "frame a",
+		"n1/a.json":    "{}",
+		"n1/b.fits":    "frame b",
+		"n1/c.fits":    "frame c",
+		"n1/d.fits":    "frame d",
+		"flats/f.fits": "flat f",
+		"darks/k.fits": "dark k dark k dark k dark k",
+	}
+	for rel, data := range files {
+		path := filepath.Join(tree, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func(data string) s3test.Object {
+		sum := sha256.Sum256([]byte(data))
+		return s3test.Object{Data: []byte(data), Metadata: map[string]string{uploader.MetadataSHA256: hex.EncodeToString(sum[:])}}
+	}
+	server.Put("bucket", "archive/n1/b.fits", stored("frame b"))
+	server.Put("bucket", "archive/n1/c.fits", stored("frame c, longer"))
+	server.Put("bucket", "archive/n1/d.fits", stored("frame D"))
+	server.Put("flats", "archive/flats/f.fits", stored("flat f"))
+	server.Put("flats", "archive/flats/other.fits", stored("other"))
+	server.Put("bucket", "archive/old.fits", stored("old"))
+	server.Put("bucket", "archive/n1/_COMPLETE", stored("{}"))
+	server.Put("bucket", "archive-old/x.fits", stored("x"))
+
+	plan, err := batch.PlanSync(context.Background(), cfg, tree, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"bucket/archive/darks/k.fits": batch.ReasonMissing,
+		"bucket/archive/n1/a.fits":    batch.ReasonMissing,
+		"bucket/archive/n1/a.json":    batch.ReasonMissing,
+		"bucket/archive/n1/c.fits":    batch.ReasonSizeDiffers,
+		"bucket/archive/n1/d.fits":    batch.ReasonChecksumDiffers,
+		"bucket/archive/old.fits":     batch.ReasonNotFoundLocally,
+	}
+	if len(plan.Changes) != len(want) || plan.Unchanged != 2 {
+		t.Fatalf("plan has %d changes and %d unchanged: %+v", len(plan.Changes), plan.Unchanged, plan.Changes)
+	}
+	for _, change := range plan.Changes {
+		if reason := want[change.Bucket+"/"+change.Key]; reason != change.Reason {
+			t.Errorf("%s/%s: reason %q, want %q", change.Bucket, change.Key, change.Reason, reason)
+		}
+	}
+
+	err = batch.Sync(context.Background(), cfg, plan, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range plan.Changes {
+		if change.Err != nil {
+			t.Errorf("%s: %v", change.Key, change.Err)
+		}
+	}
+	if _, ok := server.Object("bucket", "archive/old.fits"); ok {
+		t.Error("object with no local file was not deleted")
+	}
+	// Only objects of the prefix itself are deleted, and never markers or
+	// objects of other buckets
+	for _, kept := range []struct{ bucket, key string }{
+		{"bucket", "archive-old/x.fits"},
+		{"bucket", "archive/n1/_COMPLETE"},
+		{"flats", "archive/flats/other.fits"},
+	} {
+		if _, ok := server.Object(kept.bucket, kept.key); !ok {
+			t.Errorf("%s/%s was deleted", kept.bucket, kept.key)
+		}
+	}
+	if object, _ := server.Object("bucket", "archive/darks/k.fits"); object.ContentEncoding != "gzip" {
+		t.Errorf("rule did not compress the dark, encoding %q", object.ContentEncoding)
+	}
+
+	// Compressed objects differ in size but match by checksum
+	plan, err = batch.PlanSync(context.Background(), cfg, tree, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 || plan.Unchanged != len(files) {
+		t.Fatalf("synced tree has %d unchanged and changes %+v", plan.Unchanged, plan.Changes)
+	}
+}
@@ -0,0 +1,370 @@
+package catalog
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/rules"
+	bolt "go.etcd.io/bbolt"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("catalog")
+
+const (
+	filesBucket = "files"
+	// openTimeout bounds the wait for another process holding the
+	// database, which keeps it open until it exits
+	openTimeout = time.Second
+	// copyAttempts bounds the copies a query takes of a database that is
+	// written to while it is copied
+	copyAttempts = 3
+)
+
+// ErrInUse is returned when another process, i.e. the daemon, holds the
+// catalog open.
+var ErrInUse = errors.New("Catalog is in use by another process")
+
+// Status is the outcome of the last attempt to upload a file.
+type Status string
+
+const (
+	StatusUploaded     Status = "uploaded"
+	StatusFailed       Status = "failed"
+	StatusDeadLettered Status = "dead-lettered"
+)
+
+// Keywords are the FITS header keywords kept for each file.
+//
+//nolint:gochecknoglobals
+var Keywords = []string{
+	"OBJECT", "FILTER", "IMAGETYP", "DATE-OBS", "DATE-LOC", "EXPTIME", "EXPOSURE",
+	"XBINNING", "YBINNING", "GAIN", "OFFSET", "CCD-TEMP", "TELESCOP", "INSTRUME", "RA", "DEC", "SITELONG",
+}
+
+// Entry is the record of one file, identified by its profile, bucket and
+// its path below the watched directory so it follows the file into the
+// local directory and across retries.
+type Entry struct {
+	// Profile is the profile that handled the file, empty for the default
+	// profile and the upload and sync commands
+	Profile    string      `json:"profile,omitempty"`
+	Path       string      `json:"path"`
+	Rel        string      `json:"rel"`
+	Bucket     string      `json:"bucket"`
+	Key        string      `json:"key"`
+	Size       int64       `json:"size"`
+	SHA256     string      `json:"sha256"`
+	VersionID  string      `json:"version-id"`
+	Status     Status      `json:"status"`
+	Error      string      `json:"error"`
+	Attempts   int         `json:"attempts"`
+	UploadedAt time.Time   `json:"uploaded-at"`
+	UpdatedAt  time.Time   `json:"updated-at"`
+	Header     fits.Header `json:"header"`
+	// Metadata is what the source reported along with the file, such as the
+	// HFR measured by N.I.N.A.
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (e Entry) id() []byte {
+	// Bucket names cannot hold a colon, so the ids of the default profile
+	// stay those of earlier versions
+	if e.Profile != "" {
+		return []byte(e.Profile + ":" + e.Bucket + "/" + e.Rel)
+	}
+	return []byte(e.Bucket + "/" + e.Rel)
+}
+
+// Exposure returns the exposure time of the frame from its header, zero if
+// it has none.
+func (e Entry) Exposure() time.Duration {
+	for _, keyword := range []string{"EXPTIME", "EXPOSURE"} {
+		seconds, err := strconv.ParseFloat(e.Header[keyword], 64)
+		if err == nil {
+			return time.Duration(seconds * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// Night returns the date the night of the observation began, see fits.Night.
+func (e Entry) Night() string {
+	night, _ := fits.Night(e.Header)
+	return night
+}
+
+// Filter selects entries. Empty fields match every entry.
+type Filter struct {
+	// Headers maps FITS keywords to globs their values must match
+	Headers map[string]string
+	Night   string
+	Status  Status
+	// Since and Until bound the time the file was last handled
+	Since time.Time
+	Until time.Time
+}
+
+// Match reports whether entry satisfies every field of the filter.
+func (f Filter) Match(entry Entry) bool {
+	switch {
+	case f.Status != "" && entry.Status != f.Status:
+		return false
+	case !f.Since.IsZero() && entry.UpdatedAt.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !entry.UpdatedAt.Before(f.Until):
+		return false
+	case f.Night != "" && entry.Night() != f.Night:
+		return false
+	}
+	return rules.MatchHeaders(f.Headers, entry.Header)
+}
+
+// Catalog is the local database of every file handled. The process that
+// writes to it keeps it open throughout, queries from another process read
+// a copy in the meantime.
+type Catalog struct {
+	db *bolt.DB
+	// profile is recorded with the entries written through the catalog
+	profile string
+}
+
+// Open opens the configured catalog, creating it if needed, or returns nil
+// if it is disabled. It fails with ErrInUse if another process holds it.
+func Open(cfg config.Catalog) (*Catalog, error) {
+	if cfg.Disabled {
+		return nil, nil
+	}
+	err := os.MkdirAll(filepath.Dir(cfg.Path), 0o700)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(cfg.Path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s", ErrInUse, cfg.Path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open catalog: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(filesBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open catalog: %w", err)
+	}
+	return &Catalog{db: db}, nil
+}
+
+// Close closes the catalog and every view of it.
+func (c *Catalog) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+// Profile returns a view of the catalog that records entries as handled by
+// profile, so files at the same path below the directories of different
+// profiles do not replace each other. The default profile records entries
+// without one. A nil catalog has nil views.
+func (c *Catalog) Profile(name string) *Catalog {
+	if c == nil {
+		return nil
+	}
+	if name == config.DefaultProfileName {
+		name = ""
+	}
+	return &Catalog{db: c.db, profile: name}
+}
+
+func (c *Catalog) update(fn func(files *bolt.Bucket) error) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket([]byte(filesBucket)))
+	})
+}
+
+// Record stores the outcome of an upload attempt, counting it towards the
+// attempts of the file. What a failed attempt did not get to learn, such as
+// the key, is kept from earlier attempts.
+func (c *Catalog) Record(entry Entry) error {
+	entry.Profile = c.profile
+	entry.UpdatedAt = time.Now()
+	header := fits.Header{}
+	for _, keyword := range Keywords {
+		if value, ok := entry.Header[keyword]; ok {
+			header[keyword] = value
+		}
+	}
+	entry.Header = header
+
+	return c.update(func(files *bolt.Bucket) error {
+		var previous Entry
+		if data := files.Get(entry.id()); data != nil {
+			if err := json.Unmarshal(data, &previous); err != nil {
+				logger.Warn("replacing unreadable catalog entry", "path", entry.Path, "error", err)
+			}
+		}
+		entry.Attempts = previous.Attempts + 1
+		if entry.Status == StatusUploaded {
+			entry.UploadedAt = entry.UpdatedAt
+		} else {
+			entry.UploadedAt = previous.UploadedAt
+			entry.Key = cmp.Or(entry.Key, previous.Key)
+			entry.SHA256 = cmp.Or(entry.SHA256, previous.SHA256)
+			entry.VersionID = cmp.Or(entry.VersionID, previous.VersionID)
+			if len(entry.Header) == 0 {
+				entry.Header = previous.Header
+			}
+		}
+		if len(entry.Metadata) == 0 {
+			// Retries from the local directory no longer know it
+			entry.Metadata = previous.Metadata
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal catalog entry: %w", err)
+		}
+		return files.Put(entry.id(), data)
+	})
+}
+
+// SetStatus changes the status of the file at rel in bucket, if it has been
+// recorded, without counting an attempt.
+func (c *Catalog) SetStatus(bucket, rel string, status Status, reason string) error {
+	id := Entry{Profile: c.profile, Bucket: bucket, Rel: rel}.id()
+	return c.update(func(files *bolt.Bucket) error {
+		data := files.Get(id)
+		if data == nil {
+			return nil
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to unmarshal catalog entry: %w", err)
+		}
+		entry.Status = status
+		entry.Error = reason
+		entry.UpdatedAt = time.Now()
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal catalog entry: %w", err)
+		}
+		return files.Put(id, data)
+	})
+}
+
+// Entries returns the entries matching filter, oldest first.
+func (c *Catalog) Entries(filter Filter) ([]Entry, error) {
+	return entries(c.db, filter)
+}
+
+// Query returns the entries matching filter from the catalog at path, oldest
+// first. A catalog that was never written to has no entries. A catalog the
+// daemon holds open is read from a copy, which is taken again if a write
+// tore it.
+func Query(path string, filter Filter) ([]Entry, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if errors.Is(err, bolt.ErrTimeout) {
+		return queryCopy(path, filter)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open catalog: %w", err)
+	}
+	defer db.Close()
+	return entries(db, filter)
+}
+
+// queryCopy queries a consistent copy of the catalog at path.
+func queryCopy(path string, filter Filter) ([]Entry, error) {
+	var err error
+	for range copyAttempts {
+		var result []Entry
+		result, err = func() ([]Entry, error) {
+			copied, err := copyFile(path)
+			if err != nil {
+				return nil, err
+			}
+			defer os.Remove(copied)
+			db, err := bolt.Open(copied, 0o600, &bolt.Options{ReadOnly: true})
+			if err != nil {
+				return nil, err
+			}
+			defer db.Close()
+			err = db.View(func(tx *bolt.Tx) error {
+				var errs []error
+				for err := range tx.Check() {
+					errs = append(errs, err)
+				}
+				return errors.Join(errs...)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return entries(db, filter)
+		}()
+		if err == nil {
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to read copy of catalog: %w", err)
+}
+
+// copyFile copies the file at path to a temporary file and returns its path.
+func copyFile(path string) (string, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	copied, err := os.CreateTemp("", "catalog-*.db")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(copied, source)
+	if closeErr := copied.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(copied.Name())
+		return "", err
+	}
+	return copied.Name(), nil
+}
+
+func entries(db *bolt.DB, filter Filter) ([]Entry, error) {
+	var entries []Entry
+	err := db.View(func(tx *bolt.Tx) error {
+		files := tx.Bucket([]byte(filesBucket))
+		if files == nil {
+			return nil
+		}
+		return files.ForEach(func(id, data []byte) error {
+			var entry Entry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				logger.Warn("skipping unreadable catalog entry", "id", string(id), "error", err)
+				return nil
+			}
+			if filter.Match(entry) {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	slices.SortFunc(entries, func(a, b Entry) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+	return entries, nil
+}
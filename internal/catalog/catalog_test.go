@@ -0,0 +1,90 @@
+package catalog_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/catalog"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+)
+
+func TestRecord(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "catalog.db")
+	c, err := catalog.Open(config.Catalog{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	entries, err := c.Entries(catalog.Filter{})
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected an empty catalog, got %v, %v", entries, err)
+	}
+
+	header := fits.Header{"OBJECT": "NGC 7000", "FILTER": "Ha", "EXPTIME": "300.0", "DATE-LOC": "2026-09-13T01:00:00", "NAXIS": "2"}
+	frame := catalog.Entry{Path: "/src/n1/a.fits", Rel: "n1/a.fits", Bucket: "bucket", Key: "n1/a.fits", Header: header, Status: catalog.StatusFailed, Error: "offline"}
+	if err := c.Record(frame); err != nil {
+		t.Fatal(err)
+	}
+	frame.Path = "/local/n1/a.fits"
+	frame.Status = catalog.StatusUploaded
+	frame.Error = ""
+	frame.VersionID = "v1"
+	if err := c.Record(frame); err != nil {
+		t.Fatal(err)
+	}
+	other := catalog.Entry{Rel: "n1/b.fits", Bucket: "bucket", Header: fits.Header{"OBJECT": "M31", "FILTER": "Ha"}, Status: catalog.StatusFailed}
+	if err := c.Record(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetStatus("bucket", "n1/b.fits", catalog.StatusDeadLettered, "gave up"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = c.Entries(catalog.Filter{Headers: map[string]string{"object": "ngc*"}, Night: "2026-09-12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %d", len(entries))
+	}
+	got := entries[0]
+	if got.Attempts != 2 || got.Status != catalog.StatusUploaded || got.Path != "/local/n1/a.fits" || got.VersionID != "v1" || got.UploadedAt.IsZero() {
+		t.Errorf("unexpected entry %+v", got)
+	}
+	if _, ok := got.Header["NAXIS"]; ok {
+		t.Error("expected only the catalog keywords to be kept")
+	}
+	if got.Exposure() != 5*time.Minute {
+		t.Errorf("expected 5m exposure, got %s", got.Exposure())
+	}
+
+	entries, err = c.Entries(catalog.Filter{Status: catalog.StatusDeadLettered, Since: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Rel != "n1/b.fits" || entries[0].Error != "gave up" {
+		t.Errorf("expected the dead-lettered entry, got %+v", entries)
+	}
+
+	// Profiles keep apart files at the same path
+	rig := c.Profile("rig2")
+	if err := rig.Record(catalog.Entry{Rel: "n1/b.fits", Bucket: "bucket", Status: catalog.StatusUploaded}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rig.SetStatus("bucket", "n1/b.fits", catalog.StatusFailed, "offline"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A query from another process reads a copy while the catalog is open
+	entries, err = catalog.Query(path, catalog.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[1].Status != catalog.StatusDeadLettered || entries[2].Profile != "rig2" || entries[2].Status != catalog.StatusFailed {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
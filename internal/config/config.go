@@ -4,10 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"gopkg.in/yaml.v3"
@@ -25,36 +30,495 @@ const (
 // Config stores the application configuration.
 type Config struct {
 	LogLevel LogLevel `json:"log-level" yaml:"log-level"`
+	Log      Log      `json:"log" yaml:"log"`
 
 	S3       S3       `json:"s3" yaml:"s3"`
 	Uploader Uploader `json:"uploader" yaml:"uploader"`
+	Rules    []Rule   `json:"rules" yaml:"rules"`
+	// RuleMode decides whether the first matching rule or every matching
+	// rule applies to a file
+	RuleMode RuleMode `json:"rule-mode" yaml:"rule-mode"`
+
+	// Profiles run several independent uploads in one process, each
+	// overriding parts of the config above. Without profiles the config
+	// above is the only profile.
+	Profiles []Profile `json:"profiles" yaml:"profiles"`
+	// Bandwidth limits the upload rate of all profiles together in bytes
+	// per second, zero is unlimited
+	Bandwidth Size    `json:"bandwidth" yaml:"bandwidth"`
+	Metrics   Metrics `json:"metrics" yaml:"metrics"`
+	Catalog   Catalog `json:"catalog" yaml:"catalog"`
+}
+
+// Catalog configures the local record of every file handled, which the
+// catalog query command reads. Profiles share one catalog.
+type Catalog struct {
+	Disabled bool `json:"disabled" yaml:"disabled"`
+	// Path is the catalog database, catalog.db in the state directory if unset
+	Path string `json:"path" yaml:"path"`
+}
+
+// Metrics configures the Prometheus metrics endpoint.
+type Metrics struct {
+	// Listen is the address to serve /metrics on, empty disables it
+	Listen string `json:"listen" yaml:"listen"`
 }
 
 type S3 struct {
-	Region   string `json:"region" yaml:"region"`
-	Bucket   string `json:"bucket" yaml:"bucket"`
-	Prefix   string `json:"prefix" yaml:"prefix"`
-	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	Region      string      `json:"region" yaml:"region"`
+	Bucket      string      `json:"bucket" yaml:"bucket"`
+	Prefix      string      `json:"prefix" yaml:"prefix"`
+	Endpoint    string      `json:"endpoint" yaml:"endpoint"`
+	Encryption  Encryption  `json:"encryption" yaml:"encryption"`
+	Credentials Credentials `json:"credentials" yaml:"credentials"`
+	Addressing  Addressing  `json:"addressing" yaml:"addressing"`
+	// Checksum is the additional checksum S3 verifies each upload and part
+	// against. Not every S3-compatible store supports one
+	Checksum Checksum `json:"checksum" yaml:"checksum"`
+	TLS      TLS      `json:"tls" yaml:"tls"`
+	// Proxy is an HTTP proxy URL, the HTTPS_PROXY environment variable is used if unset
+	Proxy string `json:"proxy" yaml:"proxy"`
+	// KeyTemplate renders the object key below the prefix, the path relative
+	// to the watched directory is used if unset
+	KeyTemplate string `json:"key-template" yaml:"key-template"`
+}
+
+type Addressing string
+
+const (
+	// AddressingAuto uses path-style addressing only with a custom endpoint
+	AddressingAuto    Addressing = "auto"
+	AddressingPath    Addressing = "path"
+	AddressingVirtual Addressing = "virtual"
+)
+
+type Checksum string
+
+const (
+	ChecksumNone   Checksum = "none"
+	ChecksumCRC32  Checksum = "crc32"
+	ChecksumCRC32C Checksum = "crc32c"
+	ChecksumSHA1   Checksum = "sha1"
+	ChecksumSHA256 Checksum = "sha256"
+)
+
+// TLS configures the connection to S3-compatible stores with private CAs.
+type TLS struct {
+	CAFile             string `json:"ca-file" yaml:"ca-file"`
+	CertFile           string `json:"cert-file" yaml:"cert-file"`
+	KeyFile            string `json:"key-file" yaml:"key-file"`
+	InsecureSkipVerify bool   `json:"insecure-skip-verify" yaml:"insecure-skip-verify"`
+}
+
+// Credentials selects where S3 credentials come from. When nothing is set the
+// default AWS credential chain is used. Secrets can be read from files with the
+// _FILE variants, i.e. secret-access-key-file.
+type Credentials struct {
+	Profile             string      `json:"profile" yaml:"profile"`
+	AccessKeyID         string      `json:"access-key-id" yaml:"access-key-id"`
+	AccessKeyIDFile     string      `json:"access-key-id-file" yaml:"access-key-id-file"`
+	SecretAccessKey     string      `json:"secret-access-key" yaml:"secret-access-key"`
+	SecretAccessKeyFile string      `json:"secret-access-key-file" yaml:"secret-access-key-file"`
+	SessionToken        string      `json:"session-token" yaml:"session-token"`
+	SessionTokenFile    string      `json:"session-token-file" yaml:"session-token-file"`
+	AssumeRole          AssumeRole  `json:"assume-role" yaml:"assume-role"`
+	WebIdentity         WebIdentity `json:"web-identity" yaml:"web-identity"`
+}
+
+// AssumeRole assumes a role on top of the other configured credentials.
+type AssumeRole struct {
+	RoleARN     string        `json:"role-arn" yaml:"role-arn"`
+	ExternalID  string        `json:"external-id" yaml:"external-id"`
+	SessionName string        `json:"session-name" yaml:"session-name"`
+	Duration    time.Duration `json:"duration" yaml:"duration"`
+}
+
+// WebIdentity exchanges an OIDC token file for role credentials.
+type WebIdentity struct {
+	RoleARN     string `json:"role-arn" yaml:"role-arn"`
+	TokenFile   string `json:"token-file" yaml:"token-file"`
+	SessionName string `json:"session-name" yaml:"session-name"`
+}
+
+type EncryptionMode string
+
+const (
+	EncryptionModeNone   EncryptionMode = "none"
+	EncryptionModeSSES3  EncryptionMode = "SSE-S3"
+	EncryptionModeSSEKMS EncryptionMode = "SSE-KMS"
+	EncryptionModeSSEC   EncryptionMode = "SSE-C"
+)
+
+// Encryption configures server-side encryption of uploaded objects.
+type Encryption struct {
+	Mode EncryptionMode `json:"mode" yaml:"mode"`
+	// KMSKeyID is optional with SSE-KMS, the AWS managed key is used if unset
+	KMSKeyID  string `json:"kms-key-id" yaml:"kms-key-id"`
+	BucketKey bool   `json:"bucket-key" yaml:"bucket-key"`
+	// CustomerKeyFile holds the 256-bit SSE-C key, raw or base64 encoded
+	CustomerKeyFile string `json:"customer-key-file" yaml:"customer-key-file"`
 }
 
 type Uploader struct {
-	Directory  string        `json:"directory" yaml:"directory"`
-	Extensions []string      `json:"extensions" yaml:"extensions"`
-	Local      Local         `json:"local" yaml:"local"`
-	Delay      time.Duration `json:"delay" yaml:"delay"`
+	Directory  string   `json:"directory" yaml:"directory"`
+	Extensions []string `json:"extensions" yaml:"extensions"`
+	// Include limits uploads to files whose path relative to the directory
+	// matches one of these globs, every file is included if unset
+	Include        []string       `json:"include" yaml:"include"`
+	Local          Local          `json:"local" yaml:"local"`
+	Delay          time.Duration  `json:"delay" yaml:"delay"`
+	Sidecars       []Sidecar      `json:"sidecars" yaml:"sidecars"`
+	CompleteMarker CompleteMarker `json:"complete-marker" yaml:"complete-marker"`
+	// StateDirectory holds state that must survive restarts, such as
+	// in-progress multipart uploads
+	StateDirectory string    `json:"state-directory" yaml:"state-directory"`
+	Multipart      Multipart `json:"multipart" yaml:"multipart"`
+	// Conflict decides what happens when the destination key already exists
+	Conflict   ConflictPolicy `json:"conflict" yaml:"conflict"`
+	PostUpload PostUpload     `json:"post-upload" yaml:"post-upload"`
+	Retry      Retry          `json:"retry" yaml:"retry"`
+	DeadLetter DeadLetter     `json:"dead-letter" yaml:"dead-letter"`
+	// Connectivity pauses uploads while the S3 endpoint is unreachable
+	Connectivity Connectivity `json:"connectivity" yaml:"connectivity"`
+	// Priority orders the backlog found at startup and waiting for reupload
+	Priority Priority `json:"priority" yaml:"priority"`
+	// NINAAPI uploads frames as soon as N.I.N.A. reports them saved
+	NINAAPI NINAAPI `json:"nina-api" yaml:"nina-api"`
+	// Quiet pauses uploads between parts while the imaging PC is busy
+	Quiet Quiet `json:"quiet" yaml:"quiet"`
+	// Analysis measures frames before upload for rules to route by
+	Analysis Analysis `json:"analysis" yaml:"analysis"`
+	// Hooks run external commands around uploads
+	Hooks Hooks `json:"hooks" yaml:"hooks"`
+	// Pipeline transforms each file on its way to S3, in order
+	Pipeline []PipelineStage `json:"pipeline" yaml:"pipeline"`
+	// DrainTimeout is how long shutdown waits for uploads in flight before
+	// cancelling them, 30s if unset. A negative timeout cancels them at once
+	DrainTimeout time.Duration `json:"drain-timeout" yaml:"drain-timeout"`
+}
+
+// RelativePath returns the slash-separated path of a file below the local
+// or watched directory, which is the same for a frame wherever it waits.
+func (u Uploader) RelativePath(filePath string) (string, bool) {
+	if u.Local.Directory != "" && strings.HasPrefix(filePath, u.Local.Directory) {
+		filePath = strings.TrimPrefix(filePath, u.Local.Directory)
+	} else if u.Directory != "" && strings.HasPrefix(filePath, u.Directory) {
+		filePath = strings.TrimPrefix(filePath, u.Directory)
+	} else {
+		return "", false
+	}
+
+	return strings.TrimPrefix(strings.ReplaceAll(filePath, "\\", "/"), "/"), true
+}
+
+type PriorityOrder string
+
+const (
+	PriorityNewest    PriorityOrder = "newest"
+	PriorityOldest    PriorityOrder = "oldest"
+	PrioritySmallest  PriorityOrder = "smallest"
+	PriorityImageType PriorityOrder = "imagetype"
+)
+
+// Priority decides the order in which a backlog of files is uploaded.
+type Priority struct {
+	Order PriorityOrder `json:"order" yaml:"order"`
+	// ImageTypes ranks FITS IMAGETYP values for the imagetype order, files
+	// with unlisted types follow oldest first
+	ImageTypes []string `json:"image-types" yaml:"image-types"`
+}
+
+// Connectivity configures the probe that decides whether the S3 endpoint is
+// reachable. Uploads are paused in place while it is not.
+type Connectivity struct {
+	// Interval between probes while the endpoint is reachable
+	Interval time.Duration `json:"interval" yaml:"interval"`
+	// OfflineInterval between probes while the endpoint is unreachable
+	OfflineInterval time.Duration `json:"offline-interval" yaml:"offline-interval"`
+	Timeout         time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+// NINAAPI connects to the websocket of the N.I.N.A. Advanced API plugin.
+// The watcher keeps running alongside it and picks up whatever the API does
+// not report, including everything while it is unreachable.
+type NINAAPI struct {
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+	Host    string `json:"host" yaml:"host"`
+	Port    int    `json:"port" yaml:"port"`
+	// ReconnectInterval between connection attempts while the API is unreachable
+	ReconnectInterval time.Duration `json:"reconnect-interval" yaml:"reconnect-interval"`
+}
+
+// Quiet configures the signals that open a quiet window, during which
+// uploads pause between parts so they do not contend with the camera. Every
+// window ends on its own after the timeout.
+type Quiet struct {
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+	// NINAEvents are the events of the N.I.N.A. API that open a window
+	NINAEvents []string `json:"nina-events" yaml:"nina-events"`
+	// FlagFile holds a window open while a file of this name in the watched
+	// directory was modified within the timeout, empty disables it
+	FlagFile string `json:"flag-file" yaml:"flag-file"`
+}
+
+// Analysis measures the image of each frame before it is uploaded. The
+// statistics are stored as object metadata and can be matched by rules, i.e.
+// to route cloudy or out of focus frames away from the main archive.
+type Analysis struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// ImageTypes limits analysis to frames with these IMAGETYP values
+	ImageTypes []string `json:"image-types" yaml:"image-types"`
+	// StarThreshold detects stars peaking this many times the noise above
+	// the background
+	StarThreshold float64 `json:"star-threshold" yaml:"star-threshold"`
+}
+
+// Retry is the retry policy for failed uploads. The first attempts are made
+// in place, after which the file is moved to the local directory and retried
+// in the background until the policy is exhausted.
+type Retry struct {
+	// ImmediateAttempts are made before the file is moved to the local directory
+	ImmediateAttempts uint `json:"immediate-attempts" yaml:"immediate-attempts"`
+	// MaxAttempts is the total number of attempts, zero retries forever
+	MaxAttempts uint          `json:"max-attempts" yaml:"max-attempts"`
+	BaseBackoff time.Duration `json:"base-backoff" yaml:"base-backoff"`
+	MaxBackoff  time.Duration `json:"max-backoff" yaml:"max-backoff"`
+	// Jitter randomizes each backoff by up to this fraction of it
+	Jitter float64 `json:"jitter" yaml:"jitter"`
+	// MaxAge gives up on a file this long after its first failure, zero never gives up
+	MaxAge time.Duration `json:"max-age" yaml:"max-age"`
+}
+
+// DeadLetter receives files that failed permanently or exhausted the retry
+// policy, each with an error report next to it.
+type DeadLetter struct {
+	Directory string `json:"directory" yaml:"directory"`
+}
+
+type PostUploadAction string
+
+const (
+	PostUploadDelete PostUploadAction = "delete"
+	PostUploadMove   PostUploadAction = "move"
+	PostUploadKeep   PostUploadAction = "keep"
+)
+
+// PostUpload decides what happens to a source file once it is uploaded.
+type PostUpload struct {
+	Action PostUploadAction `json:"action" yaml:"action"`
+	// Directory receives uploaded files, keeping their relative path, with the move action
+	Directory string    `json:"directory" yaml:"directory"`
+	Retention Retention `json:"retention" yaml:"retention"`
+}
+
+// Retention limits how long and how much uploaded data is kept locally with
+// the keep and move actions. Zero values disable a limit.
+type Retention struct {
+	MaxAge  time.Duration `json:"max-age" yaml:"max-age"`
+	MaxSize Size          `json:"max-size" yaml:"max-size"`
+}
+
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite always replaces the existing object
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictSkip skips the upload when an object with the same size and
+	// checksum exists, and overwrites it otherwise
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictRename uploads a differing file under a numbered key
+	ConflictRename ConflictPolicy = "rename"
+	// ConflictFail refuses to replace a differing object
+	ConflictFail ConflictPolicy = "fail"
+)
+
+// Multipart configures resumable multipart uploads. Files larger than the
+// part size are uploaded in parts, and the completed parts are recorded in
+// the state directory so an interrupted upload continues where it left off.
+type Multipart struct {
+	PartSize    Size `json:"part-size" yaml:"part-size"`
+	Concurrency int  `json:"concurrency" yaml:"concurrency"`
+	// StaleAfter is how long an incomplete upload may sit idle before it is aborted
+	StaleAfter time.Duration `json:"stale-after" yaml:"stale-after"`
 }
 
 type Local struct {
 	Directory string `json:"directory" yaml:"directory"`
 }
 
+type SidecarMatch string
+
+const (
+	// SidecarMatchBasename groups sidecars that share the frame's file name stem
+	SidecarMatchBasename SidecarMatch = "basename"
+	// SidecarMatchDirectory groups every sidecar in the frame's directory
+	SidecarMatchDirectory SidecarMatch = "directory"
+)
+
+// Sidecar describes files that are uploaded and deleted together with a frame.
+type Sidecar struct {
+	Extensions []string     `json:"extensions" yaml:"extensions"`
+	Match      SidecarMatch `json:"match" yaml:"match"`
+}
+
+type RuleMode string
+
+const (
+	// RuleModeFirst applies the first matching rule
+	RuleModeFirst RuleMode = "first"
+	// RuleModeAll applies every matching rule in order, later rules
+	// overriding the options they set and adding to the tags
+	RuleModeAll RuleMode = "all"
+)
+
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	// CompressionGzip stores the object gzipped with a gzip content encoding
+	CompressionGzip Compression = "gzip"
+)
+
+// Rule applies object options to the files it matches, as the rule mode
+// decides.
+type Rule struct {
+	Match  RuleMatch     `json:"match" yaml:"match"`
+	Object ObjectOptions `json:"object" yaml:"object"`
+}
+
+// RuleMatch selects files. Every non-empty field must match.
+type RuleMatch struct {
+	// Paths are globs against the path relative to the watched directory.
+	// * matches within a path segment and ** matches across segments
+	Paths      []string `json:"paths" yaml:"paths"`
+	Extensions []string `json:"extensions" yaml:"extensions"`
+	// Headers maps FITS header keywords to globs their value must match
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	// MinSize and MaxSize bound the file size, zero is unbounded
+	MinSize Size         `json:"min-size" yaml:"min-size"`
+	MaxSize Size         `json:"max-size" yaml:"max-size"`
+	Time    TimeMatch    `json:"time" yaml:"time"`
+	Quality QualityMatch `json:"quality" yaml:"quality"`
+}
+
+// TimeMatch selects files by when the frame was taken, from DATE-OBS or the
+// modification time of files without it. Bounds are dates like 2025-01-31 in
+// local time or RFC 3339 times, and unset bounds are not checked.
+type TimeMatch struct {
+	// After is inclusive
+	After string `json:"after" yaml:"after"`
+	// Before is exclusive
+	Before string `json:"before" yaml:"before"`
+}
+
+// Bounds parses the bounds, zero times for unset bounds.
+func (t TimeMatch) Bounds() (time.Time, time.Time, error) {
+	after, err := parseRuleTime(t.After)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	before, err := parseRuleTime(t.Before)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return after, before, nil
+}
+
+func parseRuleTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// QualityMatch selects frames failing any of its thresholds, as measured by
+// the analysis. Unset thresholds are not checked, and frames that were not
+// analyzed never match a rule with thresholds.
+type QualityMatch struct {
+	MinStars  int     `json:"min-stars" yaml:"min-stars"`
+	MaxHFR    float64 `json:"max-hfr" yaml:"max-hfr"`
+	MaxFWHM   float64 `json:"max-fwhm" yaml:"max-fwhm"`
+	MaxMedian float64 `json:"max-median" yaml:"max-median"`
+	MaxNoise  float64 `json:"max-noise" yaml:"max-noise"`
+}
+
+// IsZero reports whether no threshold is set.
+func (q QualityMatch) IsZero() bool {
+	return q == QualityMatch{}
+}
+
+// ObjectOptions decide where and how a file is uploaded and what happens to
+// it afterwards. Unset options fall back to the top-level config.
+type ObjectOptions struct {
+	// Bucket is the destination bucket, s3.bucket if unset
+	Bucket string `json:"bucket" yaml:"bucket"`
+	// KeyTemplate replaces s3.key-template for the matched files
+	KeyTemplate string `json:"key-template" yaml:"key-template"`
+	// Prefix is inserted before the key below the configured prefix, i.e.
+	// rejected/
+	Prefix       string `json:"prefix" yaml:"prefix"`
+	StorageClass string `json:"storage-class" yaml:"storage-class"`
+	// Tags values are Go templates, i.e. {{ .FITS.IMAGETYP }} or {{ .Dir }}
+	Tags         map[string]string `json:"tags" yaml:"tags"`
+	CacheControl string            `json:"cache-control" yaml:"cache-control"`
+	ContentType  string            `json:"content-type" yaml:"content-type"`
+	Compression  Compression       `json:"compression" yaml:"compression"`
+	// PostUpload replaces uploader.post-upload.action for the matched files
+	PostUpload PostUploadAction `json:"post-upload" yaml:"post-upload"`
+}
+
+// CompleteMarker configures the marker object written once a directory is idle.
+type CompleteMarker struct {
+	Enabled bool          `json:"enabled" yaml:"enabled"`
+	Name    string        `json:"name" yaml:"name"`
+	Idle    time.Duration `json:"idle" yaml:"idle"`
+}
+
 const (
 	defaultConfigPath = "config.yaml"
 	defaultLogLevel   = LogLevelInfo
 
-	defaultS3Region   = "us-east-1"
-	defaultS3Prefix   = "/"
-	defaultS3Endpoint = "s3.amazonaws.com"
+	defaultS3Region     = "us-east-1"
+	defaultS3Prefix     = "/"
+	defaultS3Addressing = AddressingAuto
+	defaultS3Checksum   = ChecksumNone
+
+	defaultStateDirectoryName = "nina-s3-uploader"
+	defaultCatalogFileName    = "catalog.db"
+	defaultConflictPolicy     = ConflictOverwrite
+	defaultPostUploadAction   = PostUploadDelete
+	defaultDeadLetterDirName  = "dead-letter"
+
+	defaultRetryImmediateAttempts = 3
+	defaultRetryBaseBackoff       = time.Second
+	defaultRetryMaxBackoff        = 5 * time.Minute
+	defaultRetryJitter            = 0.5
+
+	defaultPriorityOrder = PriorityOldest
+	defaultDrainTimeout  = 30 * time.Second
+
+	defaultConnectivityInterval        = time.Minute
+	defaultConnectivityOfflineInterval = 15 * time.Second
+	defaultConnectivityTimeout         = 10 * time.Second
+
+	defaultNINAAPIHost              = "localhost"
+	defaultNINAAPIPort              = 1888
+	defaultNINAAPIReconnectInterval = 30 * time.Second
+
+	defaultQuietTimeout = 30 * time.Second
+
+	defaultAnalysisStarThreshold = 5
+
+	defaultMultipartPartSize    = 16 * 1024 * 1024
+	minMultipartPartSize        = 5 * 1024 * 1024
+	defaultMultipartConcurrency = 5
+	defaultMultipartStaleAfter  = 7 * 24 * time.Hour
+
+	defaultCompleteMarkerName = "_COMPLETE"
+	defaultCompleteMarkerIdle = 10 * time.Minute
 )
 
 const (
@@ -78,6 +542,49 @@ var (
 	ErrMissingUploaderDirectory  = errors.New("Missing uploader directory")
 	ErrMissingUploaderExtensions = errors.New("Missing uploader extensions")
 	ErrMissingUploaderLocalDir   = errors.New("Missing uploader local directory")
+	ErrInvalidSidecarMatch       = errors.New("Invalid sidecar match")
+	ErrMissingSidecarExtensions  = errors.New("Missing sidecar extensions")
+	ErrInvalidCompleteMarker     = errors.New("Invalid complete marker")
+	ErrInvalidStorageClass       = errors.New("Invalid storage class")
+	ErrInvalidTagTemplate        = errors.New("Invalid tag template")
+	ErrTooManyTags               = errors.New("Too many tags, S3 allows at most 10")
+	ErrInvalidEncryptionMode     = errors.New("Invalid encryption mode")
+	ErrMissingCustomerKeyFile    = errors.New("Missing SSE-C customer key file")
+	ErrInvalidKMSOptions         = errors.New("KMS key ID and bucket key require SSE-KMS")
+	ErrConflictingCredential     = errors.New("Credential set both directly and from a file")
+	ErrIncompleteStaticKey       = errors.New("Static credentials need both an access key ID and a secret access key")
+	ErrMissingWebIdentityOptions = errors.New("Web identity needs both a role ARN and a token file")
+	ErrConflictingRoles          = errors.New("Assume role and web identity cannot be used together")
+	ErrConflictingProfile        = errors.New("A credentials profile and a static key cannot be used together")
+	ErrInvalidAddressing         = errors.New("Invalid S3 addressing")
+	ErrInvalidChecksum           = errors.New("Invalid S3 checksum algorithm")
+	ErrIncompleteClientCert      = errors.New("Client certificate needs both a cert file and a key file")
+	ErrInvalidProxy              = errors.New("Invalid proxy URL")
+	ErrInvalidEndpoint           = errors.New("Invalid S3 endpoint")
+	ErrInvalidMultipartPartSize  = errors.New("Multipart part size must be at least 5MiB")
+	ErrInvalidMultipartOptions   = errors.New("Invalid multipart options")
+	ErrInvalidConflictPolicy     = errors.New("Invalid conflict policy")
+	ErrInvalidPostUploadAction   = errors.New("Invalid post-upload action")
+	ErrMissingPostUploadDir      = errors.New("Missing post-upload directory for the move action")
+	ErrInvalidRetention          = errors.New("Invalid retention")
+	ErrInvalidRetryPolicy        = errors.New("Invalid retry policy")
+	ErrInvalidConnectivity       = errors.New("Invalid connectivity options")
+	ErrInvalidNINAAPI            = errors.New("Invalid N.I.N.A. API options")
+	ErrInvalidQuiet              = errors.New("Invalid quiet window options")
+	ErrQuietNeedsNINAAPI         = errors.New("Quiet N.I.N.A. events need the N.I.N.A. API enabled")
+	ErrInvalidAnalysis           = errors.New("Invalid analysis options")
+	ErrInvalidQualityMatch       = errors.New("Quality thresholds must not be negative")
+	ErrInvalidRuleMode           = errors.New("Invalid rule mode")
+	ErrInvalidSizeMatch          = errors.New("Invalid size match")
+	ErrInvalidTimeMatch          = errors.New("Invalid time match")
+	ErrInvalidCompression        = errors.New("Invalid compression")
+	ErrInvalidBucket             = errors.New("Invalid bucket")
+	ErrInvalidPriorityOrder      = errors.New("Invalid priority order")
+	ErrInvalidKeyTemplate        = errors.New("Invalid key template")
+	ErrInvalidInclude            = errors.New("Invalid include glob")
+	ErrInvalidProfileName        = errors.New("Invalid profile name")
+	ErrDuplicateProfileName      = errors.New("Duplicate profile name")
+	ErrInvalidBandwidth          = errors.New("Invalid bandwidth")
 )
 
 func LoadConfig(cmd *cobra.Command) (*Config, error) {
@@ -125,22 +632,126 @@ func LoadConfig(cmd *cobra.Command) (*Config, error) {
 	if config.LogLevel == "" {
 		config.LogLevel = defaultLogLevel
 	}
+	config.Log.setDefaults()
 	if config.S3.Region == "" {
 		config.S3.Region = defaultS3Region
 	}
 	if config.S3.Prefix == "" {
 		config.S3.Prefix = defaultS3Prefix
 	}
-	if config.S3.Endpoint == "" {
-		config.S3.Endpoint = defaultS3Endpoint
+	if config.S3.Addressing == "" {
+		config.S3.Addressing = defaultS3Addressing
+	}
+	if config.S3.Checksum == "" {
+		config.S3.Checksum = defaultS3Checksum
+	}
+	if config.S3.Encryption.Mode == "" {
+		config.S3.Encryption.Mode = EncryptionModeNone
+	}
+	if config.RuleMode == "" {
+		config.RuleMode = RuleModeFirst
+	}
+	for i := range config.Uploader.Sidecars {
+		if config.Uploader.Sidecars[i].Match == "" {
+			config.Uploader.Sidecars[i].Match = SidecarMatchBasename
+		}
+	}
+	if config.Uploader.StateDirectory == "" {
+		config.Uploader.StateDirectory = defaultStateDirectory()
+	}
+	if config.Catalog.Path == "" {
+		config.Catalog.Path = filepath.Join(config.Uploader.StateDirectory, defaultCatalogFileName)
+	}
+	if config.Uploader.Conflict == "" {
+		config.Uploader.Conflict = defaultConflictPolicy
+	}
+	if config.Uploader.PostUpload.Action == "" {
+		config.Uploader.PostUpload.Action = defaultPostUploadAction
+	}
+	if config.Uploader.Retry.ImmediateAttempts == 0 {
+		config.Uploader.Retry.ImmediateAttempts = defaultRetryImmediateAttempts
+	}
+	if config.Uploader.Retry.BaseBackoff == 0 {
+		config.Uploader.Retry.BaseBackoff = defaultRetryBaseBackoff
+	}
+	if config.Uploader.Retry.MaxBackoff == 0 {
+		config.Uploader.Retry.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if config.Uploader.Retry.Jitter == 0 {
+		config.Uploader.Retry.Jitter = defaultRetryJitter
+	}
+	if config.Uploader.Connectivity.Interval == 0 {
+		config.Uploader.Connectivity.Interval = defaultConnectivityInterval
+	}
+	if config.Uploader.Connectivity.OfflineInterval == 0 {
+		config.Uploader.Connectivity.OfflineInterval = defaultConnectivityOfflineInterval
+	}
+	if config.Uploader.Connectivity.Timeout == 0 {
+		config.Uploader.Connectivity.Timeout = defaultConnectivityTimeout
+	}
+	if config.Uploader.NINAAPI.Host == "" {
+		config.Uploader.NINAAPI.Host = defaultNINAAPIHost
+	}
+	if config.Uploader.NINAAPI.Port == 0 {
+		config.Uploader.NINAAPI.Port = defaultNINAAPIPort
+	}
+	if config.Uploader.NINAAPI.ReconnectInterval == 0 {
+		config.Uploader.NINAAPI.ReconnectInterval = defaultNINAAPIReconnectInterval
+	}
+	if config.Uploader.Quiet.Timeout == 0 {
+		config.Uploader.Quiet.Timeout = defaultQuietTimeout
+	}
+	if len(config.Uploader.Analysis.ImageTypes) == 0 {
+		config.Uploader.Analysis.ImageTypes = []string{"LIGHT"}
+	}
+	if config.Uploader.Analysis.StarThreshold == 0 {
+		config.Uploader.Analysis.StarThreshold = defaultAnalysisStarThreshold
+	}
+	config.Uploader.Hooks.setDefaults()
+	if config.Uploader.Priority.Order == "" {
+		config.Uploader.Priority.Order = defaultPriorityOrder
+	}
+	if len(config.Uploader.Priority.ImageTypes) == 0 {
+		config.Uploader.Priority.ImageTypes = []string{"LIGHT"}
+	}
+	if config.Uploader.DrainTimeout == 0 {
+		config.Uploader.DrainTimeout = defaultDrainTimeout
+	}
+	if config.Uploader.DeadLetter.Directory == "" {
+		config.Uploader.DeadLetter.Directory = filepath.Join(config.Uploader.StateDirectory, defaultDeadLetterDirName)
+	}
+	if config.Uploader.Multipart.PartSize == 0 {
+		config.Uploader.Multipart.PartSize = defaultMultipartPartSize
+	}
+	if config.Uploader.Multipart.Concurrency == 0 {
+		config.Uploader.Multipart.Concurrency = defaultMultipartConcurrency
+	}
+	if config.Uploader.Multipart.StaleAfter == 0 {
+		config.Uploader.Multipart.StaleAfter = defaultMultipartStaleAfter
+	}
+	if config.Uploader.CompleteMarker.Name == "" {
+		config.Uploader.CompleteMarker.Name = defaultCompleteMarkerName
+	}
+	if config.Uploader.CompleteMarker.Idle == 0 {
+		config.Uploader.CompleteMarker.Idle = defaultCompleteMarkerIdle
 	}
 
 	return &config, nil
 }
 
+// defaultStateDirectory places state in the user's cache directory, which is
+// %LocalAppData% on Windows.
+func defaultStateDirectory() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "." + defaultStateDirectoryName
+	}
+	return filepath.Join(dir, defaultStateDirectoryName)
+}
+
 func RegisterFlags(cmd *cobra.Command) {
-	cmd.Flags().StringP(keyConfigFile, "c", defaultConfigPath, "Config file path")
-	cmd.Flags().String(keyLogLevel, string(defaultLogLevel), "Log level")
+	cmd.PersistentFlags().StringP(keyConfigFile, "c", defaultConfigPath, "Config file path")
+	cmd.PersistentFlags().String(keyLogLevel, string(defaultLogLevel), "Log level")
 }
 
 func overrideFlags(config *Config, cmd *cobra.Command) error {
@@ -156,23 +767,268 @@ func overrideFlags(config *Config, cmd *cobra.Command) error {
 }
 
 func (c *Config) Validate() error {
-	switch c.LogLevel {
-	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
-	default:
+	if err := c.Log.validate(); err != nil {
+		return err
+	}
+	if c.Bandwidth < 0 {
+		return ErrInvalidBandwidth
+	}
+	if len(c.Profiles) == 0 {
+		return c.validate()
+	}
+	names := make(map[string]bool, len(c.Profiles))
+	for _, profile := range c.Profiles {
+		if !validProfileName.MatchString(profile.Name) {
+			return fmt.Errorf("%w: %q", ErrInvalidProfileName, profile.Name)
+		}
+		if names[profile.Name] {
+			return fmt.Errorf("%w: %s", ErrDuplicateProfileName, profile.Name)
+		}
+		names[profile.Name] = true
+	}
+	for _, profile := range c.ProfileConfigs() {
+		if err := profile.Config.validate(); err != nil {
+			return fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if !c.LogLevel.valid() {
 		return ErrInvalidLogLevel
 	}
 	if c.S3.Bucket == "" {
 		return ErrMissingS3Bucket
 	}
+	switch c.S3.Encryption.Mode {
+	case EncryptionModeNone, EncryptionModeSSES3, EncryptionModeSSEKMS:
+	case EncryptionModeSSEC:
+		if c.S3.Encryption.CustomerKeyFile == "" {
+			return ErrMissingCustomerKeyFile
+		}
+	default:
+		return ErrInvalidEncryptionMode
+	}
+	if c.S3.Encryption.Mode != EncryptionModeSSEKMS && (c.S3.Encryption.KMSKeyID != "" || c.S3.Encryption.BucketKey) {
+		return ErrInvalidKMSOptions
+	}
+	if err := c.S3.Credentials.validate(); err != nil {
+		return err
+	}
+	switch c.S3.Addressing {
+	case AddressingAuto, AddressingPath, AddressingVirtual:
+	default:
+		return ErrInvalidAddressing
+	}
+	switch c.S3.Checksum {
+	case ChecksumNone, ChecksumCRC32, ChecksumCRC32C, ChecksumSHA1, ChecksumSHA256:
+	default:
+		return ErrInvalidChecksum
+	}
+	if (c.S3.TLS.CertFile == "") != (c.S3.TLS.KeyFile == "") {
+		return ErrIncompleteClientCert
+	}
+	if c.S3.Proxy != "" {
+		if u, err := url.Parse(c.S3.Proxy); err != nil || u.Host == "" {
+			return ErrInvalidProxy
+		}
+	}
+	if c.S3.Endpoint != "" {
+		if _, err := url.Parse(c.S3.Endpoint); err != nil {
+			return ErrInvalidEndpoint
+		}
+	}
 	if c.Uploader.Directory == "" {
 		return ErrMissingUploaderDirectory
 	}
-	if len(c.Uploader.Extensions) == 0 {
+	if len(c.Uploader.Extensions) == 0 && !slices.ContainsFunc(c.Rules, func(rule Rule) bool { return len(rule.Match.Extensions) > 0 }) {
 		return ErrMissingUploaderExtensions
 	}
 	if c.Uploader.Local.Directory == "" {
 		return ErrMissingUploaderLocalDir
 	}
+	switch c.Uploader.Conflict {
+	case ConflictOverwrite, ConflictSkip, ConflictRename, ConflictFail:
+	default:
+		return ErrInvalidConflictPolicy
+	}
+	switch c.Uploader.PostUpload.Action {
+	case PostUploadDelete, PostUploadKeep:
+	case PostUploadMove:
+		if c.Uploader.PostUpload.Directory == "" {
+			return ErrMissingPostUploadDir
+		}
+	default:
+		return ErrInvalidPostUploadAction
+	}
+	if c.Uploader.PostUpload.Retention.MaxAge < 0 || c.Uploader.PostUpload.Retention.MaxSize < 0 {
+		return ErrInvalidRetention
+	}
+	retry := c.Uploader.Retry
+	if retry.BaseBackoff <= 0 || retry.MaxBackoff < retry.BaseBackoff || retry.Jitter < 0 || retry.Jitter > 1 ||
+		retry.MaxAge < 0 || (retry.MaxAttempts > 0 && retry.MaxAttempts < retry.ImmediateAttempts) {
+		return ErrInvalidRetryPolicy
+	}
+	switch c.Uploader.Priority.Order {
+	case PriorityNewest, PriorityOldest, PrioritySmallest, PriorityImageType:
+	default:
+		return ErrInvalidPriorityOrder
+	}
+	connectivity := c.Uploader.Connectivity
+	if connectivity.Interval <= 0 || connectivity.OfflineInterval <= 0 || connectivity.Timeout <= 0 {
+		return ErrInvalidConnectivity
+	}
+	if api := c.Uploader.NINAAPI; api.Enabled && (api.Host == "" || api.Port < 1 || api.Port > 65535 || api.ReconnectInterval <= 0) {
+		return ErrInvalidNINAAPI
+	}
+	if quiet := c.Uploader.Quiet; quiet.Timeout <= 0 || strings.ContainsAny(quiet.FlagFile, "/\\") {
+		return ErrInvalidQuiet
+	}
+	if len(c.Uploader.Quiet.NINAEvents) > 0 && !c.Uploader.NINAAPI.Enabled {
+		// No event could ever arrive to open a window
+		return ErrQuietNeedsNINAAPI
+	}
+	if c.Uploader.Analysis.StarThreshold <= 0 {
+		return ErrInvalidAnalysis
+	}
+	if err := c.Uploader.Hooks.validate(); err != nil {
+		return err
+	}
+	if err := validatePipeline(c.Uploader.Pipeline); err != nil {
+		return err
+	}
+	if c.Uploader.Multipart.PartSize < minMultipartPartSize {
+		return ErrInvalidMultipartPartSize
+	}
+	if c.Uploader.Multipart.Concurrency < 1 || c.Uploader.Multipart.StaleAfter <= 0 {
+		return ErrInvalidMultipartOptions
+	}
+	for _, sidecar := range c.Uploader.Sidecars {
+		switch sidecar.Match {
+		case SidecarMatchBasename, SidecarMatchDirectory:
+		default:
+			return ErrInvalidSidecarMatch
+		}
+		if len(sidecar.Extensions) == 0 {
+			return ErrMissingSidecarExtensions
+		}
+	}
+	switch c.RuleMode {
+	case RuleModeFirst, RuleModeAll:
+	default:
+		return ErrInvalidRuleMode
+	}
+	for _, rule := range c.Rules {
+		if err := c.validateRule(rule); err != nil {
+			return err
+		}
+	}
+	if c.S3.KeyTemplate != "" {
+		if _, err := template.New("key").Parse(c.S3.KeyTemplate); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidKeyTemplate, err)
+		}
+	}
+	for _, glob := range c.Uploader.Include {
+		if glob == "" {
+			return ErrInvalidInclude
+		}
+	}
+	if c.Uploader.CompleteMarker.Enabled {
+		name := c.Uploader.CompleteMarker.Name
+		if c.Uploader.CompleteMarker.Idle <= 0 || name == "" || strings.ContainsAny(name, "/\\") {
+			return ErrInvalidCompleteMarker
+		}
+	}
+
+	return nil
+}
 
+func (c *Config) validateRule(rule Rule) error {
+	if rule.Object.StorageClass != "" &&
+		!slices.Contains(types.StorageClass("").Values(), types.StorageClass(rule.Object.StorageClass)) {
+		return ErrInvalidStorageClass
+	}
+	quality := rule.Match.Quality
+	if quality.MinStars < 0 || quality.MaxHFR < 0 || quality.MaxFWHM < 0 || quality.MaxMedian < 0 || quality.MaxNoise < 0 {
+		return ErrInvalidQualityMatch
+	}
+	if rule.Match.MinSize < 0 || rule.Match.MaxSize < 0 || (rule.Match.MaxSize > 0 && rule.Match.MaxSize < rule.Match.MinSize) {
+		return ErrInvalidSizeMatch
+	}
+	after, before, err := rule.Match.Time.Bounds()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTimeMatch, err)
+	}
+	if !after.IsZero() && !before.IsZero() && !before.After(after) {
+		return ErrInvalidTimeMatch
+	}
+	if len(rule.Object.Tags) > 10 {
+		return ErrTooManyTags
+	}
+	for _, tag := range rule.Object.Tags {
+		if _, err := template.New("tag").Parse(tag); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidTagTemplate, err)
+		}
+	}
+	if rule.Object.KeyTemplate != "" {
+		if _, err := template.New("key").Parse(rule.Object.KeyTemplate); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidKeyTemplate, err)
+		}
+	}
+	if strings.ContainsAny(rule.Object.Bucket, "/ ") {
+		return fmt.Errorf("%w: %q", ErrInvalidBucket, rule.Object.Bucket)
+	}
+	switch rule.Object.Compression {
+	case "", CompressionNone, CompressionGzip:
+	default:
+		return ErrInvalidCompression
+	}
+	switch rule.Object.PostUpload {
+	case "", PostUploadDelete, PostUploadKeep:
+	case PostUploadMove:
+		if c.Uploader.PostUpload.Directory == "" {
+			return ErrMissingPostUploadDir
+		}
+	default:
+		return ErrInvalidPostUploadAction
+	}
+	return nil
+}
+
+// Buckets returns the configured bucket followed by the other buckets rules
+// upload to.
+func (c *Config) Buckets() []string {
+	buckets := []string{c.S3.Bucket}
+	for _, rule := range c.Rules {
+		if rule.Object.Bucket != "" && !slices.Contains(buckets, rule.Object.Bucket) {
+			buckets = append(buckets, rule.Object.Bucket)
+		}
+	}
+	return buckets
+}
+
+func (c *Credentials) validate() error {
+	if (c.AccessKeyID != "" && c.AccessKeyIDFile != "") ||
+		(c.SecretAccessKey != "" && c.SecretAccessKeyFile != "") ||
+		(c.SessionToken != "" && c.SessionTokenFile != "") {
+		return ErrConflictingCredential
+	}
+	hasKeyID := c.AccessKeyID != "" || c.AccessKeyIDFile != ""
+	hasSecret := c.SecretAccessKey != "" || c.SecretAccessKeyFile != ""
+	if hasKeyID != hasSecret {
+		return ErrIncompleteStaticKey
+	}
+	if hasKeyID && c.Profile != "" {
+		// The static key would silently win over the profile
+		return ErrConflictingProfile
+	}
+	webIdentity := c.WebIdentity.RoleARN != "" || c.WebIdentity.TokenFile != ""
+	if webIdentity && (c.WebIdentity.RoleARN == "" || c.WebIdentity.TokenFile == "") {
+		return ErrMissingWebIdentityOptions
+	}
+	if webIdentity && c.AssumeRole.RoleARN != "" {
+		return ErrConflictingRoles
+	}
 	return nil
 }
@@ -1,10 +1,77 @@
 package config_test
 
 import (
+	"errors"
 	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
 )
 
 func TestNoop(t *testing.T) {
 	t.Parallel()
 	t.Log("Noop")
 }
+
+func TestParseSize(t *testing.T) {
+	t.Parallel()
+	tests := map[string]config.Size{
+		"1024":   1024,
+		"16MiB":  16 * 1024 * 1024,
+		"5 GB":   5 * 1000 * 1000 * 1000,
+		"1.5KiB": 1536,
+		"10B":    10,
+	}
+	for input, want := range tests {
+		got, err := config.ParseSize(input)
+		if err != nil {
+			t.Errorf("ParseSize(%q) returned error: %v", input, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseSize(%q) = %d, want %d", input, got, want)
+		}
+	}
+	if _, err := config.ParseSize("lots"); err == nil {
+		t.Error("expected an error for an invalid size")
+	}
+}
+
+func TestProfileConfigs(t *testing.T) {
+	t.Parallel()
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		S3:       config.S3{Bucket: "shared", Prefix: "/", Encryption: config.Encryption{Mode: config.EncryptionModeNone}},
+		Uploader: config.Uploader{
+			Extensions:     []string{".fits"},
+			StateDirectory: "state",
+			DeadLetter:     config.DeadLetter{Directory: "dead"},
+		},
+		Profiles: []config.Profile{
+			{Name: "rig1", Directory: "rig1", Local: config.Local{Directory: "rig1-local"}},
+			{Name: "allsky", Directory: "allsky", Local: config.Local{Directory: "allsky-local"}, Bucket: "allsky", Extensions: []string{".jpg"}},
+		},
+	}
+
+	profiles := cfg.ProfileConfigs()
+	if len(profiles) != 2 {
+		t.Fatalf("expected 2 profiles, got %d", len(profiles))
+	}
+	rig1, allsky := profiles[0].Config, profiles[1].Config
+	if rig1.S3.Bucket != "shared" || rig1.Uploader.Extensions[0] != ".fits" || rig1.Uploader.Directory != "rig1" {
+		t.Errorf("rig1 did not inherit the top-level config: %+v", rig1)
+	}
+	if allsky.S3.Bucket != "allsky" || allsky.Uploader.Extensions[0] != ".jpg" {
+		t.Errorf("allsky did not override the top-level config: %+v", allsky)
+	}
+	if rig1.Uploader.StateDirectory == allsky.Uploader.StateDirectory || rig1.Uploader.DeadLetter.Directory == allsky.Uploader.DeadLetter.Directory {
+		t.Error("profiles share a state or dead-letter directory")
+	}
+	if len(rig1.Profiles) != 0 {
+		t.Error("profile config still lists profiles")
+	}
+
+	cfg.Profiles = append(cfg.Profiles, config.Profile{Name: "rig1", Directory: "other", Local: config.Local{Directory: "other-local"}})
+	if err := cfg.Validate(); !errors.Is(err, config.ErrDuplicateProfileName) {
+		t.Errorf("expected duplicate profile name error, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+type HookReject string
+
+const (
+	// HookRejectSkip leaves a file the pre-upload hook rejected in place
+	HookRejectSkip HookReject = "skip"
+	// HookRejectVeto moves a file the pre-upload hook rejected to the
+	// dead-letter directory
+	HookRejectVeto HookReject = "veto"
+)
+
+// Hooks run external commands around the upload of each frame, i.e. to
+// start a local stacking job. Hooks without a command are not run.
+type Hooks struct {
+	PreUpload  Hook `json:"pre-upload" yaml:"pre-upload"`
+	PostUpload Hook `json:"post-upload" yaml:"post-upload"`
+	// OnFailure runs once a frame is given up on and dead-lettered
+	OnFailure Hook `json:"on-failure" yaml:"on-failure"`
+	// OnSpill runs once a frame that failed to upload is moved to the local
+	// directory to be retried
+	OnSpill    Hook `json:"on-spill" yaml:"on-spill"`
+	OnNightEnd Hook `json:"on-night-end" yaml:"on-night-end"`
+	// NightEnd is how long after the last frame of a night was uploaded the
+	// night is over
+	NightEnd time.Duration `json:"night-end" yaml:"night-end"`
+}
+
+// Hook is an external command.
+type Hook struct {
+	// Command is the program followed by its arguments, run without a shell
+	Command []string `json:"command" yaml:"command"`
+	// Timeout kills the command once it has run this long
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+	// Reject decides what a non-zero exit of the pre-upload hook does
+	Reject HookReject `json:"reject" yaml:"reject"`
+}
+
+const (
+	defaultHookTimeout  = time.Minute
+	defaultHookNightEnd = 2 * time.Hour
+)
+
+var ErrInvalidHook = errors.New("Invalid hook options")
+
+func (h *Hooks) setDefaults() {
+	for _, hook := range []*Hook{&h.PreUpload, &h.PostUpload, &h.OnFailure, &h.OnSpill, &h.OnNightEnd} {
+		if hook.Timeout == 0 {
+			hook.Timeout = defaultHookTimeout
+		}
+		if hook.Reject == "" {
+			hook.Reject = HookRejectSkip
+		}
+	}
+	if h.NightEnd == 0 {
+		h.NightEnd = defaultHookNightEnd
+	}
+}
+
+func (h Hooks) validate() error {
+	for _, hook := range []Hook{h.PreUpload, h.PostUpload, h.OnFailure, h.OnSpill, h.OnNightEnd} {
+		if hook.Timeout <= 0 || (len(hook.Command) > 0 && hook.Command[0] == "") {
+			return ErrInvalidHook
+		}
+		switch hook.Reject {
+		case HookRejectSkip, HookRejectVeto:
+		default:
+			return ErrInvalidHook
+		}
+	}
+	if h.NightEnd <= 0 {
+		return ErrInvalidHook
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type LogFormat string
+
+const (
+	// LogFormatTint is colored text for a console
+	LogFormatTint LogFormat = "tint"
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+// Log configures the format and destination of the logs. The level itself
+// is the top level log-level.
+type Log struct {
+	Format LogFormat `json:"format" yaml:"format"`
+	File   LogFile   `json:"file" yaml:"file"`
+	// Levels overrides the log level of subsystems, i.e. watcher: debug
+	Levels map[string]LogLevel `json:"levels" yaml:"levels"`
+}
+
+// LogFile writes the logs to a file instead of the console, rotating it
+// once it grows past MaxSize.
+type LogFile struct {
+	// Path is the log file, empty logs to the console
+	Path    string `json:"path" yaml:"path"`
+	MaxSize Size   `json:"max-size" yaml:"max-size"`
+	// MaxAge removes rotated files older than this, zero keeps them
+	MaxAge time.Duration `json:"max-age" yaml:"max-age"`
+	// MaxBackups is how many rotated files to keep, zero keeps them all
+	MaxBackups int  `json:"max-backups" yaml:"max-backups"`
+	Compress   bool `json:"compress" yaml:"compress"`
+}
+
+const (
+	defaultLogFormat      = LogFormatTint
+	defaultLogFileMaxSize = 100 * 1024 * 1024
+)
+
+var (
+	ErrInvalidLogFormat = errors.New("Invalid log format")
+	ErrInvalidLogFile   = errors.New("Invalid log file options")
+)
+
+func (l *Log) setDefaults() {
+	if l.Format == "" {
+		l.Format = defaultLogFormat
+	}
+	if l.File.MaxSize == 0 {
+		l.File.MaxSize = defaultLogFileMaxSize
+	}
+}
+
+func (l Log) validate() error {
+	switch l.Format {
+	case "", LogFormatTint, LogFormatText, LogFormatJSON:
+	default:
+		return ErrInvalidLogFormat
+	}
+	if l.File.MaxSize < 0 || l.File.MaxAge < 0 || l.File.MaxBackups < 0 {
+		return ErrInvalidLogFile
+	}
+	for subsystem, level := range l.Levels {
+		if !level.valid() {
+			return fmt.Errorf("%w for %s: %q", ErrInvalidLogLevel, subsystem, level)
+		}
+	}
+	return nil
+}
+
+func (l LogLevel) valid() bool {
+	switch l {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/pkg/pipeline"
+)
+
+// PipelineStage is a stage the uploader passes each file through before it
+// is uploaded.
+type PipelineStage struct {
+	// Stage is the name the stage is registered under
+	Stage   string            `json:"stage" yaml:"stage"`
+	Options map[string]string `json:"options" yaml:"options"`
+}
+
+var ErrInvalidPipeline = errors.New("Invalid pipeline")
+
+func validatePipeline(stages []PipelineStage) error {
+	encoded := false
+	for _, stage := range stages {
+		if !pipeline.Registered(stage.Stage) {
+			return fmt.Errorf("%w: unknown stage %q", ErrInvalidPipeline, stage.Stage)
+		}
+		switch stage.Stage {
+		case pipeline.StageGzip, pipeline.StageEncrypt:
+			encoded = true
+		case pipeline.StageFITSHeader:
+			// The header can only be found in the unencoded file
+			if encoded {
+				return fmt.Errorf("%w: %s must come before gzip and encrypt", ErrInvalidPipeline, stage.Stage)
+			}
+		}
+	}
+	return nil
+}
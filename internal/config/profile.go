@@ -0,0 +1,83 @@
+package config
+
+import (
+	"cmp"
+	"path/filepath"
+	"regexp"
+)
+
+// DefaultProfileName names the implicit profile of a config without profiles.
+const DefaultProfileName = "default"
+
+//nolint:gochecknoglobals
+var validProfileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// Profile is an independent upload within the process, such as one per
+// imaging rig. Unset fields fall back to the top level of the config.
+type Profile struct {
+	Name       string   `json:"name" yaml:"name"`
+	Directory  string   `json:"directory" yaml:"directory"`
+	Extensions []string `json:"extensions" yaml:"extensions"`
+	Include    []string `json:"include" yaml:"include"`
+	Local      Local    `json:"local" yaml:"local"`
+	Bucket     string   `json:"bucket" yaml:"bucket"`
+	Prefix     string   `json:"prefix" yaml:"prefix"`
+	// KeyTemplate renders the object key below the prefix
+	KeyTemplate string `json:"key-template" yaml:"key-template"`
+	// NINAAPI replaces the top-level N.I.N.A. API options, i.e. to connect
+	// to the instance of N.I.N.A. on another rig
+	NINAAPI *NINAAPI `json:"nina-api" yaml:"nina-api"`
+}
+
+// NamedConfig is the complete config of one profile.
+type NamedConfig struct {
+	Name   string
+	Config *Config
+}
+
+// ProfileConfigs resolves each profile into a complete config. Without
+// profiles the config itself is returned as the default profile.
+//
+// Profiles keep their state, dead letters and moved files in a directory of
+// their own, so that two profiles never share a retention ledger.
+func (c *Config) ProfileConfigs() []NamedConfig {
+	if len(c.Profiles) == 0 {
+		return []NamedConfig{{Name: DefaultProfileName, Config: c}}
+	}
+
+	configs := make([]NamedConfig, 0, len(c.Profiles))
+	for _, profile := range c.Profiles {
+		cfg := *c
+		cfg.Profiles = nil
+		cfg.Uploader.Directory = profile.Directory
+		if len(profile.Extensions) > 0 {
+			cfg.Uploader.Extensions = profile.Extensions
+		}
+		if len(profile.Include) > 0 {
+			cfg.Uploader.Include = profile.Include
+		}
+		cfg.Uploader.Local = profile.Local
+		if profile.Bucket != "" {
+			cfg.S3.Bucket = profile.Bucket
+		}
+		if profile.Prefix != "" {
+			cfg.S3.Prefix = profile.Prefix
+		}
+		if profile.KeyTemplate != "" {
+			cfg.S3.KeyTemplate = profile.KeyTemplate
+		}
+		if profile.NINAAPI != nil {
+			cfg.Uploader.NINAAPI = *profile.NINAAPI
+			cfg.Uploader.NINAAPI.Host = cmp.Or(cfg.Uploader.NINAAPI.Host, c.Uploader.NINAAPI.Host)
+			cfg.Uploader.NINAAPI.Port = cmp.Or(cfg.Uploader.NINAAPI.Port, c.Uploader.NINAAPI.Port)
+			cfg.Uploader.NINAAPI.ReconnectInterval = cmp.Or(cfg.Uploader.NINAAPI.ReconnectInterval, c.Uploader.NINAAPI.ReconnectInterval)
+		}
+		cfg.Uploader.StateDirectory = filepath.Join(c.Uploader.StateDirectory, "profiles", profile.Name)
+		cfg.Uploader.DeadLetter.Directory = filepath.Join(c.Uploader.DeadLetter.Directory, profile.Name)
+		if c.Uploader.PostUpload.Directory != "" {
+			cfg.Uploader.PostUpload.Directory = filepath.Join(c.Uploader.PostUpload.Directory, profile.Name)
+		}
+		configs = append(configs, NamedConfig{Name: profile.Name, Config: &cfg})
+	}
+	return configs
+}
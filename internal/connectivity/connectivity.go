@@ -0,0 +1,189 @@
+package connectivity
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("connectivity")
+
+// ErrStopped is returned by Do when the monitor is stopped while the call is
+// still queued.
+var ErrStopped = errors.New("connectivity monitor stopped")
+
+// Prober checks whether the S3 endpoint can be reached.
+type Prober interface {
+	Probe(ctx context.Context) error
+}
+
+// Monitor tracks whether the S3 endpoint is reachable and runs uploads in
+// the order they were queued, holding them while the endpoint is not.
+type Monitor struct {
+	config config.Connectivity
+	prober Prober
+	done   chan struct{}
+	// recheck asks the probe loop to probe again now
+	recheck chan struct{}
+
+	lock   sync.Mutex
+	online bool
+	// changed is closed and replaced whenever online or serving changes
+	changed chan struct{}
+	// Calls are served in ticket order, next is the ticket for the next call
+	next      uint64
+	serving   uint64
+	abandoned map[uint64]struct{}
+}
+
+func NewMonitor(cfg config.Connectivity, prober Prober) *Monitor {
+	return &Monitor{
+		config:    cfg,
+		prober:    prober,
+		done:      make(chan struct{}),
+		recheck:   make(chan struct{}, 1),
+		online:    true,
+		changed:   make(chan struct{}),
+		abandoned: make(map[uint64]struct{}),
+	}
+}
+
+// Run probes the endpoint until Stop is called, more often while it is
+// unreachable.
+func (m *Monitor) Run() {
+	for {
+		m.probe()
+		interval := m.config.Interval
+		if !m.Online() {
+			interval = m.config.OfflineInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-m.done:
+			timer.Stop()
+			return
+		case <-m.recheck:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop ends the probe loop and releases every queued call with ErrStopped.
+func (m *Monitor) Stop() {
+	close(m.done)
+}
+
+// Online reports whether the endpoint was reachable when last checked.
+func (m *Monitor) Online() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.online
+}
+
+// Do runs fn once the endpoint is reachable and every call queued before it
+// has finished. If fn fails because the endpoint is unreachable, uploads are
+// paused and fn keeps its place at the head of the queue until the endpoint
+// is reachable again, so a dead link does not use up any retry attempts.
+func (m *Monitor) Do(fn func() error) error {
+	m.lock.Lock()
+	ticket := m.next
+	m.next++
+	m.lock.Unlock()
+
+	for {
+		m.lock.Lock()
+		ready := m.online && m.serving == ticket
+		changed := m.changed
+		m.lock.Unlock()
+
+		if ready {
+			err := fn()
+			if uploader.IsUnreachable(err) {
+				m.setOnline(false, err)
+				continue
+			}
+			m.lock.Lock()
+			m.advance()
+			m.lock.Unlock()
+			return err
+		}
+
+		select {
+		case <-m.done:
+			m.abandon(ticket)
+			return ErrStopped
+		case <-changed:
+		}
+	}
+}
+
+func (m *Monitor) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
+	defer cancel()
+	err := m.prober.Probe(ctx)
+	if uploader.IsUnreachable(err) {
+		m.setOnline(false, err)
+		return
+	}
+	if err != nil {
+		// The endpoint answered, whatever is wrong is not the link
+		logger.Debug("S3 endpoint reachable but probe failed", "error", err)
+	}
+	m.setOnline(true, nil)
+}
+
+func (m *Monitor) setOnline(online bool, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.online == online {
+		return
+	}
+	m.online = online
+	if online {
+		logger.Info("S3 endpoint reachable again, resuming uploads", "queued", m.next-m.serving)
+	} else {
+		logger.Warn("S3 endpoint unreachable, pausing uploads", "error", err)
+		select {
+		case m.recheck <- struct{}{}:
+		default:
+		}
+	}
+	m.broadcast()
+}
+
+// abandon gives up the place of a call that is no longer waiting.
+func (m *Monitor) abandon(ticket uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ticket == m.serving {
+		m.advance()
+		return
+	}
+	m.abandoned[ticket] = struct{}{}
+}
+
+// advance moves on to the next call still waiting. m.lock must be held.
+func (m *Monitor) advance() {
+	m.serving++
+	for {
+		if _, ok := m.abandoned[m.serving]; !ok {
+			break
+		}
+		delete(m.abandoned, m.serving)
+		m.serving++
+	}
+	m.broadcast()
+}
+
+// broadcast wakes every queued call. m.lock must be held.
+func (m *Monitor) broadcast() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
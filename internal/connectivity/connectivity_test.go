@@ -0,0 +1,135 @@
+package connectivity_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/connectivity"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+type fakeProber struct {
+	online atomic.Bool
+}
+
+func (p *fakeProber) Probe(_ context.Context) error {
+	if p.online.Load() {
+		return nil
+	}
+	return &smithyhttp.RequestSendError{Err: errors.New("connection refused")}
+}
+
+func TestPauseAndOrderedResume(t *testing.T) {
+	t.Parallel()
+	prober := &fakeProber{}
+	monitor := connectivity.NewMonitor(config.Connectivity{
+		Interval:        time.Hour,
+		OfflineInterval: 10 * time.Millisecond,
+		Timeout:         time.Second,
+	}, prober)
+	defer monitor.Stop()
+	go monitor.Run()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for monitor.Online() {
+		if time.Now().After(deadline) {
+			t.Fatal("monitor did not notice the endpoint was unreachable")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var lock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := monitor.Do(func() error {
+				lock.Lock()
+				defer lock.Unlock()
+				order = append(order, i)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Do returned %v", err)
+			}
+		}()
+		// Give each call time to take its place in the queue
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	lock.Lock()
+	if len(order) != 0 {
+		t.Fatalf("calls ran while the endpoint was unreachable: %v", order)
+	}
+	lock.Unlock()
+
+	prober.online.Store(true)
+	wg.Wait()
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("calls ran out of order: %v", order)
+		}
+	}
+}
+
+func TestUnreachableCallKeepsItsPlace(t *testing.T) {
+	t.Parallel()
+	prober := &fakeProber{}
+	prober.online.Store(true)
+	monitor := connectivity.NewMonitor(config.Connectivity{
+		Interval:        time.Hour,
+		OfflineInterval: 10 * time.Millisecond,
+		Timeout:         time.Second,
+	}, prober)
+	defer monitor.Stop()
+
+	var calls int
+	err := monitor.Do(func() error {
+		calls++
+		if calls == 1 {
+			prober.online.Store(false)
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				prober.online.Store(true)
+			}()
+			go monitor.Run()
+			return &smithyhttp.RequestSendError{Err: errors.New("connection reset")}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do returned %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected the call to be retried once the link returned, got %d calls", calls)
+	}
+}
+
+func TestStopReleasesQueuedCalls(t *testing.T) {
+	t.Parallel()
+	monitor := connectivity.NewMonitor(config.Connectivity{
+		Interval:        time.Hour,
+		OfflineInterval: time.Hour,
+		Timeout:         time.Second,
+	}, &fakeProber{})
+	go monitor.Run()
+
+	for monitor.Online() {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		monitor.Stop()
+	}()
+	err := monitor.Do(func() error { return nil })
+	if !errors.Is(err, connectivity.ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+}
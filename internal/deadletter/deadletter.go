@@ -0,0 +1,62 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fsutil"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("deadletter")
+
+// ReportSuffix is appended to the frame's file name for its error report.
+const ReportSuffix = ".error.json"
+
+// Report describes why a file was given up on.
+type Report struct {
+	Path           string    `json:"path"`
+	Error          string    `json:"error"`
+	Permanent      bool      `json:"permanent"`
+	Attempts       uint      `json:"attempts"`
+	FirstFailure   time.Time `json:"first-failure"`
+	DeadLetteredAt time.Time `json:"dead-lettered-at"`
+}
+
+// Send moves a group of files from under root into dir, keeping their
+// relative path, and writes the report next to the first file of the group.
+func Send(dir string, group []string, root string, report Report) error {
+	report.DeadLetteredAt = time.Now()
+	var reportPath string
+	for i, path := range group {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve relative path: %w", err)
+		}
+		dst := filepath.Join(dir, rel)
+		if i == 0 {
+			reportPath = dst + ReportSuffix
+		}
+		err = fsutil.Move(path, dst)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to move file to dead-letter directory: %w", err)
+		}
+		logger.Warn("moved file to dead-letter directory", "path", path, "destination", dst)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal error report: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(reportPath), 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(reportPath, data, 0o600)
+}
@@ -0,0 +1,257 @@
+package fits
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	blockSize = 2880
+	cardSize  = 80
+)
+
+// Extensions lists the file extensions that are treated as FITS files.
+var Extensions = []string{".fits", ".fit", ".fts"}
+
+var ErrNotFITS = errors.New("not a FITS file")
+
+// Header holds the keyword values of a FITS primary header. String values
+// are unquoted and comments are dropped.
+type Header map[string]string
+
+// IsFITS reports whether the path has a FITS file extension.
+func IsFITS(path string) bool {
+	return slices.Contains(Extensions, strings.ToLower(filepath.Ext(path)))
+}
+
+// ReadFile reads the primary header of the FITS file at path.
+func ReadFile(path string) (Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadHeader(file)
+}
+
+// ReadHeader reads the primary header from r, stopping after the block that
+// contains the END card.
+func ReadHeader(r io.Reader) (Header, error) {
+	header := Header{}
+	block := make([]byte, blockSize)
+	first := true
+	for {
+		_, err := io.ReadFull(r, block)
+		if err != nil {
+			if first {
+				return nil, ErrNotFITS
+			}
+			return nil, fmt.Errorf("failed to read header block: %w", err)
+		}
+		for i := 0; i < blockSize; i += cardSize {
+			card := string(block[i : i+cardSize])
+			keyword := strings.TrimSpace(card[:8])
+			if first && i == 0 && keyword != "SIMPLE" {
+				return nil, ErrNotFITS
+			}
+			if keyword == "END" {
+				return header, nil
+			}
+			if card[8:10] != "= " || keyword == "" {
+				continue
+			}
+			header[keyword] = parseValue(card[10:])
+		}
+		first = false
+	}
+}
+
+func parseValue(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "'") {
+		var sb strings.Builder
+		for i := 1; i < len(value); i++ {
+			if value[i] == '\'' {
+				// Two single quotes are an escaped quote
+				if i+1 < len(value) && value[i+1] == '\'' {
+					sb.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			sb.WriteByte(value[i])
+		}
+		return strings.TrimRight(sb.String(), " ")
+	}
+	if idx := strings.Index(value, "/"); idx >= 0 {
+		value = value[:idx]
+	}
+	return strings.TrimSpace(value)
+}
+
+// MetadataPrefix starts the object metadata keys that hold header values.
+const MetadataPrefix = "fits-"
+
+// nightOffset shifts an observation time so a whole night, which spans
+// midnight, falls on the date it began
+const nightOffset = 12 * time.Hour
+
+// MetadataKeywords are the header keywords stored with each uploaded FITS
+// file, so objects can be found again without downloading them.
+var MetadataKeywords = []string{"OBJECT", "FILTER", "IMAGETYP", "DATE-OBS", "DATE-LOC", "SITELONG"}
+
+// Metadata returns the values of MetadataKeywords in h as object metadata,
+// reduced to printable ASCII as S3 requires.
+func Metadata(h Header) map[string]string {
+	metadata := make(map[string]string)
+	for _, keyword := range MetadataKeywords {
+		value := strings.Map(func(r rune) rune {
+			if r < ' ' || r > '~' {
+				return -1
+			}
+			return r
+		}, h[keyword])
+		if value != "" {
+			metadata[MetadataPrefix+strings.ToLower(keyword)] = value
+		}
+	}
+	return metadata
+}
+
+// FromMetadata returns the header values stored in object metadata.
+func FromMetadata(metadata map[string]string) Header {
+	h := Header{}
+	for key, value := range metadata {
+		if keyword, ok := strings.CutPrefix(strings.ToLower(key), MetadataPrefix); ok {
+			h[strings.ToUpper(keyword)] = value
+		}
+	}
+	return h
+}
+
+// Night returns the date the night of the observation began. The local
+// DATE-LOC is used if present, otherwise the UTC DATE-OBS is shifted to the
+// local solar time of the east longitude in SITELONG, or to the local time
+// zone for frames without one.
+func Night(h Header) (string, bool) {
+	t, ok := parseDate(h["DATE-LOC"])
+	if !ok {
+		t, ok = ObservationTime(h)
+		if !ok {
+			return "", false
+		}
+		if longitude, err := strconv.ParseFloat(h["SITELONG"], 64); err == nil {
+			t = t.Add(time.Duration(longitude / 15 * float64(time.Hour)))
+		} else {
+			t = t.In(time.Local)
+		}
+	}
+	return t.Add(-nightOffset).Format(time.DateOnly), true
+}
+
+// ObservationTime returns when the observation started, from the UTC
+// DATE-OBS.
+func ObservationTime(h Header) (time.Time, bool) {
+	return parseDate(h["DATE-OBS"])
+}
+
+// parseDate parses a FITS date value, dropping fractional seconds.
+func parseDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006-01-02T15:04:05", strings.SplitN(value, ".", 2)[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// ErrUnsupportedImage is returned for image data ReadImage cannot decode.
+var ErrUnsupportedImage = errors.New("Unsupported FITS image")
+
+// Image is the first plane of the primary image of a FITS file, with BZERO
+// and BSCALE applied.
+type Image struct {
+	Width  int
+	Height int
+	// Pixels are stored row by row
+	Pixels []float32
+}
+
+// At returns the value of the pixel in column x of row y.
+func (i *Image) At(x, y int) float32 {
+	return i.Pixels[y*i.Width+x]
+}
+
+// ReadImage reads the image described by h from r, which must be positioned
+// at the start of the data, right after the header. Color images are reduced
+// to their first plane.
+func ReadImage(r io.Reader, h Header) (*Image, error) {
+	bitpix, err := strconv.Atoi(h["BITPIX"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid BITPIX %q", ErrUnsupportedImage, h["BITPIX"])
+	}
+	axes, _ := strconv.Atoi(h["NAXIS"])
+	width, _ := strconv.Atoi(h["NAXIS1"])
+	height, _ := strconv.Atoi(h["NAXIS2"])
+	if axes < 2 || width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("%w: not a two-dimensional image", ErrUnsupportedImage)
+	}
+	zero, scale := 0.0, 1.0
+	if value, err := strconv.ParseFloat(h["BZERO"], 64); err == nil {
+		zero = value
+	}
+	if value, err := strconv.ParseFloat(h["BSCALE"], 64); err == nil {
+		scale = value
+	}
+
+	var decode func([]byte) float64
+	switch bitpix {
+	case 8:
+		decode = func(b []byte) float64 { return float64(b[0]) }
+	case 16:
+		decode = func(b []byte) float64 { return float64(int16(binary.BigEndian.Uint16(b))) }
+	case 32:
+		decode = func(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b))) }
+	case -32:
+		decode = func(b []byte) float64 { return float64(math.Float32frombits(binary.BigEndian.Uint32(b))) }
+	case -64:
+		decode = func(b []byte) float64 { return math.Float64frombits(binary.BigEndian.Uint64(b)) }
+	default:
+		return nil, fmt.Errorf("%w: BITPIX %d", ErrUnsupportedImage, bitpix)
+	}
+
+	size := abs(bitpix) / 8
+	image := &Image{Width: width, Height: height, Pixels: make([]float32, width*height)}
+	row := make([]byte, width*size)
+	reader := bufio.NewReader(r)
+	for y := range height {
+		_, err := io.ReadFull(reader, row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image data: %w", err)
+		}
+		for x := range width {
+			image.Pixels[y*width+x] = float32(zero + scale*decode(row[x*size:]))
+		}
+	}
+	return image, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
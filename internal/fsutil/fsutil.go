@@ -0,0 +1,95 @@
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// PartialSuffix ends the name of a copy that is still being written.
+const PartialSuffix = ".partial"
+
+// CopyFile copies the regular file src to dst. The copy is written to a
+// temporary file next to dst and renamed into place once it is complete, so
+// an interrupted copy never leaves a partial file at dst.
+func CopyFile(src, dst string) error {
+	sourceFileStat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !sourceFileStat.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", src)
+	}
+
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*"+PartialSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := destination.Name()
+	cleanup := func() {
+		destination.Close()
+		removeErr := os.Remove(tmp)
+		if removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			slog.Error("failed to cleanup failed copy", "path", tmp, "error", removeErr)
+		}
+	}
+
+	_, err = io.Copy(destination, source)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	err = destination.Sync()
+	if err != nil {
+		cleanup()
+		return err
+	}
+	err = destination.Close()
+	if err != nil {
+		cleanup()
+		return err
+	}
+	err = os.Chmod(tmp, sourceFileStat.Mode().Perm())
+	if err != nil {
+		cleanup()
+		return err
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	return nil
+}
+
+// Move renames src to dst, creating dst's directory. Across file systems,
+// where a rename is not possible, it copies and then removes src.
+func Move(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0o755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) {
+		return err
+	}
+	err = CopyFile(src, dst)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
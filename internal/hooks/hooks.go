@@ -0,0 +1,181 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("hooks")
+
+type Event string
+
+const (
+	PreUpload  Event = "pre-upload"
+	PostUpload Event = "post-upload"
+	OnFailure  Event = "on-failure"
+	OnSpill    Event = "on-spill"
+	OnNightEnd Event = "on-night-end"
+)
+
+const (
+	// maxOutput bounds the output of a failed hook quoted in its error
+	maxOutput = 512
+	// maxCapture bounds the output of a hook kept for the debug log, a
+	// chatty hook keeps only its end
+	maxCapture = 64 * 1024
+	// waitDelay is how long the output of a killed hook is waited for, in
+	// case a child it started holds on to it
+	waitDelay = time.Second
+)
+
+// ErrFailed is returned when a hook exits non-zero, times out or cannot be
+// started.
+var ErrFailed = errors.New("Hook failed")
+
+// Env is what a hook is told about its event. Empty fields are left out of
+// the environment.
+type Env struct {
+	Path   string
+	Key    string
+	Bucket string
+	Size   int64
+	SHA256 string
+	Error  string
+	// Night is the date the night began, for OnNightEnd
+	Night string
+	// Files counts the frames uploaded during the night, for OnNightEnd
+	Files int
+}
+
+// variables returns the environment variables for env.
+func (e Env) variables() []string {
+	var vars []string
+	add := func(name, value string) {
+		if value != "" {
+			vars = append(vars, "HOOK_"+name+"="+value)
+		}
+	}
+	add("PATH", e.Path)
+	add("KEY", e.Key)
+	add("BUCKET", e.Bucket)
+	if e.Size > 0 {
+		add("SIZE", strconv.FormatInt(e.Size, 10))
+	}
+	add("SHA256", e.SHA256)
+	add("ERROR", e.Error)
+	add("NIGHT", e.Night)
+	if e.Files > 0 {
+		add("FILES", strconv.Itoa(e.Files))
+	}
+	return vars
+}
+
+// Runner runs the hooks of one profile.
+type Runner struct {
+	config  config.Hooks
+	profile string
+}
+
+func NewRunner(cfg config.Hooks, profile string) *Runner {
+	return &Runner{config: cfg, profile: profile}
+}
+
+// Hook returns the configuration of the hook of event.
+func (r *Runner) Hook(event Event) config.Hook {
+	switch event {
+	case PreUpload:
+		return r.config.PreUpload
+	case PostUpload:
+		return r.config.PostUpload
+	case OnFailure:
+		return r.config.OnFailure
+	case OnSpill:
+		return r.config.OnSpill
+	case OnNightEnd:
+		return r.config.OnNightEnd
+	}
+	return config.Hook{}
+}
+
+// Configured reports whether the hook of event has a command.
+func (r *Runner) Configured(event Event) bool {
+	return len(r.Hook(event).Command) > 0
+}
+
+// Run runs the hook of event with env and waits for it to exit, killing it
+// after its timeout. Hooks without a command succeed at once.
+func (r *Runner) Run(ctx context.Context, event Event, env Env) error {
+	hook := r.Hook(event)
+	if len(hook.Command) == 0 {
+		return nil
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+
+	//nolint:gosec // the command is configured by the operator
+	cmd := exec.CommandContext(hookCtx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(), "HOOK_EVENT="+string(event), "HOOK_PROFILE="+r.profile)
+	cmd.Env = append(cmd.Env, env.variables()...)
+	cmd.WaitDelay = waitDelay
+	output := &tailBuffer{limit: maxCapture}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	err := cmd.Run()
+	log := logger.With("hook", event, "path", env.Path, "duration", time.Since(start))
+	if out := strings.TrimSpace(output.String()); out != "" {
+		log.Debug("hook output", "output", out)
+	}
+	if err != nil {
+		// A cancelled parent context is a shutdown, not a slow hook
+		if errors.Is(hookCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			err = fmt.Errorf("timed out after %v: %w", hook.Timeout, err)
+		}
+		return fmt.Errorf("%w: %s: %w%s", ErrFailed, event, err, quote(output.String()))
+	}
+	log.Debug("hook finished")
+	return nil
+}
+
+// quote returns the end of the output of a failed hook for its error.
+func quote(output string) string {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return ""
+	}
+	if len(output) > maxOutput {
+		output = "..." + output[len(output)-maxOutput:]
+	}
+	return ": " + output
+}
+
+// tailBuffer keeps the last limit bytes written to it. Stdout and stderr
+// share it, and exec writes to a shared writer from one goroutine at a time.
+type tailBuffer struct {
+	limit int
+	data  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	// Trimming once the buffer doubles keeps appends amortized
+	if len(b.data) > 2*b.limit {
+		b.data = append(b.data[:0], b.data[len(b.data)-b.limit:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.data[max(len(b.data)-b.limit, 0):])
+}
@@ -0,0 +1,82 @@
+package hooks_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/hooks"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with sh")
+	}
+	out := filepath.Join(t.TempDir(), "env")
+	runner := hooks.NewRunner(config.Hooks{
+		PostUpload: config.Hook{
+			Command: []string{"sh", "-c", `echo "$HOOK_EVENT $HOOK_PROFILE $HOOK_KEY $HOOK_SIZE $HOOK_ERROR" > "$0"`, out},
+			Timeout: 5 * time.Second,
+		},
+		PreUpload: config.Hook{
+			Command: []string{"sh", "-c", "echo not tonight >&2; exit 3"},
+			Timeout: 5 * time.Second,
+		},
+		OnFailure: config.Hook{
+			Command: []string{"sleep", "10"},
+			Timeout: 50 * time.Millisecond,
+		},
+		OnNightEnd: config.Hook{
+			Command: []string{"sh", "-c", "head -c 1000000 /dev/zero | tr '\\0' x; echo; echo the end; exit 1"},
+			Timeout: 5 * time.Second,
+		},
+	}, "main")
+
+	err := runner.Run(context.Background(), hooks.PostUpload, hooks.Env{Path: "/frames/a.fits", Key: "M31/a.fits", Size: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(env)); got != "post-upload main M31/a.fits 42" {
+		t.Fatalf("hook saw %q", got)
+	}
+
+	err = runner.Run(context.Background(), hooks.PreUpload, hooks.Env{Path: "/frames/a.fits"})
+	if !errors.Is(err, hooks.ErrFailed) || !strings.Contains(err.Error(), "not tonight") {
+		t.Fatalf("expected the failure with its output, got %v", err)
+	}
+
+	start := time.Now()
+	err = runner.Run(context.Background(), hooks.OnFailure, hooks.Env{})
+	if !errors.Is(err, hooks.ErrFailed) || !strings.Contains(err.Error(), "timed out") || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the hook to time out, got %v after %v", err, time.Since(start))
+	}
+
+	// A hook stopped by a shutdown did not time out
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = runner.Run(ctx, hooks.OnFailure, hooks.Env{})
+	if !errors.Is(err, hooks.ErrFailed) || strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected the cancelled hook to fail without timing out, got %v", err)
+	}
+
+	// Only the end of a chatty hook's output is kept
+	err = runner.Run(context.Background(), hooks.OnNightEnd, hooks.Env{})
+	if !errors.Is(err, hooks.ErrFailed) || !strings.HasSuffix(err.Error(), "the end") || len(err.Error()) > 1024 {
+		t.Fatalf("expected the end of the output, got %d bytes", len(err.Error()))
+	}
+
+	if err := runner.Run(context.Background(), hooks.OnSpill, hooks.Env{}); err != nil || runner.Configured(hooks.OnSpill) {
+		t.Fatalf("hook without a command ran: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/lmittmann/tint"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	// SubsystemKey is the attribute naming the subsystem that logged a line
+	SubsystemKey = "subsystem"
+	// FileKey is the attribute identifying the file a line is about
+	FileKey = "file"
+
+	fileIDLength = 12
+	bytesPerMB   = 1024 * 1024
+	hoursPerDay  = 24
+)
+
+// output is what every logger currently writes to. It is replaced as a
+// whole on Configure, so loggers created before keep working.
+type output struct {
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+}
+
+//nolint:gochecknoglobals
+var (
+	current    atomic.Pointer[output]
+	subsystems sync.Map
+
+	fileLock    sync.Mutex
+	file        *lumberjack.Logger
+	fileOptions config.LogFile
+)
+
+//nolint:gochecknoinits
+func init() {
+	current.Store(&output{
+		handler: tint.NewHandler(os.Stdout, &tint.Options{Level: slog.LevelDebug}),
+		level:   slog.LevelInfo,
+	})
+}
+
+// For returns the logger of a subsystem, whose level can be overridden in
+// log.levels. It follows later calls to Configure, so it can be kept in a
+// package variable.
+func For(subsystem string) *slog.Logger {
+	subsystems.Store(subsystem, true)
+	return slog.New(&handler{subsystem: subsystem}).With(SubsystemKey, subsystem)
+}
+
+// File returns the attribute identifying the file at path. The ID is derived
+// from the path below the watched or local directory, so a frame keeps it
+// from the watcher through its uploads and retries.
+func File(cfg config.Uploader, path string) slog.Attr {
+	rel, ok := cfg.RelativePath(path)
+	if !ok {
+		rel = filepath.ToSlash(path)
+	}
+	sum := sha256.Sum256([]byte(rel))
+	return slog.String(FileKey, hex.EncodeToString(sum[:])[:fileIDLength])
+}
+
+// Configure applies the log level, format and destination of cfg to every
+// logger, including the default slog logger.
+func Configure(cfg *config.Config) {
+	writer := io.Writer(os.Stdout)
+	if cfg.Log.File.Path != "" {
+		writer = openFile(cfg.Log.File)
+	} else {
+		closeFile()
+	}
+
+	var inner slog.Handler
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch cfg.Log.Format {
+	case config.LogFormatJSON:
+		inner = slog.NewJSONHandler(writer, options)
+	case config.LogFormatText:
+		inner = slog.NewTextHandler(writer, options)
+	default:
+		inner = tint.NewHandler(writer, &tint.Options{Level: slog.LevelDebug, NoColor: cfg.Log.File.Path != ""})
+	}
+
+	levels := make(map[string]slog.Level, len(cfg.Log.Levels))
+	for subsystem, level := range cfg.Log.Levels {
+		levels[subsystem] = Level(level)
+	}
+	current.Store(&output{
+		handler: inner,
+		level:   Level(cfg.LogLevel),
+		levels:  levels,
+	})
+	slog.SetDefault(slog.New(&handler{}))
+
+	for subsystem := range cfg.Log.Levels {
+		if _, ok := subsystems.Load(subsystem); !ok {
+			slog.Warn("log level set for unknown subsystem", SubsystemKey, subsystem)
+		}
+	}
+}
+
+// Close closes the log file, if any.
+func Close() error {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	if file == nil {
+		return nil
+	}
+	err := file.Close()
+	file = nil
+	return err
+}
+
+// openFile returns the rotating log file, reusing the open one if its
+// options are unchanged so lines in flight are not lost.
+func openFile(options config.LogFile) *lumberjack.Logger {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	if file != nil && fileOptions == options {
+		return file
+	}
+	if file != nil {
+		file.Close()
+	}
+	file = &lumberjack.Logger{
+		Filename:   options.Path,
+		MaxSize:    max(1, int((options.MaxSize+bytesPerMB-1)/bytesPerMB)),
+		MaxAge:     int((options.MaxAge.Hours() + hoursPerDay - 1) / hoursPerDay),
+		MaxBackups: options.MaxBackups,
+		LocalTime:  true,
+		Compress:   options.Compress,
+	}
+	fileOptions = options
+	return file
+}
+
+func closeFile() {
+	err := Close()
+	if err != nil {
+		slog.Error("failed to close log file", "error", err)
+	}
+}
+
+// Level converts a config log level to its slog level.
+func Level(level config.LogLevel) slog.Level {
+	switch level {
+	case config.LogLevelDebug:
+		return slog.LevelDebug
+	case config.LogLevelWarn:
+		return slog.LevelWarn
+	case config.LogLevelError:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// handler filters records by the level of its subsystem and passes them to
+// the current output, replaying the attributes and groups added to it.
+type handler struct {
+	subsystem string
+	ops       []func(slog.Handler) slog.Handler
+	resolved  atomic.Pointer[resolved]
+}
+
+type resolved struct {
+	output  *output
+	handler slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	out := current.Load()
+	minimum, ok := out.levels[h.subsystem]
+	if !ok {
+		minimum = out.level
+	}
+	return level >= minimum
+}
+
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	return h.resolve().Handle(ctx, record)
+}
+
+func (h *handler) resolve() slog.Handler {
+	out := current.Load()
+	if r := h.resolved.Load(); r != nil && r.output == out {
+		return r.handler
+	}
+	inner := out.handler
+	for _, op := range h.ops {
+		inner = op(inner)
+	}
+	h.resolved.Store(&resolved{output: out, handler: inner})
+	return inner
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	return &handler{
+		subsystem: h.subsystem,
+		ops:       append(slices.Clip(h.ops), op),
+	}
+}
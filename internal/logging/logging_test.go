@@ -0,0 +1,83 @@
+package logging_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+)
+
+func TestFile(t *testing.T) {
+	t.Parallel()
+	uploader := config.Uploader{
+		Directory: filepath.Join("/", "src"),
+		Local:     config.Local{Directory: filepath.Join("/", "local")},
+	}
+	source := logging.File(uploader, filepath.Join("/", "src", "n1", "a.fits"))
+	local := logging.File(uploader, filepath.Join("/", "local", "n1", "a.fits"))
+	other := logging.File(uploader, filepath.Join("/", "src", "n1", "b.fits"))
+	if source.Key != logging.FileKey || source.Value.String() == "" {
+		t.Fatalf("unexpected attribute %v", source)
+	}
+	if !source.Equal(local) {
+		t.Errorf("moving a file to the local directory changed its ID from %v to %v", source, local)
+	}
+	if source.Equal(other) {
+		t.Errorf("different files share the ID %v", source)
+	}
+}
+
+//nolint:paralleltest // Configure changes the loggers of the whole process
+func TestConfigure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "uploader.log")
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		Log: config.Log{
+			Format: config.LogFormatJSON,
+			File:   config.LogFile{Path: path, MaxSize: 1024 * 1024},
+			Levels: map[string]config.LogLevel{"test-watcher": config.LogLevelDebug},
+		},
+	}
+	// Loggers made before Configure follow it
+	watcher := logging.For("test-watcher")
+	manager := logging.For("test-manager").With("profile", "main")
+	logging.Configure(cfg)
+	t.Cleanup(func() {
+		logging.Configure(&config.Config{LogLevel: config.LogLevelInfo})
+	})
+
+	watcher.Debug("watcher debug")
+	manager.Debug("manager debug")
+	manager.Info("manager info")
+	if err := logging.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []map[string]any
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %v", len(lines), lines)
+	}
+	if lines[0]["msg"] != "watcher debug" || lines[0][logging.SubsystemKey] != "test-watcher" {
+		t.Errorf("unexpected first line %v", lines[0])
+	}
+	if lines[1]["msg"] != "manager info" || lines[1][logging.SubsystemKey] != "test-manager" || lines[1]["profile"] != "main" {
+		t.Errorf("unexpected second line %v", lines[1])
+	}
+}
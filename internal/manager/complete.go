@@ -0,0 +1,173 @@
+package manager
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/sidecar"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/watcher"
+)
+
+type directoryActivity struct {
+	LastActivity time.Time
+	Files        int
+	// Locations are where the frames of the directory were uploaded into,
+	// which the marker and the shared sidecars are written to
+	Locations []uploader.Location
+}
+
+type completeMarker struct {
+	Directory   string    `json:"directory"`
+	Files       int       `json:"files"`
+	CompletedAt time.Time `json:"completed-at"`
+}
+
+func (u *Manager) markActivity(path string) {
+	if !u.config.Uploader.CompleteMarker.Enabled {
+		return
+	}
+	u.activity.Compute(filepath.Dir(path), func(activity directoryActivity, _ bool) (directoryActivity, bool) {
+		activity.LastActivity = time.Now()
+		activity.Files++
+		return activity, false
+	})
+}
+
+// markUploaded records where the frame at path was uploaded into.
+func (u *Manager) markUploaded(path string, result uploader.Result) {
+	if !u.config.Uploader.CompleteMarker.Enabled {
+		return
+	}
+	u.activity.Compute(filepath.Dir(path), func(activity directoryActivity, loaded bool) (directoryActivity, bool) {
+		if loc := result.Location(); loaded && !slices.Contains(activity.Locations, loc) {
+			activity.Locations = append(activity.Locations, loc)
+		}
+		return activity, !loaded
+	})
+}
+
+func (u *Manager) watchCompletion() {
+	ticker := time.NewTicker(tickerPeriod(u.config.Uploader.CompleteMarker.Idle))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.stopping.Done():
+			return
+		case <-ticker.C:
+			u.checkCompletion()
+		}
+	}
+}
+
+// tickerPeriod is how often a condition that takes d to become true is
+// checked, half of d within a second and a minute.
+func tickerPeriod(d time.Duration) time.Duration {
+	return min(max(d/2, time.Second), time.Minute)
+}
+
+func (u *Manager) checkCompletion() {
+	if !u.connectivity.Online() || !u.begin() {
+		return
+	}
+	defer u.inflight.Done()
+
+	u.activity.Range(func(dir string, activity directoryActivity) bool {
+		if time.Since(activity.LastActivity) < u.config.Uploader.CompleteMarker.Idle {
+			return true
+		}
+		if u.hasPendingFrames(dir) {
+			logger.Debug("directory is idle but still has pending frames", "path", dir)
+			return true
+		}
+
+		locations := activity.Locations
+		if len(locations) == 0 {
+			loc, err := u.uploader.MarkerLocation(dir)
+			if err != nil {
+				logger.Error("failed to resolve complete marker location", "path", dir, "error", err)
+				return true
+			}
+			locations = []uploader.Location{loc}
+		}
+
+		// Sidecars written after the last frame, and those shared by the
+		// directory such as a session log, are left in place by the groups
+		// of the frames, now that the directory is idle they are final and
+		// go beside every frame they were shared by
+		for _, leftover := range sidecar.Leftovers(dir, u.config.Uploader.Sidecars) {
+			if u.postUpload.Retained(leftover) {
+				continue
+			}
+			rel, ok := u.config.Uploader.RelativePath(leftover)
+			if !ok {
+				logger.Error("file path does not match local or source directory", "path", leftover)
+				continue
+			}
+			for _, loc := range locations {
+				err := u.uploader.UploadInto(u.ctx, leftover, rel, loc)
+				if err != nil {
+					logger.Error("failed to upload leftover sidecar", "path", leftover, "error", err)
+					return true
+				}
+			}
+			u.postUpload.Apply([]string{leftover}, u.config.Uploader.Directory, "")
+		}
+
+		rel, err := filepath.Rel(u.config.Uploader.Directory, dir)
+		if err != nil {
+			logger.Error("failed to resolve relative path", "path", dir, "error", err)
+			return true
+		}
+		body, err := json.Marshal(completeMarker{
+			Directory:   filepath.ToSlash(rel),
+			Files:       activity.Files,
+			CompletedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			logger.Error("failed to marshal complete marker", "path", dir, "error", err)
+			return true
+		}
+
+		for _, loc := range locations {
+			err = u.uploader.WriteMarker(u.ctx, loc, body)
+			if err != nil {
+				logger.Error("failed to write complete marker", "path", dir, "error", err)
+				return true
+			}
+		}
+		logger.Info("wrote complete marker", "path", dir, "files", activity.Files)
+		u.activity.Delete(dir)
+		return true
+	})
+}
+
+// hasPendingFrames reports whether any frame from dir is still waiting to be
+// uploaded, either in the source directory or in its local directory mirror.
+func (u *Manager) hasPendingFrames(dir string) bool {
+	roots := map[string]string{dir: u.config.Uploader.Directory}
+	rel, err := filepath.Rel(u.config.Uploader.Directory, dir)
+	if err == nil {
+		roots[filepath.Join(u.config.Uploader.Local.Directory, rel)] = u.config.Uploader.Local.Directory
+	}
+
+	for d, root := range roots {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			path := filepath.Join(d, entry.Name())
+			if entry.IsDir() || !watcher.Watched(u.config, root, path) {
+				continue
+			}
+			if !u.postUpload.Retained(path) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/deadletter"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/hooks"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+)
+
+type nightActivity struct {
+	LastActivity time.Time
+	Files        int
+	Size         int64
+}
+
+// preUpload runs the pre-upload hook and reports whether the group of the
+// frame at path may be uploaded. A group the hook vetoes is dead-lettered
+// relative to root, the directory it is in, one it skips is left in place.
+func (u *Manager) preUpload(path string, group []string, root string) bool {
+	if !u.hooks.Configured(hooks.PreUpload) {
+		return true
+	}
+	log := logger.With(logging.File(u.config.Uploader, path))
+	env := hooks.Env{Path: path, SHA256: u.checksum(path)}
+	if info, err := os.Stat(path); err == nil {
+		env.Size = info.Size()
+	}
+	if rel, ok := u.config.Uploader.RelativePath(path); ok {
+		target, err := u.uploader.Destination(path, rel)
+		if err != nil {
+			log.Warn("failed to resolve object key for pre-upload hook", "path", path, "error", err)
+		}
+		env.Bucket, env.Key = target.Bucket, target.Key
+	}
+
+	err := u.hooks.Run(u.ctx, hooks.PreUpload, env)
+	if err == nil {
+		return true
+	}
+	if u.config.Uploader.Hooks.PreUpload.Reject != config.HookRejectVeto {
+		log.Info("pre-upload hook skipped upload, leaving file in place", "path", path, "error", err)
+		return false
+	}
+
+	log.Warn("pre-upload hook vetoed upload", "path", path, "error", err)
+	u.metrics.DeadLettered()
+	reason := err.Error()
+	err = deadletter.Send(u.config.Uploader.DeadLetter.Directory, group, root, deadletter.Report{
+		Path:      path,
+		Error:     reason,
+		Permanent: true,
+	})
+	if err != nil {
+		log.Error("failed to move file to dead-letter directory", "path", path, "error", err)
+	}
+	u.uploader.MarkDeadLettered(group, reason)
+	return false
+}
+
+// checksum returns the SHA-256 of the file at path for a hook, empty if it
+// cannot be read. The upload reuses it rather than reading the file again.
+func (u *Manager) checksum(path string) string {
+	sum, err := u.uploader.Checksum(path)
+	if err != nil {
+		logger.Warn("failed to hash file for hook", "path", path, "error", err, logging.File(u.config.Uploader, path))
+	}
+	return sum
+}
+
+// runHook runs the hook of event, a failing hook is only logged.
+func (u *Manager) runHook(event hooks.Event, env hooks.Env) {
+	if err := u.hooks.Run(u.ctx, event, env); err != nil {
+		logger.Warn("hook failed", "hook", event, "path", env.Path, "error", err, logging.File(u.config.Uploader, env.Path))
+	}
+}
+
+// markNight counts an uploaded frame towards the night it was taken in.
+func (u *Manager) markNight(result uploader.Result) {
+	if !u.hooks.Configured(hooks.OnNightEnd) {
+		return
+	}
+	night, ok := fits.Night(result.Header)
+	if !ok {
+		return
+	}
+	u.nights.Compute(night, func(activity nightActivity, _ bool) (nightActivity, bool) {
+		activity.LastActivity = time.Now()
+		activity.Files++
+		activity.Size += result.Size
+		return activity, false
+	})
+}
+
+// watchNights runs the on-night-end hook for each night once no frame of it
+// has been uploaded for the night end period.
+func (u *Manager) watchNights() {
+	ticker := time.NewTicker(tickerPeriod(u.config.Uploader.Hooks.NightEnd))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.stopping.Done():
+			return
+		case <-ticker.C:
+		}
+		u.nights.Range(func(night string, activity nightActivity) bool {
+			if time.Since(activity.LastActivity) < u.config.Uploader.Hooks.NightEnd {
+				return true
+			}
+			u.nights.Delete(night)
+			logger.Info("night ended", "night", night, "files", activity.Files)
+			u.runHook(hooks.OnNightEnd, hooks.Env{
+				Path:   filepath.Clean(u.config.Uploader.Directory),
+				Bucket: u.config.S3.Bucket,
+				Size:   activity.Size,
+				Night:  night,
+				Files:  activity.Files,
+			})
+			return true
+		})
+	}
+}
@@ -1,33 +1,93 @@
 package manager
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
-	"log/slog"
 	"os"
 	"path/filepath"
-	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/bandwidth"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/catalog"
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/connectivity"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/deadletter"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fsutil"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/hooks"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/metrics"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/ninaapi"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/postupload"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/priority"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/quiet"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/retrypolicy"
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/reupload"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/sidecar"
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/watcher"
 	"github.com/avast/retry-go/v4"
+	"github.com/puzpuzpuz/xsync/v3"
 	"golang.org/x/sync/errgroup"
 )
 
+//nolint:gochecknoglobals
+var logger = logging.For("manager")
+
+const (
+	janitorInterval   = time.Hour
+	retentionInterval = 10 * time.Minute
+	// cancelTimeout is how long cancelled uploads get to return after the
+	// drain timeout
+	cancelTimeout = 10 * time.Second
+)
+
 type Manager struct {
 	config        *config.Config
+	profile       string
+	metrics       *metrics.Profile
 	srcWatcher    *watcher.Watcher
 	localWatcher  *watcher.Watcher
 	uploader      *uploader.Uploader
 	reuploadQueue *reupload.ReuploadQueue
+	retryPolicy   *retrypolicy.Policy
+	postUpload    *postupload.Handler
+	connectivity  *connectivity.Monitor
+	// quiet is shared by every profile, as they contend for the same PC
+	quiet *quiet.Gate
+	// ninaAPI reports frames as N.I.N.A. saves them, nil unless enabled
+	ninaAPI *ninaapi.Client
+	// claims holds when each file was last handed to an upload by the API
+	// or the watcher, so the other does not upload it again
+	claims     map[string]time.Time
+	claimsLock sync.Mutex
+	// scanQueue holds the files found in the source directory at startup
+	scanQueue *priority.Queue
+	activity  *xsync.MapOf[string, directoryActivity]
+	hooks     *hooks.Runner
+	// nights tracks the frames uploaded of each night for the on-night-end
+	// hook
+	nights *xsync.MapOf[string, nightActivity]
+	// ctx is cancelled once the drain timeout passes, interrupting the
+	// uploads still in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stopping is cancelled when shutdown begins, no upload starts after it
+	stopping context.Context
+	stop     context.CancelFunc
+	// inflight counts running uploads, lock keeps it from growing once
+	// shutdown has begun
+	inflight sync.WaitGroup
+	lock     sync.Mutex
 }
 
-func NewManager(cfg *config.Config) (*Manager, error) {
+// NewManager creates the manager of one profile. Managers of different
+// profiles share the bandwidth limiter, the quiet gate and the catalog,
+// which may be nil.
+func NewManager(cfg *config.Config, profile string, limiter *bandwidth.Limiter, gate *quiet.Gate, catalog *catalog.Catalog, metrics *metrics.Profile) (*Manager, error) {
 	localWatcher, err := watcher.NewWatcher(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create local watcher: %w", err)
@@ -36,48 +96,192 @@ func NewManager(cfg *config.Config) (*Manager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create source watcher: %w", err)
 	}
-	uploader, err := uploader.NewUploader(cfg)
-	reuploadQueue := reupload.NewReuploadQueue(cfg, uploader)
+	uploader, err := uploader.NewUploader(cfg, limiter, gate, catalog.Profile(profile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create uploader: %w", err)
+	}
+	// Bounded like a probe, so an unreachable endpoint cannot hold up the
+	// start or a reload
+	checkCtx, cancelCheck := context.WithTimeout(context.Background(), cfg.Uploader.Connectivity.Timeout)
+	err = uploader.Check(checkCtx)
+	cancelCheck()
+	if err != nil {
+		// The link may just be down, uploads are retried later so this
+		// only needs reporting
+		logger.Error("S3 connectivity check failed", "error", err)
+	}
+	postUpload, err := postupload.NewHandler(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create post-upload handler: %w", err)
+	}
+	retryPolicy := retrypolicy.New(cfg.Uploader.Retry)
+	monitor := connectivity.NewMonitor(cfg.Uploader.Connectivity, uploader)
+	hookRunner := hooks.NewRunner(cfg.Uploader.Hooks, profile)
+	reuploadQueue := reupload.NewReuploadQueue(cfg, uploader, postUpload, hookRunner, retryPolicy, monitor, metrics)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopping, stop := context.WithCancel(ctx)
 
 	manager := &Manager{
 		config:        cfg,
+		profile:       profile,
+		metrics:       metrics,
 		srcWatcher:    watcher,
 		uploader:      uploader,
 		reuploadQueue: reuploadQueue,
+		retryPolicy:   retryPolicy,
+		postUpload:    postUpload,
+		connectivity:  monitor,
+		scanQueue:     priority.NewQueue(cfg.Uploader.Priority),
 		localWatcher:  localWatcher,
+		activity:      xsync.NewMapOf[string, directoryActivity](),
+		hooks:         hookRunner,
+		nights:        xsync.NewMapOf[string, nightActivity](),
+		ctx:           ctx,
+		cancel:        cancel,
+		stopping:      stopping,
+		stop:          stop,
+		quiet:         gate,
+		claims:        make(map[string]time.Time),
 	}
-
-	// TODO: walk the local directory and startup reupload jobs for each file
-	// TODO: walk the source directory and upload each file
-	foundFiles := findFiles(cfg.Uploader.Local.Directory, cfg.Uploader.Extensions)
-	for _, file := range foundFiles {
-		slog.Info("found file in local directory", "path", file)
-		go reuploadQueue.Add(file)
+	if cfg.Uploader.NINAAPI.Enabled {
+		manager.ninaAPI = ninaapi.NewClient(cfg.Uploader.NINAAPI, manager.ninaEvent)
 	}
-	foundFiles = findFiles(cfg.Uploader.Directory, cfg.Uploader.Extensions)
-	for _, file := range foundFiles {
-		slog.Info("found file in source directory", "path", file)
-		go manager.uploadCallback(file)
+
+	// The directory is watched from here on, so a manager whose directory
+	// cannot be watched is never started in place of a working one. Events
+	// wait for Start
+	watcher.SetUploadCallback(manager.fileWritten)
+	reuploadQueue.SetCallbacks(manager.preUpload, manager.markNight)
+	err = watcher.Add(cfg.Uploader.Directory)
+	if err != nil {
+		watcher.Stop()
+		localWatcher.Stop()
+		return nil, fmt.Errorf("failed to add directory to watcher: %w", err)
 	}
 
 	return manager, nil
 }
 
-func (u *Manager) Start() error {
-	u.srcWatcher.SetUploadCallback(u.uploadCallback)
-	err := u.srcWatcher.Add(u.config.Uploader.Directory)
+// scan queues the files left in the local and source directories, which
+// are uploaded once the manager starts.
+func (u *Manager) scan() {
+	removePartialCopies(u.config.Uploader.Local.Directory)
+
+	for _, file := range findFiles(u.config, u.config.Uploader.Local.Directory) {
+		if u.postUpload.Retained(file) {
+			continue
+		}
+		logger.Info("found file in local directory", "path", file, logging.File(u.config.Uploader, file))
+		u.reuploadQueue.Add(file)
+	}
+	for _, file := range findFiles(u.config, u.config.Uploader.Directory) {
+		if u.postUpload.Retained(file) {
+			logger.Debug("skipping uploaded file kept by post-upload action", "path", file, logging.File(u.config.Uploader, file))
+			continue
+		}
+		logger.Info("found file in source directory", "path", file, logging.File(u.config.Uploader, file))
+		u.scanQueue.Push(file)
+	}
+}
+
+// Start scans the directories for files left from before and starts
+// uploading. The scan happens here rather than in NewManager, so a manager
+// replacing another on reload only finds what the other left behind.
+func (u *Manager) Start() {
+	logger.Info("starting profile", "profile", u.profile, "directory", u.config.Uploader.Directory, "bucket", u.config.S3.Bucket)
+	err := u.postUpload.Reload()
 	if err != nil {
-		return fmt.Errorf("failed to add directory to watcher: %w", err)
+		logger.Warn("failed to reload retention ledger", "error", err)
 	}
+	u.scan()
 	go u.srcWatcher.Start()
-	return nil
+	go u.connectivity.Run()
+	if u.ninaAPI != nil {
+		go u.ninaAPI.Run()
+	}
+	u.inflight.Add(1)
+	go func() {
+		defer u.inflight.Done()
+		u.reuploadQueue.Run(u.ctx)
+	}()
+	go u.drainScan()
+	if u.config.Uploader.Quiet.FlagFile != "" {
+		go u.watchFlagFile()
+	}
+	if u.config.Uploader.CompleteMarker.Enabled {
+		go u.watchCompletion()
+	}
+	if u.hooks.Configured(hooks.OnNightEnd) {
+		go u.watchNights()
+	}
+	go u.runJanitor()
+	go u.runRetention()
+}
+
+// drainScan uploads the files found at startup one at a time in priority
+// order, so a backlog does not race for the uploader.
+func (u *Manager) drainScan() {
+	for {
+		path, ok := u.scanQueue.Pop(u.stopping.Done())
+		if !ok {
+			return
+		}
+		u.uploadCallback(path, nil)
+	}
 }
 
+// runJanitor periodically aborts stale incomplete multipart uploads.
+func (u *Manager) runJanitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		if u.connectivity.Online() {
+			err := u.uploader.AbortStaleUploads(u.ctx)
+			if err != nil {
+				logger.Warn("failed to clean up stale multipart uploads", "error", err)
+			}
+		}
+		select {
+		case <-u.stopping.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runRetention periodically enforces the retention limits on kept files.
+func (u *Manager) runRetention() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		u.postUpload.Sweep()
+		select {
+		case <-u.stopping.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops watching for files and waits up to the drain timeout for
+// uploads in flight to finish. Uploads still running after that are
+// cancelled, multipart uploads keep their progress to resume from. Files are
+// only ever removed once uploaded or completely copied to the local directory.
 func (u *Manager) Stop() error {
+	u.lock.Lock()
+	u.stop()
+	u.lock.Unlock()
+	defer u.cancel()
+	u.connectivity.Stop()
+	u.reuploadQueue.Stop()
+	if u.ninaAPI != nil {
+		u.ninaAPI.Stop()
+	}
+
 	errgroup := errgroup.Group{}
 	errgroup.Go(func() error {
-		slog.Debug("stopping source watcher")
-		defer slog.Debug("stopped source watcher")
+		logger.Debug("stopping source watcher")
+		defer logger.Debug("stopped source watcher")
 		err := u.srcWatcher.Stop()
 		if err != nil {
 			return fmt.Errorf("failed to stop source watcher: %w", err)
@@ -85,8 +289,8 @@ func (u *Manager) Stop() error {
 		return nil
 	})
 	errgroup.Go(func() error {
-		slog.Debug("stopping local watcher")
-		defer slog.Debug("stopped local watcher")
+		logger.Debug("stopping local watcher")
+		defer logger.Debug("stopped local watcher")
 		err := u.localWatcher.Stop()
 		if err != nil {
 			return fmt.Errorf("failed to stop local watcher: %w", err)
@@ -95,172 +299,255 @@ func (u *Manager) Stop() error {
 	})
 
 	errgroup.Go(func() error {
-		slog.Debug("stopping reupload queue")
-		defer slog.Debug("stopped reupload queue")
-		err := u.reuploadQueue.Stop()
-		if err != nil {
-			return fmt.Errorf("failed to stop reupload queue: %w", err)
-		}
-		return nil
+		logger.Debug("draining in-flight uploads", "timeout", u.config.Uploader.DrainTimeout)
+		defer logger.Debug("drained in-flight uploads")
+		return u.drain()
 	})
 	return errgroup.Wait()
 }
 
-func (u *Manager) uploadCallback(path string) {
-	slog.Info("uploading", "path", path)
-	err := retry.Do(
-		func() error { return u.uploader.Upload(path) },
-		retry.Attempts(3),
-		retry.DelayType(retry.BackOffDelay),
-		retry.Delay(time.Second),
-		retry.OnRetry(func(n uint, err error) {
-			slog.Warn("retrying upload", "attempt", n+1, "path", path, "error", err)
-		}),
-	)
-	if err != nil {
-		slog.Error("failed to upload after 3 attempts", "path", path)
+// begin registers an upload as in flight. It returns false once shutdown has
+// begun, the file is then left for the next start.
+func (u *Manager) begin() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.stopping.Err() != nil {
+		return false
+	}
+	u.inflight.Add(1)
+	return true
+}
 
-		// path is likely to be an absolute path, but it is not guaranteed to be
-		// therefore we should resolve the absolute path in all cases
-		path, err := filepath.Abs(path)
-		if err != nil {
-			slog.Error("failed to resolve absolute path", "path", path, "error", err)
-			return
+// drain waits for in-flight uploads, cancelling them once the drain timeout
+// has passed, or at once if it is negative.
+func (u *Manager) drain() error {
+	done := make(chan struct{})
+	go func() {
+		u.inflight.Wait()
+		close(done)
+	}()
+
+	if timeout := u.config.Uploader.DrainTimeout; timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+			return nil
+		case <-timer.C:
 		}
+		logger.Warn("drain timeout reached, cancelling in-flight uploads")
+	}
 
-		localPath, err := filepath.Abs(u.config.Uploader.Local.Directory)
-		if err != nil {
-			slog.Error("failed to resolve absolute path", "path", path, "error", err)
-			return
-		}
+	u.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(cancelTimeout):
+		return errors.New("in-flight uploads did not stop after being cancelled")
+	}
+}
 
-		err = os.MkdirAll(localPath, fs.FileMode(0755))
-		if err != nil {
-			slog.Error("failed to create local directory", "path", path, "error", err)
-			return
-		}
+// sleep waits for d, returning early once in-flight uploads are cancelled.
+func (u *Manager) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-u.ctx.Done():
+	case <-timer.C:
+	}
+}
 
-		uploaderDirAbsPath, err := filepath.Abs(u.config.Uploader.Directory)
-		if err != nil {
-			slog.Error("failed to resolve absolute path", "path", path, "error", err)
-			return
-		}
+// uploadCallback uploads the group of the frame at path, storing metadata
+// with the frame.
+func (u *Manager) uploadCallback(path string, metadata map[string]string) {
+	log := logger.With(logging.File(u.config.Uploader, path))
+	if !u.begin() {
+		log.Debug("shutting down, leaving file for the next start", "path", path)
+		return
+	}
+	defer u.inflight.Done()
 
-		// we need to remove the prefix of u.config.Uploader.Directory from the path
-		// to be left with only the relative path from the configured local directory
-		path, err = filepath.Rel(uploaderDirAbsPath, path)
-		if err != nil {
-			slog.Error("failed to resolve relative path", "path", path, "error", err)
+	group := sidecar.Group(path, u.config.Uploader.Sidecars)
+	// A vetoed frame takes only its own sidecars, the shared ones stay for
+	// the other frames of the directory
+	if !u.preUpload(path, sidecar.Owned(group), u.config.Uploader.Directory) {
+		return
+	}
+	u.markActivity(path)
+	log.Info("uploading", "path", path, "sidecars", len(group)-1)
+	size := sidecar.Size(group)
+	firstAttempt := time.Now()
+	attempts := u.retryPolicy.ImmediateAttempts()
+	var result uploader.Result
+	err := retry.Do(
+		func() error {
+			// Attempts only count while the endpoint is reachable, until
+			// then the group waits here in the source directory
+			err := u.connectivity.Do(func() error {
+				var err error
+				result, err = u.uploader.UploadGroup(u.ctx, group, metadata)
+				return err
+			})
+			if err != nil && !errors.Is(err, connectivity.ErrStopped) && u.ctx.Err() == nil {
+				u.metrics.Failed()
+			}
+			return err
+		},
+		retry.Attempts(attempts),
+		retry.DelayType(func(n uint, _ error, _ *retry.Config) time.Duration {
+			return u.retryPolicy.Delay(n + 1)
+		}),
+		retry.RetryIf(func(err error) bool {
+			return !uploader.IsPermanent(err) && !errors.Is(err, connectivity.ErrStopped) && u.stopping.Err() == nil
+		}),
+		retry.Context(u.stopping),
+		retry.LastErrorOnly(true),
+		retry.OnRetry(func(n uint, err error) {
+			log.Warn("retrying upload", "attempt", n+1, "path", path, "error", err)
+		}),
+	)
+	if err != nil && u.stopping.Err() != nil {
+		// Left in place to be found again on the next start
+		log.Info("stopped before upload", "path", path, "error", err)
+		return
+	}
+	if err != nil {
+		if uploader.IsPermanent(err) || u.retryPolicy.Exhausted(attempts, firstAttempt) {
+			log.Error("giving up on upload", "path", path, "permanent", uploader.IsPermanent(err), "error", err)
+			u.metrics.DeadLettered()
+			reason := err.Error()
+			err = deadletter.Send(u.config.Uploader.DeadLetter.Directory, sidecar.Owned(group), u.config.Uploader.Directory, deadletter.Report{
+				Path:         path,
+				Error:        reason,
+				Permanent:    uploader.IsPermanent(err),
+				Attempts:     attempts,
+				FirstFailure: firstAttempt,
+			})
+			if err != nil {
+				log.Error("failed to move file to dead-letter directory", "path", path, "error", err)
+			}
+			u.uploader.MarkDeadLettered(group, reason)
+			u.runHook(hooks.OnFailure, hooks.Env{Path: path, Size: size, Error: reason})
 			return
 		}
-
-		localPath = filepath.Join(localPath, path)
-		slog.Debug("want to write to local directory", "path", path, "localPath", localPath)
-
-		// Create dir tree in local directory
-		os.MkdirAll(filepath.Dir(localPath), fs.FileMode(0755))
-
-		srcFile := filepath.Join(u.config.Uploader.Directory, path)
-
-		// copy file to local directory
-		err = copyFile(srcFile, localPath)
-		if err != nil {
-			slog.Error("failed to copy file to local directory", "path", path, "error", err)
-			return
+		log.Error("failed to upload, moving to local directory", "attempts", attempts, "path", path, "error", err)
+		reason := err.Error()
+
+		// The frame is moved with its own sidecars so the reupload job can
+		// find them next to it again, shared sidecars stay for the next frame
+		owned := sidecar.Owned(group)
+		localPaths := make([]string, 0, len(owned))
+		for i, file := range owned {
+			if i > 0 {
+				if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+			}
+			localPath, err := u.copyToLocal(file)
+			if err != nil {
+				return
+			}
+			localPaths = append(localPaths, localPath)
 		}
-		slog.Info("added to local directory", "path", path)
 
 		if u.config.Uploader.Delay > 0 {
-			slog.Debug("delaying for", "delay", u.config.Uploader.Delay)
-			time.Sleep(u.config.Uploader.Delay)
-			slog.Debug("delay complete")
+			log.Debug("delaying for", "delay", u.config.Uploader.Delay)
+			u.sleep(u.config.Uploader.Delay)
+			log.Debug("delay complete")
 		}
 
-		err = os.Remove(srcFile)
-		if err != nil {
-			slog.Error("failed to remove file from source directory", "path", path, "error", err)
-			return
+		for _, file := range owned {
+			err = os.Remove(file)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Error("failed to remove file from source directory", "path", file, "error", err)
+				return
+			}
 		}
 
+		env := hooks.Env{Path: localPaths[0], Size: size, Error: reason}
+		if u.hooks.Configured(hooks.OnSpill) {
+			env.SHA256 = u.checksum(localPaths[0])
+		}
+		u.runHook(hooks.OnSpill, env)
 		// add an infinite retry to continue trying to upload
-		u.reuploadQueue.Add(localPath)
+		u.reuploadQueue.Add(localPaths[0])
 		return
 	}
-	slog.Info("uploaded", "path", path)
+	log.Info("uploaded", "path", path)
+	u.metrics.Uploaded(len(group), size)
+	u.markUploaded(path, result)
+	u.markNight(result)
+	// Before the post-upload action, so the hook can still read the file
+	u.runHook(hooks.PostUpload, hooks.Env{Path: path, Key: result.Key, Bucket: result.Bucket, Size: result.Size, SHA256: result.SHA256})
 
 	if u.config.Uploader.Delay > 0 {
-		slog.Debug("delaying for", "delay", u.config.Uploader.Delay)
-		time.Sleep(u.config.Uploader.Delay)
-		slog.Debug("delay complete")
+		log.Debug("delaying for", "delay", u.config.Uploader.Delay)
+		u.sleep(u.config.Uploader.Delay)
+		log.Debug("delay complete")
 	}
 
-	// File uploaded successfully, remove it
-	err = os.Remove(path)
-	if err != nil {
-		slog.Error("failed to remove file", "path", path, "error", err)
-	}
-	slog.Info("removed local copy of file", "path", path)
+	u.postUpload.Apply(sidecar.Owned(group), u.config.Uploader.Directory, result.PostUpload)
 }
 
-func copyFile(src, dst string) error {
-	sourceFileStat, err := os.Stat(src)
+// copyToLocal copies a file from the source directory into the same relative
+// location in the local directory and returns the new path.
+func (u *Manager) copyToLocal(path string) (string, error) {
+	log := logger.With(logging.File(u.config.Uploader, path))
+	// path is likely to be an absolute path, but it is not guaranteed to be
+	// therefore we should resolve the absolute path in all cases
+	path, err := filepath.Abs(path)
 	if err != nil {
-		return err
+		log.Error("failed to resolve absolute path", "path", path, "error", err)
+		return "", err
 	}
 
-	if !sourceFileStat.Mode().IsRegular() {
-		return fmt.Errorf("%s is not a regular file", src)
+	localPath, err := filepath.Abs(u.config.Uploader.Local.Directory)
+	if err != nil {
+		log.Error("failed to resolve absolute path", "path", path, "error", err)
+		return "", err
 	}
 
-	source, err := os.Open(src)
+	err = os.MkdirAll(localPath, fs.FileMode(0755))
 	if err != nil {
-		return err
+		log.Error("failed to create local directory", "path", path, "error", err)
+		return "", err
 	}
-	defer source.Close()
 
-	// Check if the destination file exists
-	// and if it does, remove it
-	if _, err := os.Stat(dst); errors.Is(err, os.ErrNotExist) {
-		err = os.Remove(dst)
-		if err != nil {
-			slog.Error("failed to remove existing file", "path", dst, "error", err)
-		}
+	uploaderDirAbsPath, err := filepath.Abs(u.config.Uploader.Directory)
+	if err != nil {
+		log.Error("failed to resolve absolute path", "path", path, "error", err)
+		return "", err
 	}
 
-	destination, err := os.Create(dst)
+	// we need to remove the prefix of u.config.Uploader.Directory from the path
+	// to be left with only the relative path from the configured local directory
+	path, err = filepath.Rel(uploaderDirAbsPath, path)
 	if err != nil {
-		return err
+		log.Error("failed to resolve relative path", "path", path, "error", err)
+		return "", err
 	}
-	defer destination.Close()
 
-	buf := make([]byte, 1024)
-	for {
-		n, err := source.Read(buf)
-		if err != nil && err != io.EOF {
-			removeErr := os.Remove(dst)
-			if removeErr != nil {
-				slog.Error("failed to cleanup failed copy", "path", dst, "error", removeErr)
-			}
-			return err
-		}
-		if n == 0 {
-			break
-		}
+	localPath = filepath.Join(localPath, path)
+	log.Debug("want to write to local directory", "path", path, "localPath", localPath)
 
-		if _, err := destination.Write(buf[:n]); err != nil {
-			removeErr := os.Remove(dst)
-			if removeErr != nil {
-				slog.Error("failed to cleanup failed copy", "path", dst, "error", removeErr)
-			}
-			return err
-		}
+	// Create dir tree in local directory
+	os.MkdirAll(filepath.Dir(localPath), fs.FileMode(0755))
+
+	srcFile := filepath.Join(u.config.Uploader.Directory, path)
+
+	// copy file to local directory
+	err = fsutil.CopyFile(srcFile, localPath)
+	if err != nil {
+		log.Error("failed to copy file to local directory", "path", path, "error", err)
+		return "", err
 	}
-	return nil
+	log.Info("added to local directory", "path", path)
+	return localPath, nil
 }
 
-func findFiles(path string, extensions []string) []string {
+func findFiles(cfg *config.Config, root string) []string {
 	var files []string
-	err := filepath.Walk(path, func(path string, info fs.FileInfo, err error) error {
+	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
 		if err != nil && !os.IsPermission(err) {
 			return err
 		} else if os.IsPermission(err) {
@@ -271,13 +558,37 @@ func findFiles(path string, extensions []string) []string {
 				return filepath.SkipDir
 			}
 		}
-		if !info.IsDir() && slices.Contains(extensions, filepath.Ext(path)) {
+		if !info.IsDir() && watcher.Watched(cfg, root, path) {
 			files = append(files, path)
 		}
 		return nil
 	})
 	if err != nil {
-		slog.Error("failed to walk directory", "path", path, "error", err)
+		logger.Error("failed to walk directory", "path", root, "error", err)
 	}
 	return files
 }
+
+// removePartialCopies removes copies into the local directory that were
+// interrupted before they completed.
+func removePartialCopies(dir string) {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), fsutil.PartialSuffix) {
+			logger.Info("removing interrupted copy", "path", path)
+			err = os.Remove(path)
+			if err != nil {
+				logger.Error("failed to remove interrupted copy", "path", path, "error", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("failed to walk directory", "path", dir, "error", err)
+	}
+}
@@ -0,0 +1,128 @@
+package manager_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/manager"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/metrics"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/s3test"
+	"github.com/spf13/cobra"
+)
+
+// loadConfig loads the YAML config text with its defaults, uploading to
+// bucket on server.
+func loadConfig(t *testing.T, server *s3test.Server, bucket, text string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	config.RegisterFlags(cmd)
+	if err := cmd.ParseFlags([]string{"--config", path}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.S3 = server.S3(bucket)
+	return cfg
+}
+
+func TestPreUploadVeto(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with sh")
+	}
+	server := s3test.New(t, "bucket")
+	root := t.TempDir()
+	watched, dead := filepath.Join(root, "watched"), filepath.Join(root, "dead")
+	seen := filepath.Join(root, "sha256")
+	cfg := loadConfig(t, server, "bucket", `
+uploader:
+  directory: `+watched+`
+  local:
+    directory: `+filepath.Join(root, "local")+`
+  state-directory: `+filepath.Join(root, "state")+`
+  dead-letter:
+    directory: `+dead+`
+  extensions: [.fits]
+  post-upload:
+    action: keep
+  sidecars:
+    - extensions: [.json]
+    - extensions: [.csv]
+      match: directory
+  hooks:
+    pre-upload:
+      command: [sh, -c, 'case "$HOOK_PATH" in *a.fits) echo "$HOOK_SHA256" > "$0"; exit 1;; esac', `+seen+`]
+      reject: veto
+catalog:
+  disabled: true
+`)
+
+	// a.fits is the oldest, so it is vetoed before b.fits is uploaded
+	night := filepath.Join(watched, "night")
+	if err := os.MkdirAll(night, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"session.csv", "a.fits", "a.json", "b.fits"} {
+		path := filepath.Join(night, name)
+		if err := os.WriteFile(path, []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := manager.NewManager(cfg, "default", nil, nil, nil, metrics.NewRegistry().Profile("default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, ok := server.Object("bucket", "night/b.fits"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("b.fits was not uploaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.fits", "a.json"} {
+		if _, err := os.Stat(filepath.Join(dead, "night", name)); err != nil {
+			t.Errorf("%s was not dead-lettered: %v", name, err)
+		}
+	}
+	// The shared sidecar stays for the other frame of the directory
+	if _, err := os.Stat(filepath.Join(dead, "night", "session.csv")); err == nil {
+		t.Error("shared sidecar was dead-lettered with the vetoed frame")
+	}
+	if _, ok := server.Object("bucket", "night/session.csv"); !ok {
+		t.Error("shared sidecar was not uploaded with the other frame")
+	}
+
+	sum := sha256.Sum256([]byte("a.fits"))
+	got, err := os.ReadFile(seen)
+	if err != nil || strings.TrimSpace(string(got)) != hex.EncodeToString(sum[:]) {
+		t.Errorf("pre-upload hook saw checksum %q: %v", got, err)
+	}
+}
@@ -0,0 +1,59 @@
+package manager
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/ninaapi"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/watcher"
+)
+
+// claimWindow is how long a file one source started uploading is ignored
+// when the other reports it. N.I.N.A. reports a frame saved about when the
+// watcher sees its last write.
+const claimWindow = 10 * time.Minute
+
+// imageSaved uploads the frame N.I.N.A. reported saved, along with what
+// N.I.N.A. measured in it.
+func (u *Manager) imageSaved(event ninaapi.Event) {
+	path := filepath.Clean(event.Path)
+	rel, err := filepath.Rel(u.config.Uploader.Directory, path)
+	if err != nil || !filepath.IsLocal(rel) || !watcher.Watched(u.config, u.config.Uploader.Directory, path) {
+		logger.Debug("ignoring image N.I.N.A. saved outside the watched files", "path", path)
+		return
+	}
+	if !u.claim(path) {
+		logger.Debug("image N.I.N.A. saved is already being uploaded", "path", path, logging.File(u.config.Uploader, path))
+		return
+	}
+	u.uploadCallback(path, event.Metadata())
+}
+
+// fileWritten uploads a file the watcher saw written, unless N.I.N.A.
+// already reported it.
+func (u *Manager) fileWritten(path string) {
+	if u.ninaAPI != nil && !u.claim(path) {
+		logger.Debug("file written is already being uploaded from the N.I.N.A. API", "path", path, logging.File(u.config.Uploader, path))
+		return
+	}
+	u.uploadCallback(path, nil)
+}
+
+// claim reports whether path is not yet being uploaded from either the API
+// or the watcher, marking it as such.
+func (u *Manager) claim(path string) bool {
+	now := time.Now()
+	u.claimsLock.Lock()
+	defer u.claimsLock.Unlock()
+	for claimed, at := range u.claims {
+		if now.Sub(at) > claimWindow {
+			delete(u.claims, claimed)
+		}
+	}
+	if _, ok := u.claims[path]; ok {
+		return false
+	}
+	u.claims[path] = now
+	return true
+}
@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/ninaapi"
+)
+
+// flagFileInterval is how often the watched directory is checked for the
+// quiet flag file.
+const flagFileInterval = time.Second
+
+// ninaEvent opens a quiet window for the configured events and uploads the
+// frames N.I.N.A. reports saved.
+func (u *Manager) ninaEvent(event ninaapi.Event) {
+	quiet := u.config.Uploader.Quiet
+	if slices.Contains(quiet.NINAEvents, event.Name) {
+		u.quiet.Hold("nina-api/"+u.profile, time.Now().Add(quiet.Timeout))
+	}
+	if event.Name != ninaapi.EventImageSave {
+		return
+	}
+	if event.Path == "" {
+		logger.Debug("N.I.N.A. API did not report the path of a saved image, leaving it to the watcher")
+		return
+	}
+	go u.imageSaved(event)
+}
+
+// watchFlagFile holds a quiet window open while the flag file in the watched
+// directory is fresh. A flag file left behind stops counting once it is
+// older than the timeout.
+func (u *Manager) watchFlagFile() {
+	source := "flag-file/" + u.profile
+	defer u.quiet.Release(source)
+	path := filepath.Join(u.config.Uploader.Directory, u.config.Uploader.Quiet.FlagFile)
+	ticker := time.NewTicker(flagFileInterval)
+	defer ticker.Stop()
+	for {
+		info, err := os.Stat(path)
+		if err == nil {
+			u.quiet.Hold(source, info.ModTime().Add(u.config.Uploader.Quiet.Timeout))
+		} else {
+			u.quiet.Release(source)
+		}
+		select {
+		case <-u.stopping.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
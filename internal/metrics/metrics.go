@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry collects upload metrics for each profile and serves them in the
+// Prometheus text format. Counters live as long as the registry, so they
+// carry on across config reloads.
+type Registry struct {
+	lock     sync.Mutex
+	profiles map[string]*Profile
+}
+
+// Profile holds the counters of one profile.
+type Profile struct {
+	uploadedFiles  atomic.Uint64
+	uploadedBytes  atomic.Uint64
+	failedAttempts atomic.Uint64
+	deadLettered   atomic.Uint64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{profiles: make(map[string]*Profile)}
+}
+
+// Profile returns the counters of the named profile, creating them on first use.
+func (r *Registry) Profile(name string) *Profile {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	profile, ok := r.profiles[name]
+	if !ok {
+		profile = &Profile{}
+		r.profiles[name] = profile
+	}
+	return profile
+}
+
+// Uploaded counts a successfully uploaded group of files.
+func (p *Profile) Uploaded(files int, bytes int64) {
+	p.uploadedFiles.Add(uint64(files))
+	p.uploadedBytes.Add(uint64(bytes))
+}
+
+// Failed counts a failed upload attempt.
+func (p *Profile) Failed() {
+	p.failedAttempts.Add(1)
+}
+
+// DeadLettered counts a file given up on.
+func (p *Profile) DeadLettered() {
+	p.deadLettered.Add(1)
+}
+
+type metric struct {
+	name  string
+	help  string
+	value func(*Profile) uint64
+}
+
+//nolint:gochecknoglobals
+var metricsList = []metric{
+	{"nina_s3_uploader_uploaded_files_total", "Files uploaded, including sidecars.", func(p *Profile) uint64 { return p.uploadedFiles.Load() }},
+	{"nina_s3_uploader_uploaded_bytes_total", "Bytes of uploaded files.", func(p *Profile) uint64 { return p.uploadedBytes.Load() }},
+	{"nina_s3_uploader_failed_attempts_total", "Failed upload attempts.", func(p *Profile) uint64 { return p.failedAttempts.Load() }},
+	{"nina_s3_uploader_dead_lettered_total", "Files moved to the dead-letter directory.", func(p *Profile) uint64 { return p.deadLettered.Load() }},
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.profiles))
+	for name := range r.profiles {
+		names = append(names, name)
+	}
+	profiles := make(map[string]*Profile, len(r.profiles))
+	for name, profile := range r.profiles {
+		profiles[name] = profile
+	}
+	r.lock.Unlock()
+	slices.Sort(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metricsList {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{profile=%q} %d\n", m.name, name, m.value(profiles[name]))
+		}
+	}
+}
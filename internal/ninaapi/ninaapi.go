@@ -0,0 +1,257 @@
+package ninaapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/gorilla/websocket"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("ninaapi")
+
+const (
+	// VersionPath answers with the version of the Advanced API plugin
+	VersionPath = "/v2/api/version"
+	// SocketPath streams the events of N.I.N.A.
+	SocketPath = "/v2/socket"
+
+	// EventImageSave is sent once N.I.N.A. finished saving an image
+	EventImageSave = "IMAGE-SAVE"
+	requestTimeout = 10 * time.Second
+
+	// MetadataPrefix starts the object metadata keys of the values measured
+	// by N.I.N.A.
+	MetadataPrefix   = "nina-"
+	MetadataHFR      = MetadataPrefix + "hfr"
+	MetadataStars    = MetadataPrefix + "stars"
+	MetadataTarget   = MetadataPrefix + "target"
+	maxMetadataValue = 256
+)
+
+// ErrUnexpectedResponse is returned when the API answers with something other
+// than a successful response.
+var ErrUnexpectedResponse = errors.New("Unexpected response from the N.I.N.A. Advanced API")
+
+// Event is an event of N.I.N.A. The other fields are only set for
+// EventImageSave, and Path only if the plugin reports it.
+type Event struct {
+	Name string
+	Path string
+	// HFR is the half flux radius of the stars in pixels
+	HFR    float64
+	Stars  int
+	Target string
+	Filter string
+}
+
+// Metadata returns the values measured by N.I.N.A. as object metadata.
+func (e Event) Metadata() map[string]string {
+	metadata := map[string]string{
+		MetadataHFR:   strconv.FormatFloat(e.HFR, 'f', -1, 64),
+		MetadataStars: strconv.Itoa(e.Stars),
+	}
+	if target := sanitize(e.Target); target != "" {
+		metadata[MetadataTarget] = target
+	}
+	return metadata
+}
+
+// sanitize keeps a value within what S3 accepts in a metadata header.
+func sanitize(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, value)
+	value = strings.TrimSpace(value)
+	if len(value) > maxMetadataValue {
+		value = value[:maxMetadataValue]
+	}
+	return value
+}
+
+// response is the envelope of every REST response and websocket message.
+type response struct {
+	Response json.RawMessage `json:"Response"`
+	Error    string          `json:"Error"`
+	Success  bool            `json:"Success"`
+	Type     string          `json:"Type"`
+}
+
+// event is the Response of an event, the statistics are only sent with
+// IMAGE-SAVE.
+type event struct {
+	Event           string `json:"Event"`
+	ImageStatistics struct {
+		Filename   string  `json:"Filename"`
+		HFR        float64 `json:"HFR"`
+		Stars      int     `json:"Stars"`
+		Filter     string  `json:"Filter"`
+		TargetName string  `json:"TargetName"`
+	} `json:"ImageStatistics"`
+}
+
+// EventCallback is called with every event N.I.N.A. sends.
+type EventCallback func(event Event)
+
+// Client listens to the events of the N.I.N.A. Advanced API.
+type Client struct {
+	config    config.NINAAPI
+	callback  EventCallback
+	http      *http.Client
+	done      chan struct{}
+	connected atomic.Bool
+}
+
+func NewClient(cfg config.NINAAPI, callback EventCallback) *Client {
+	return &Client{
+		config:   cfg,
+		callback: callback,
+		http:     &http.Client{Timeout: requestTimeout},
+		done:     make(chan struct{}),
+	}
+}
+
+// Connected reports whether the websocket is connected, events are only
+// received while it is.
+func (c *Client) Connected() bool {
+	return c.connected.Load()
+}
+
+// Run listens for events until Stop is called, reconnecting after the
+// reconnect interval whenever the API cannot be reached.
+func (c *Client) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.done
+		cancel()
+	}()
+
+	address := c.address()
+	for {
+		err := c.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("N.I.N.A. API unreachable, relying on the watcher", "address", address, "retry-in", c.config.ReconnectInterval, "error", err)
+		timer := time.NewTimer(c.config.ReconnectInterval)
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop ends Run, closing the websocket.
+func (c *Client) Stop() {
+	close(c.done)
+}
+
+func (c *Client) address() string {
+	return net.JoinHostPort(c.config.Host, strconv.Itoa(c.config.Port))
+}
+
+// listen connects to the websocket and handles its messages until it closes.
+func (c *Client) listen(ctx context.Context) error {
+	version, err := c.version(ctx)
+	if err != nil {
+		return err
+	}
+
+	socket := url.URL{Scheme: "ws", Host: c.address(), Path: SocketPath}
+	dialCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	conn, _, err := websocket.DefaultDialer.DialContext(dialCtx, socket.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to websocket: %w", err)
+	}
+	defer conn.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
+	c.connected.Store(true)
+	defer c.connected.Store(false)
+	logger.Info("connected to N.I.N.A. API", "address", c.address(), "version", version)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("websocket closed: %w", err)
+		}
+		event, ok := parseEvent(data)
+		if !ok {
+			continue
+		}
+		logger.Debug("N.I.N.A. event", "event", event.Name, "path", event.Path)
+		c.callback(event)
+	}
+}
+
+// version asks the REST API for its version, which tells whether the plugin
+// is there at all before the websocket is dialed.
+func (c *Client) version(ctx context.Context) (string, error) {
+	endpoint := url.URL{Scheme: "http", Host: c.address(), Path: VersionPath}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query version: %w", err)
+	}
+	defer resp.Body.Close()
+	var body response
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil || resp.StatusCode != http.StatusOK || !body.Success {
+		return "", fmt.Errorf("%w: %s %s", ErrUnexpectedResponse, resp.Status, body.Error)
+	}
+	var version string
+	if err := json.Unmarshal(body.Response, &version); err != nil {
+		return string(body.Response), nil
+	}
+	return version, nil
+}
+
+// parseEvent returns the event a websocket message reports, other
+// messages are skipped.
+func parseEvent(data []byte) (Event, bool) {
+	var message response
+	if err := json.Unmarshal(data, &message); err != nil || !message.Success {
+		return Event{}, false
+	}
+	var body event
+	if err := json.Unmarshal(message.Response, &body); err != nil || body.Event == "" {
+		return Event{}, false
+	}
+	stats := body.ImageStatistics
+	return Event{
+		Name:   body.Event,
+		Path:   stats.Filename,
+		HFR:    stats.HFR,
+		Stars:  stats.Stars,
+		Target: stats.TargetName,
+		Filter: stats.Filter,
+	}, true
+}
@@ -0,0 +1,100 @@
+package ninaapi_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/ninaapi"
+	"github.com/gorilla/websocket"
+)
+
+// mockAPI serves the version endpoint and sends messages over the websocket
+// to each client that connects, while it is up.
+func mockAPI(t *testing.T, up *atomic.Bool, messages ...string) config.NINAAPI {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc(ninaapi.VersionPath, func(w http.ResponseWriter, _ *http.Request) {
+		if !up.Load() {
+			http.NotFound(w, nil)
+			return
+		}
+		w.Write([]byte(`{"Response":"2.2.0.0","Error":"","StatusCode":200,"Success":true,"Type":"API"}`))
+	})
+	upgrader := websocket.Upgrader{}
+	mux.HandleFunc(ninaapi.SocketPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, message := range messages {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+				return
+			}
+		}
+		// Held open like N.I.N.A. does until the client goes away
+		conn.ReadMessage()
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+	return config.NINAAPI{Enabled: true, Host: host, Port: portNumber, ReconnectInterval: 10 * time.Millisecond}
+}
+
+func TestImageSaveEvents(t *testing.T) {
+	t.Parallel()
+	var up atomic.Bool
+	cfg := mockAPI(t, &up,
+		`{"Response":{"Event":"FILTERWHEEL-CHANGED"},"Success":true,"Type":"Socket"}`,
+		`{"Response":{"Event":"IMAGE-SAVE","ImageStatistics":{"HFR":2.1}},"Success":true,"Type":"Socket"}`,
+		`{"Response":{"Event":"IMAGE-SAVE","ImageStatistics":{"Filename":"C:\\Astro\\M31\\LIGHT\\M31_0001.fits","HFR":2.35,"Stars":412,"Filter":"Ha","TargetName":"M31"}},"Success":true,"Type":"Socket"}`,
+	)
+
+	events := make(chan ninaapi.Event, 3)
+	client := ninaapi.NewClient(cfg, func(event ninaapi.Event) {
+		if event.Name == ninaapi.EventImageSave && event.Path != "" {
+			events <- event
+		}
+	})
+	go client.Run()
+	defer client.Stop()
+
+	// The plugin is not answering at first, so the client has to reconnect
+	time.Sleep(50 * time.Millisecond)
+	if client.Connected() {
+		t.Fatal("client connected while the API was down")
+	}
+	up.Store(true)
+
+	select {
+	case event := <-events:
+		if event.Path != `C:\Astro\M31\LIGHT\M31_0001.fits` || event.HFR != 2.35 || event.Stars != 412 || event.Target != "M31" || event.Filter != "Ha" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		metadata := event.Metadata()
+		if metadata[ninaapi.MetadataHFR] != "2.35" || metadata[ninaapi.MetadataStars] != "412" || metadata[ninaapi.MetadataTarget] != "M31" {
+			t.Fatalf("unexpected metadata %v", metadata)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	if !client.Connected() {
+		t.Fatal("client not connected after receiving an event")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected second event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,146 @@
+package postupload
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	ledgerFile = "retained.jsonl"
+	// legacyLedgerFile is the ledger of earlier versions, a single JSON
+	// object that was rewritten on every change
+	legacyLedgerFile = "retained.json"
+)
+
+type ledgerEntry struct {
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded-at"`
+}
+
+// ledgerRecord is one line of the ledger.
+type ledgerRecord struct {
+	Path string `json:"path"`
+	ledgerEntry
+}
+
+// ledger records uploaded files that are kept locally, so restarts do not
+// upload them again and the retention sweeper knows what it may delete.
+// Files are appended to it as they are kept, and it is compacted to the
+// files still kept whenever the sweeper runs.
+type ledger struct {
+	path    string
+	entries map[string]ledgerEntry
+	lock    sync.Mutex
+}
+
+func loadLedger(stateDir string) (*ledger, error) {
+	l := &ledger{
+		path:    filepath.Join(stateDir, ledgerFile),
+		entries: map[string]ledgerEntry{},
+	}
+	data, err := os.ReadFile(filepath.Join(stateDir, legacyLedgerFile))
+	if err == nil {
+		err = json.Unmarshal(data, &l.entries)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal retention ledger: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read retention ledger: %w", err)
+	}
+
+	data, err = os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read retention ledger: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record ledgerRecord
+		// A line torn by a crash is the last one, and only loses that file
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		l.entries[record.Path] = record.ledgerEntry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read retention ledger: %w", err)
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		// Lines appended after a torn one would be joined to it
+		return l, l.save()
+	}
+	return l, nil
+}
+
+func (l *ledger) add(path string, size int64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry := ledgerEntry{Size: size, UploadedAt: time.Now()}
+	data, err := json.Marshal(ledgerRecord{Path: path, ledgerEntry: entry})
+	if err != nil {
+		return fmt.Errorf("failed to marshal retention ledger: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(l.path), 0o700)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	l.entries[path] = entry
+	return nil
+}
+
+func (l *ledger) contains(path string, size int64) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry, ok := l.entries[path]
+	return ok && entry.Size == size
+}
+
+// save compacts the ledger to its entries, replacing it atomically. The
+// lock must be held.
+func (l *ledger) save() error {
+	var data []byte
+	for path, entry := range l.entries {
+		line, err := json.Marshal(ledgerRecord{Path: path, ledgerEntry: entry})
+		if err != nil {
+			return fmt.Errorf("failed to marshal retention ledger: %w", err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	err := os.MkdirAll(filepath.Dir(l.path), 0o700)
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, l.path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(filepath.Dir(l.path), legacyLedgerFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
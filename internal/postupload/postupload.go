@@ -0,0 +1,173 @@
+package postupload
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fsutil"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("postupload")
+
+// Handler applies the configured post-upload action to uploaded files and
+// enforces the retention limits on the files it keeps.
+type Handler struct {
+	config *config.Config
+	ledger *ledger
+}
+
+func NewHandler(cfg *config.Config) (*Handler, error) {
+	ledger, err := loadLedger(cfg.Uploader.StateDirectory)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{
+		config: cfg,
+		ledger: ledger,
+	}, nil
+}
+
+// Reload reads the ledger again, picking up the files another handler of the
+// same state directory kept since this one was created.
+func (h *Handler) Reload() error {
+	ledger, err := loadLedger(h.config.Uploader.StateDirectory)
+	if err != nil {
+		return err
+	}
+	h.ledger = ledger
+	return nil
+}
+
+// Apply runs the post-upload action on a group of uploaded files, the
+// configured one if action is empty. root is the directory the files live
+// under, their path relative to it is kept when moving them.
+func (h *Handler) Apply(paths []string, root string, action config.PostUploadAction) {
+	action = cmp.Or(action, h.config.Uploader.PostUpload.Action)
+	for _, path := range paths {
+		log := logger.With(logging.File(h.config.Uploader, path))
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			log.Error("failed to stat uploaded file", "path", path, "error", err)
+			continue
+		}
+
+		switch action {
+		case config.PostUploadDelete:
+			err = os.Remove(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Error("failed to remove file", "path", path, "error", err)
+				continue
+			}
+			log.Info("removed local copy of file", "path", path)
+		case config.PostUploadMove:
+			dst, err := h.move(path, root)
+			if err != nil {
+				log.Error("failed to move uploaded file", "path", path, "error", err)
+				continue
+			}
+			h.retain(dst, info.Size())
+			log.Info("moved uploaded file", "path", path, "destination", dst)
+		case config.PostUploadKeep:
+			h.retain(path, info.Size())
+			log.Debug("keeping uploaded file", "path", path)
+		}
+	}
+}
+
+// Retained reports whether path is an uploaded file being kept locally.
+func (h *Handler) Retained(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	return h.ledger.contains(abs, info.Size())
+}
+
+// Sweep deletes kept files older than the maximum age, then the oldest kept
+// files until their total size is within the quota.
+func (h *Handler) Sweep() {
+	retention := h.config.Uploader.PostUpload.Retention
+	if retention.MaxAge == 0 && retention.MaxSize == 0 {
+		return
+	}
+
+	h.ledger.lock.Lock()
+	defer h.ledger.lock.Unlock()
+
+	type item struct {
+		path  string
+		entry ledgerEntry
+	}
+	items := make([]item, 0, len(h.ledger.entries))
+	var total int64
+	for path, entry := range h.ledger.entries {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			// Removed by hand, nothing left to track
+			delete(h.ledger.entries, path)
+			continue
+		}
+		items = append(items, item{path: path, entry: entry})
+		total += entry.Size
+	}
+	slices.SortFunc(items, func(a, b item) int { return a.entry.UploadedAt.Compare(b.entry.UploadedAt) })
+
+	for _, it := range items {
+		expired := retention.MaxAge > 0 && time.Since(it.entry.UploadedAt) > retention.MaxAge
+		overQuota := retention.MaxSize > 0 && total > int64(retention.MaxSize)
+		if !expired && !overQuota {
+			break
+		}
+		err := os.Remove(it.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("failed to remove retained file", "path", it.path, "error", err)
+			continue
+		}
+		logger.Info("removed retained file", "path", it.path, "expired", expired, "over-quota", overQuota)
+		delete(h.ledger.entries, it.path)
+		total -= it.entry.Size
+	}
+
+	err := h.ledger.save()
+	if err != nil {
+		logger.Error("failed to save retention ledger", "error", err)
+	}
+}
+
+func (h *Handler) move(path, root string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve relative path: %w", err)
+	}
+	dst := filepath.Join(h.config.Uploader.PostUpload.Directory, rel)
+	err = fsutil.Move(path, dst)
+	if err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+func (h *Handler) retain(path string, size int64) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		logger.Error("failed to resolve absolute path", "path", path, "error", err)
+		return
+	}
+	err = h.ledger.add(abs, size)
+	if err != nil {
+		logger.Error("failed to record retained file", "path", path, "error", err)
+	}
+}
@@ -0,0 +1,164 @@
+package priority
+
+import (
+	"container/heap"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("priority")
+
+type item struct {
+	path    string
+	modTime time.Time
+	size    int64
+	// rank is the position of the file's IMAGETYP in the configured list
+	rank int
+}
+
+// Queue hands out paths in the configured priority order. Files are ranked
+// when they are pushed, so a file is not read again while it waits.
+type Queue struct {
+	config config.Priority
+	lock   sync.Mutex
+	items  itemHeap
+	// ready is signalled when a path is pushed
+	ready chan struct{}
+}
+
+func NewQueue(cfg config.Priority) *Queue {
+	return &Queue{
+		config: cfg,
+		items:  itemHeap{order: cfg.Order},
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// Push adds a path to the queue.
+func (q *Queue) Push(path string) {
+	it := item{path: path, rank: len(q.config.ImageTypes)}
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Warn("failed to stat queued file", "path", path, "error", err)
+	} else {
+		it.modTime = info.ModTime()
+		it.size = info.Size()
+	}
+	if q.config.Order == config.PriorityImageType {
+		it.rank = q.rank(path)
+	}
+
+	q.lock.Lock()
+	heap.Push(&q.items, it)
+	q.lock.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Pop blocks until a path is queued and returns the one with the highest
+// priority, or returns false once done is closed.
+func (q *Queue) Pop(done <-chan struct{}) (string, bool) {
+	for {
+		q.lock.Lock()
+		if q.items.Len() > 0 {
+			it, _ := heap.Pop(&q.items).(item)
+			more := q.items.Len() > 0
+			q.lock.Unlock()
+			if more {
+				// Keep another consumer from waiting on a non-empty queue
+				select {
+				case q.ready <- struct{}{}:
+				default:
+				}
+			}
+			return it.path, true
+		}
+		q.lock.Unlock()
+
+		select {
+		case <-done:
+			return "", false
+		case <-q.ready:
+		}
+	}
+}
+
+// Len returns the number of queued paths.
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.items.Len()
+}
+
+func (q *Queue) rank(path string) int {
+	unlisted := len(q.config.ImageTypes)
+	if !fits.IsFITS(path) {
+		return unlisted
+	}
+	header, err := fits.ReadFile(path)
+	if err != nil {
+		logger.Debug("failed to read FITS header for priority", "path", path, "error", err)
+		return unlisted
+	}
+	imageType := strings.TrimSpace(header["IMAGETYP"])
+	idx := slices.IndexFunc(q.config.ImageTypes, func(t string) bool { return strings.EqualFold(t, imageType) })
+	if idx < 0 {
+		return unlisted
+	}
+	return idx
+}
+
+type itemHeap struct {
+	order config.PriorityOrder
+	items []item
+}
+
+func (h *itemHeap) Len() int { return len(h.items) }
+
+func (h *itemHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	switch h.order {
+	case config.PriorityNewest:
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.After(b.modTime)
+		}
+	case config.PrioritySmallest:
+		if a.size != b.size {
+			return a.size < b.size
+		}
+	case config.PriorityImageType:
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		fallthrough
+	case config.PriorityOldest:
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.Before(b.modTime)
+		}
+	}
+	return a.path < b.path
+}
+
+func (h *itemHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *itemHeap) Push(x any) {
+	it, _ := x.(item)
+	h.items = append(h.items, it)
+}
+
+func (h *itemHeap) Pop() any {
+	it := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return it
+}
@@ -0,0 +1,75 @@
+package priority_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/priority"
+)
+
+// writeFrame writes a minimal FITS file with the given image type, size
+// padding and modification time.
+func writeFrame(t *testing.T, dir, name, imageType string, padding int, modTime time.Time) string {
+	t.Helper()
+	var header strings.Builder
+	for _, card := range []string{
+		"SIMPLE  =                    T",
+		fmt.Sprintf("IMAGETYP= '%-8s'", imageType),
+		"END",
+	} {
+		header.WriteString(fmt.Sprintf("%-80s", card))
+	}
+	data := []byte(header.String() + strings.Repeat(" ", 2880-header.Len()+padding))
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOrder(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	now := time.Now()
+	writeFrame(t, dir, "a.fits", "DARK", 300, now.Add(-3*time.Hour))
+	writeFrame(t, dir, "b.fits", "LIGHT", 200, now.Add(-1*time.Hour))
+	writeFrame(t, dir, "c.fits", "FLAT", 100, now.Add(-2*time.Hour))
+	writeFrame(t, dir, "d.fits", "LIGHT", 400, now.Add(-4*time.Hour))
+
+	tests := []struct {
+		order config.PriorityOrder
+		want  []string
+	}{
+		{config.PriorityOldest, []string{"d.fits", "a.fits", "c.fits", "b.fits"}},
+		{config.PriorityNewest, []string{"b.fits", "c.fits", "a.fits", "d.fits"}},
+		{config.PrioritySmallest, []string{"c.fits", "b.fits", "a.fits", "d.fits"}},
+		{config.PriorityImageType, []string{"d.fits", "b.fits", "c.fits", "a.fits"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.order), func(t *testing.T) {
+			t.Parallel()
+			queue := priority.NewQueue(config.Priority{Order: tt.order, ImageTypes: []string{"light", "FLAT"}})
+			for _, name := range []string{"a.fits", "b.fits", "c.fits", "d.fits"} {
+				queue.Push(filepath.Join(dir, name))
+			}
+			var got []string
+			for queue.Len() > 0 {
+				path, _ := queue.Pop(nil)
+				got = append(got, filepath.Base(path))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
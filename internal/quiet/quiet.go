@@ -0,0 +1,169 @@
+package quiet
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("quiet")
+
+// SourceHTTP holds the quiet windows opened over HTTP.
+const SourceHTTP = "http"
+
+// Gate holds uploads between parts while a quiet window is open, i.e. while
+// the camera downloads a frame over USB. Each source of quiet windows holds
+// its own, the gate is quiet until the last of them ends. A nil Gate is
+// never quiet.
+type Gate struct {
+	lock  sync.Mutex
+	holds map[string]time.Time
+	// changed is closed and replaced whenever a hold changes
+	changed chan struct{}
+	// timeout is how long a window opened without a duration lasts
+	timeout atomic.Int64
+}
+
+func NewGate() *Gate {
+	return &Gate{
+		holds:   make(map[string]time.Time),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetTimeout sets how long a window opened over HTTP without a duration
+// lasts.
+func (g *Gate) SetTimeout(timeout time.Duration) {
+	g.timeout.Store(int64(timeout))
+}
+
+// Hold opens or moves the quiet window of source to end at until. A time in
+// the past ends it.
+func (g *Gate) Hold(source string, until time.Time) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.holds[source].Equal(until) {
+		return
+	}
+	if until.After(time.Now()) && g.until().Before(time.Now()) {
+		logger.Info("quiet window opened, pausing uploads", "source", source, "until", until)
+	}
+	g.holds[source] = until
+	g.notify()
+}
+
+// Release ends the quiet window of source.
+func (g *Gate) Release(source string) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.holds[source]; !ok {
+		return
+	}
+	delete(g.holds, source)
+	g.notify()
+}
+
+// Until returns when the last open quiet window ends, which is in the past
+// when none is open.
+func (g *Gate) Until() time.Time {
+	if g == nil {
+		return time.Time{}
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.until()
+}
+
+func (g *Gate) until() time.Time {
+	var until time.Time
+	for _, end := range g.holds {
+		if end.After(until) {
+			until = end
+		}
+	}
+	return until
+}
+
+func (g *Gate) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+	maps.DeleteFunc(g.holds, func(_ string, end time.Time) bool { return end.Before(time.Now()) })
+}
+
+// Wait returns once no quiet window is open, or with the error of ctx once
+// it is done.
+func (g *Gate) Wait(ctx context.Context) error {
+	if g == nil {
+		return ctx.Err()
+	}
+	for {
+		g.lock.Lock()
+		wait := time.Until(g.until())
+		changed := g.changed
+		g.lock.Unlock()
+		if wait <= 0 {
+			return ctx.Err()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+type status struct {
+	Quiet bool       `json:"quiet"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// ServeHTTP opens a quiet window on POST, for the duration query parameter
+// or the timeout, ends it on DELETE, and reports the state of the gate on
+// every method.
+func (g *Gate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		duration := time.Duration(g.timeout.Load())
+		if value := r.URL.Query().Get("duration"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "duration must be a positive duration like 30s", http.StatusBadRequest)
+				return
+			}
+			duration = parsed
+		}
+		g.Hold(SourceHTTP, time.Now().Add(duration))
+	case http.MethodDelete:
+		g.Release(SourceHTTP)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var state status
+	if until := g.Until(); until.After(time.Now()) {
+		state = status{Quiet: true, Until: &until}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
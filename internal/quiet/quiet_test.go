@@ -0,0 +1,75 @@
+package quiet_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/quiet"
+)
+
+func TestWaitResumesAfterTimeout(t *testing.T) {
+	t.Parallel()
+	gate := quiet.NewGate()
+	gate.Hold("camera", time.Now().Add(100*time.Millisecond))
+	gate.Hold("stale", time.Now().Add(-time.Hour))
+
+	start := time.Now()
+	if err := gate.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 80*time.Millisecond {
+		t.Fatalf("Wait returned after %v, before the window ended", waited)
+	}
+}
+
+func TestReleaseEndsWindow(t *testing.T) {
+	t.Parallel()
+	gate := quiet.NewGate()
+	gate.SetTimeout(time.Hour)
+
+	server := httptest.NewServer(gate)
+	defer server.Close()
+	resp, err := http.Post(server.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gate.Until().Before(time.Now().Add(59 * time.Minute)) {
+		t.Fatalf("POST did not open a window for the timeout, until %v", gate.Until())
+	}
+
+	done := make(chan error)
+	go func() { done <- gate.Wait(context.Background()) }()
+	select {
+	case <-done:
+		t.Fatal("Wait returned while the window was open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return once the window was released")
+	}
+}
+
+func TestNilGate(t *testing.T) {
+	t.Parallel()
+	var gate *quiet.Gate
+	gate.Hold("camera", time.Now().Add(time.Hour))
+	if err := gate.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
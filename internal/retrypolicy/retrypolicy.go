@@ -0,0 +1,51 @@
+package retrypolicy
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+)
+
+// Policy turns the retry configuration into backoff delays and decides when
+// to give up on a file.
+type Policy struct {
+	config config.Retry
+}
+
+func New(cfg config.Retry) *Policy {
+	return &Policy{config: cfg}
+}
+
+// ImmediateAttempts is the number of attempts made before a file is moved to
+// the local directory.
+func (p *Policy) ImmediateAttempts() uint {
+	if p.config.MaxAttempts > 0 {
+		return min(p.config.ImmediateAttempts, p.config.MaxAttempts)
+	}
+	return p.config.ImmediateAttempts
+}
+
+// Delay returns the exponential backoff to wait after the given number of
+// failed attempts, capped at the maximum backoff and randomized by the jitter.
+func (p *Policy) Delay(attempts uint) time.Duration {
+	delay := p.config.BaseBackoff
+	for i := uint(1); i < attempts && delay < p.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.config.MaxBackoff)
+	if p.config.Jitter > 0 {
+		//nolint:gosec // jitter does not need a secure random source
+		delay += time.Duration((rand.Float64()*2 - 1) * p.config.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// Exhausted reports whether a file that has failed the given number of
+// attempts, the first at firstFailure, should be given up on.
+func (p *Policy) Exhausted(attempts uint, firstFailure time.Time) bool {
+	if p.config.MaxAttempts > 0 && attempts >= p.config.MaxAttempts {
+		return true
+	}
+	return p.config.MaxAge > 0 && time.Since(firstFailure) >= p.config.MaxAge
+}
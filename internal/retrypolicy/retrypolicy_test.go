@@ -0,0 +1,46 @@
+package retrypolicy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/retrypolicy"
+)
+
+func TestDelay(t *testing.T) {
+	t.Parallel()
+	policy := retrypolicy.New(config.Retry{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second})
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := policy.Delay(uint(i + 1)); got != w {
+			t.Errorf("Delay(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+
+	jittered := retrypolicy.New(config.Retry{BaseBackoff: time.Second, MaxBackoff: time.Second, Jitter: 0.5})
+	for range 100 {
+		if got := jittered.Delay(1); got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("Delay with jitter = %s, want within 50%% of 1s", got)
+		}
+	}
+}
+
+func TestExhausted(t *testing.T) {
+	t.Parallel()
+	policy := retrypolicy.New(config.Retry{MaxAttempts: 5, MaxAge: time.Hour})
+	if policy.Exhausted(4, time.Now()) {
+		t.Error("expected policy not to be exhausted before max attempts")
+	}
+	if !policy.Exhausted(5, time.Now()) {
+		t.Error("expected policy to be exhausted at max attempts")
+	}
+	if !policy.Exhausted(1, time.Now().Add(-2*time.Hour)) {
+		t.Error("expected policy to be exhausted after max age")
+	}
+
+	forever := retrypolicy.New(config.Retry{})
+	if forever.Exhausted(1000, time.Now().Add(-24*365*time.Hour)) {
+		t.Error("expected unlimited policy never to be exhausted")
+	}
+}
@@ -2,72 +2,90 @@ package reupload
 
 import (
 	"context"
+	"errors"
 	"log/slog"
-	"math/rand"
-	"os"
 	"time"
 
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/connectivity"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/deadletter"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/hooks"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/metrics"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/postupload"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/retrypolicy"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/sidecar"
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
 )
 
 type reuploadJob struct {
-	path     string
-	started  bool
-	stopped  bool
-	uploader *uploader.Uploader
-	attempts uint64
+	path          string
+	logger        *slog.Logger
+	sidecars      []config.Sidecar
+	localDir      string
+	deadLetterDir string
+	uploader      *uploader.Uploader
+	postUpload    *postupload.Handler
+	hooks         *hooks.Runner
+	retryPolicy   *retrypolicy.Policy
+	monitor       *connectivity.Monitor
+	metrics       *metrics.Profile
+	firstFailure  time.Time
+	attempts      uint
 }
 
-func (r *reuploadJob) Run(callback func(path string)) error {
-	r.started = true
-	defer func() {
-		r.stopped = true
-		callback(r.path)
-	}()
-	for r.started {
-		err := r.uploader.Upload(r.path)
-		if err != nil {
-			slog.Warn("retrying upload", "attempt", r.attempts+1, "path", r.path, "error", err)
-			slog.Error("failed to upload file", "path", r.path, "error", err)
-			r.attempts++
-			randomJitter := time.Duration(rand.Intn(5))*time.Minute + time.Duration(rand.Intn(60))*time.Second
-			slog.Debug("sleeping before retrying", "duration", randomJitter)
-			// divide randomJitter up so we can check if we should stop
-			for i := 0; i < 100 && r.started; i++ {
-				time.Sleep(randomJitter / 100)
-				if !r.started {
-					return nil
-				}
+// attempt makes a single upload attempt. It returns whether the job is
+// finished, either uploaded or given up on, and otherwise how long to back
+// off before the next attempt, along with the result of an upload.
+func (r *reuploadJob) attempt(ctx context.Context) (time.Duration, bool, *uploader.Result) {
+	group := sidecar.Group(r.path, r.sidecars)
+	size := sidecar.Size(group)
+	// Jobs queue up behind the monitor instead of each probing a dead
+	// link on its own backoff
+	var result uploader.Result
+	err := r.monitor.Do(func() error {
+		var err error
+		result, err = r.uploader.UploadGroup(ctx, group, nil)
+		return err
+	})
+	if errors.Is(err, connectivity.ErrStopped) || ctx.Err() != nil {
+		// Interrupted by shutdown, the files stay for the next start
+		return 0, false, nil
+	}
+	if err != nil {
+		r.attempts++
+		r.metrics.Failed()
+		r.logger.Error("failed to upload file", "attempt", r.attempts, "path", r.path, "error", err)
+		if uploader.IsPermanent(err) || r.retryPolicy.Exhausted(r.attempts, r.firstFailure) {
+			r.logger.Error("giving up on upload", "path", r.path, "permanent", uploader.IsPermanent(err), "attempts", r.attempts)
+			r.metrics.DeadLettered()
+			reason := err.Error()
+			err = deadletter.Send(r.deadLetterDir, sidecar.Owned(group), r.localDir, deadletter.Report{
+				Path:         r.path,
+				Error:        reason,
+				Permanent:    uploader.IsPermanent(err),
+				Attempts:     r.attempts,
+				FirstFailure: r.firstFailure,
+			})
+			if err != nil {
+				r.logger.Error("failed to move file to dead-letter directory", "path", r.path, "error", err)
 			}
-			continue
-		}
-		err = os.Remove(r.path)
-		if err != nil {
-			slog.Error("failed to remove file from local directory", "path", r.path, "error", err)
-			return err
+			r.uploader.MarkDeadLettered(group, reason)
+			r.runHook(ctx, hooks.OnFailure, hooks.Env{Path: r.path, Size: size, Error: reason})
+			return 0, true, nil
 		}
-		return nil
+		delay := r.retryPolicy.Delay(r.attempts)
+		r.logger.Debug("backing off before retrying", "path", r.path, "duration", delay)
+		return delay, false, nil
 	}
-	return nil
+	r.metrics.Uploaded(len(group), size)
+	r.runHook(ctx, hooks.PostUpload, hooks.Env{Path: r.path, Key: result.Key, Bucket: result.Bucket, Size: result.Size, SHA256: result.SHA256})
+	r.postUpload.Apply(sidecar.Owned(group), r.localDir, result.PostUpload)
+	return 0, true, &result
 }
 
-func (r *reuploadJob) Stop() error {
-	r.started = false
-
-	var done = make(chan struct{})
-	go func() {
-		for !r.stopped {
-			time.Sleep(100 * time.Millisecond)
-		}
-		close(done)
-	}()
-
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
-	defer cancel()
-	select {
-	case <-done:
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
+// runHook runs the hook of event, a failing hook is only logged.
+func (r *reuploadJob) runHook(ctx context.Context, event hooks.Event, env hooks.Env) {
+	if err := r.hooks.Run(ctx, event, env); err != nil {
+		r.logger.Warn("hook failed", "hook", event, "path", r.path, "error", err)
 	}
 }
@@ -1,42 +1,152 @@
 package reupload
 
 import (
+	"context"
+	"os"
+	"time"
+
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/connectivity"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/hooks"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/metrics"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/postupload"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/priority"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/retrypolicy"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/sidecar"
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
 	"github.com/puzpuzpuz/xsync/v3"
-	"golang.org/x/sync/errgroup"
 )
 
+//nolint:gochecknoglobals
+var logger = logging.For("reupload")
+
+// ReuploadQueue retries files from the local directory. A single dispatcher
+// takes the highest priority job that is not backing off, so a backlog
+// drains in the configured order instead of every job retrying at once.
 type ReuploadQueue struct {
-	config    *config.Config
-	reuploads *xsync.MapOf[string, reuploadJob]
-	uploader  *uploader.Uploader
+	config      *config.Config
+	reuploads   *xsync.MapOf[string, *reuploadJob]
+	pending     *priority.Queue
+	uploader    *uploader.Uploader
+	postUpload  *postupload.Handler
+	hooks       *hooks.Runner
+	retryPolicy *retrypolicy.Policy
+	monitor     *connectivity.Monitor
+	metrics     *metrics.Profile
+	preUpload   PreUploadCallback
+	uploaded    UploadedCallback
+	done        chan struct{}
 }
 
-func NewReuploadQueue(config *config.Config, uploader *uploader.Uploader) *ReuploadQueue {
+// PreUploadCallback runs the pre-upload hook for the group of the frame at
+// path and reports whether it may be uploaded. A group the hook vetoes is
+// dead-lettered relative to root.
+type PreUploadCallback func(path string, group []string, root string) bool
+
+// UploadedCallback is told about each frame the queue uploads.
+type UploadedCallback func(result uploader.Result)
+
+func NewReuploadQueue(config *config.Config, uploader *uploader.Uploader, postUpload *postupload.Handler, hooks *hooks.Runner, retryPolicy *retrypolicy.Policy, monitor *connectivity.Monitor, metrics *metrics.Profile) *ReuploadQueue {
 	return &ReuploadQueue{
-		config:    config,
-		reuploads: xsync.NewMapOf[string, reuploadJob](),
-		uploader:  uploader,
+		config:      config,
+		reuploads:   xsync.NewMapOf[string, *reuploadJob](),
+		pending:     priority.NewQueue(config.Uploader.Priority),
+		uploader:    uploader,
+		postUpload:  postUpload,
+		hooks:       hooks,
+		retryPolicy: retryPolicy,
+		monitor:     monitor,
+		metrics:     metrics,
+		done:        make(chan struct{}),
 	}
 }
 
+// SetCallbacks sets what retried frames are checked with and reported to,
+// so they are treated like new ones. It must be called before Run.
+func (r *ReuploadQueue) SetCallbacks(preUpload PreUploadCallback, uploaded UploadedCallback) {
+	r.preUpload = preUpload
+	r.uploaded = uploaded
+}
+
 func (r *ReuploadQueue) Add(path string) {
-	job, loaded := r.reuploads.LoadOrStore(path, reuploadJob{path: path, uploader: r.uploader})
+	// The local copy is made when the first attempts fail, so its
+	// modification time survives restarts as the time of the first failure
+	firstFailure := time.Now()
+	if info, err := os.Stat(path); err == nil {
+		firstFailure = info.ModTime()
+	}
+	_, loaded := r.reuploads.LoadOrStore(path, &reuploadJob{
+		path:          path,
+		logger:        logger.With(logging.File(r.config.Uploader, path)),
+		sidecars:      r.config.Uploader.Sidecars,
+		localDir:      r.config.Uploader.Local.Directory,
+		deadLetterDir: r.config.Uploader.DeadLetter.Directory,
+		uploader:      r.uploader,
+		postUpload:    r.postUpload,
+		hooks:         r.hooks,
+		retryPolicy:   r.retryPolicy,
+		monitor:       r.monitor,
+		metrics:       r.metrics,
+		firstFailure:  firstFailure,
+		// Earlier attempts were made before the file was moved here
+		attempts: r.retryPolicy.ImmediateAttempts(),
+	})
 	if !loaded {
-		go job.Run(r.callback)
+		r.pending.Push(path)
 	}
 }
 
-func (r *ReuploadQueue) callback(path string) {
-	r.reuploads.Delete(path)
+// Run dispatches queued jobs one at a time until Stop is called, returning
+// once the job in flight has finished. Cancelling ctx interrupts that job.
+func (r *ReuploadQueue) Run(ctx context.Context) {
+	for {
+		path, ok := r.pending.Pop(r.done)
+		if !ok {
+			return
+		}
+		job, ok := r.reuploads.Load(path)
+		if !ok {
+			continue
+		}
+		delay, finished := r.attempt(ctx, job)
+		if finished {
+			r.reuploads.Delete(path)
+			continue
+		}
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+		time.AfterFunc(delay, func() {
+			select {
+			case <-r.done:
+			default:
+				r.pending.Push(path)
+			}
+		})
+	}
 }
 
-func (r *ReuploadQueue) Stop() error {
-	errgroup := errgroup.Group{}
-	r.reuploads.Range(func(key string, value reuploadJob) bool {
-		errgroup.Go(value.Stop)
-		return true
-	})
-	return errgroup.Wait()
+// attempt checks the job with the pre-upload callback before attempting it.
+// A group the hook skips is left in the local directory until the next
+// start, as skipped new frames are left in the watched one.
+func (r *ReuploadQueue) attempt(ctx context.Context, job *reuploadJob) (time.Duration, bool) {
+	if r.preUpload != nil {
+		group := sidecar.Owned(sidecar.Group(job.path, job.sidecars))
+		if !r.preUpload(job.path, group, job.localDir) {
+			return 0, true
+		}
+	}
+	delay, finished, result := job.attempt(ctx)
+	if result != nil && r.uploaded != nil {
+		r.uploaded(*result)
+	}
+	return delay, finished
+}
+
+// Stop keeps further jobs from starting.
+func (r *ReuploadQueue) Stop() {
+	close(r.done)
 }
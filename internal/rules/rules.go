@@ -0,0 +1,335 @@
+package rules
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"maps"
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/analysis"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// File describes the file a rule is evaluated against.
+type File struct {
+	// Path is relative to the watched directory and uses forward slashes
+	Path   string
+	Header fits.Header
+	Size   int64
+	// ModTime stands in for when the frame was taken without a DATE-OBS
+	ModTime time.Time
+	// Quality is nil unless the frame was analyzed
+	Quality *analysis.Stats
+}
+
+// templateData is exposed to tag and key templates.
+type templateData struct {
+	Path string
+	Dir  string
+	Name string
+	Ext  string
+	FITS fits.Header
+}
+
+// Match returns the first rule that matches file, or nil.
+func Match(rules []config.Rule, file File) *config.Rule {
+	for i := range rules {
+		if matches(rules[i].Match, file) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Admits reports whether a rule picks up the file at path, relative to the
+// watched directory, listing its extension and matching it by path if the
+// rule has paths. Rules without extensions only refine files picked up
+// otherwise.
+func Admits(rules []config.Rule, path string) bool {
+	return slices.ContainsFunc(rules, func(rule config.Rule) bool {
+		return len(rule.Match.Extensions) > 0 && matches(config.RuleMatch{Paths: rule.Match.Paths, Extensions: rule.Match.Extensions}, File{Path: path})
+	})
+}
+
+// Resolve returns the object options for file and the rules they came from.
+// With RuleModeFirst those are the options of the first matching rule, with
+// RuleModeAll every matching rule applies in order, later rules overriding
+// the options they set and adding to the tags.
+func Resolve(mode config.RuleMode, rules []config.Rule, file File) (config.ObjectOptions, []*config.Rule) {
+	if mode != config.RuleModeAll {
+		rule := Match(rules, file)
+		if rule == nil {
+			return config.ObjectOptions{}, nil
+		}
+		return rule.Object, []*config.Rule{rule}
+	}
+
+	var opts config.ObjectOptions
+	var matched []*config.Rule
+	for i := range rules {
+		if !matches(rules[i].Match, file) {
+			continue
+		}
+		matched = append(matched, &rules[i])
+		merge(&opts, rules[i].Object)
+	}
+	return opts, matched
+}
+
+func merge(opts *config.ObjectOptions, other config.ObjectOptions) {
+	tags := opts.Tags
+	if len(other.Tags) > 0 {
+		tags = maps.Clone(tags)
+		if tags == nil {
+			tags = make(map[string]string, len(other.Tags))
+		}
+		maps.Copy(tags, other.Tags)
+	}
+	opts.Bucket = cmp.Or(other.Bucket, opts.Bucket)
+	opts.KeyTemplate = cmp.Or(other.KeyTemplate, opts.KeyTemplate)
+	opts.Prefix = cmp.Or(other.Prefix, opts.Prefix)
+	opts.StorageClass = cmp.Or(other.StorageClass, opts.StorageClass)
+	opts.CacheControl = cmp.Or(other.CacheControl, opts.CacheControl)
+	opts.ContentType = cmp.Or(other.ContentType, opts.ContentType)
+	opts.Compression = cmp.Or(other.Compression, opts.Compression)
+	opts.PostUpload = cmp.Or(other.PostUpload, opts.PostUpload)
+	opts.Tags = tags
+}
+
+func matches(match config.RuleMatch, file File) bool {
+	if len(match.Extensions) > 0 && !slices.Contains(match.Extensions, path.Ext(file.Path)) {
+		return false
+	}
+	if len(match.Paths) > 0 && !slices.ContainsFunc(match.Paths, func(glob string) bool {
+		return Glob(glob, file.Path)
+	}) {
+		return false
+	}
+	if (match.MinSize > 0 && file.Size < int64(match.MinSize)) || (match.MaxSize > 0 && file.Size > int64(match.MaxSize)) {
+		return false
+	}
+	if !matchTime(match.Time, file) {
+		return false
+	}
+	if !match.Quality.IsZero() && !FailsQuality(match.Quality, file.Quality) {
+		return false
+	}
+	return MatchHeaders(match.Headers, file.Header)
+}
+
+// matchTime reports whether the frame was taken within the bounds of match.
+// Bounds that do not parse were rejected with the config and match nothing.
+func matchTime(match config.TimeMatch, file File) bool {
+	if match == (config.TimeMatch{}) {
+		return true
+	}
+	after, before, err := match.Bounds()
+	if err != nil {
+		return false
+	}
+	taken, ok := fits.ObservationTime(file.Header)
+	if !ok {
+		taken = file.ModTime
+	}
+	return (after.IsZero() || !taken.Before(after)) && (before.IsZero() || taken.Before(before))
+}
+
+// FailsQuality reports whether stats fail any threshold of quality. Frames
+// without statistics fail none.
+func FailsQuality(quality config.QualityMatch, stats *analysis.Stats) bool {
+	if stats == nil {
+		return false
+	}
+	switch {
+	case quality.MinStars > 0 && stats.Stars < quality.MinStars:
+		return true
+	case quality.MaxHFR > 0 && stats.HFR > quality.MaxHFR:
+		return true
+	case quality.MaxFWHM > 0 && stats.FWHM > quality.MaxFWHM:
+		return true
+	case quality.MaxMedian > 0 && stats.Median > quality.MaxMedian:
+		return true
+	case quality.MaxNoise > 0 && stats.Noise > quality.MaxNoise:
+		return true
+	}
+	return false
+}
+
+// MatchHeaders reports whether header has a value matching the glob of each
+// keyword in globs.
+func MatchHeaders(globs map[string]string, header fits.Header) bool {
+	for keyword, glob := range globs {
+		value, ok := header[strings.ToUpper(keyword)]
+		if !ok || !Glob(glob, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Glob matches name against a glob where * does not cross a / but ** does.
+// Matching is case-insensitive as N.I.N.A. paths and header values are not
+// consistently cased.
+func Glob(glob, name string) bool {
+	var sb strings.Builder
+	sb.WriteString("(?i)^")
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+		}
+	}
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return false
+	}
+	return re.MatchString(name)
+}
+
+// Apply sets the rule's object options on input.
+func Apply(opts config.ObjectOptions, file File, input *s3.PutObjectInput) error {
+	if opts.StorageClass != "" {
+		input.StorageClass = types.StorageClass(opts.StorageClass)
+	}
+	if opts.CacheControl != "" {
+		input.CacheControl = aws.String(opts.CacheControl)
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if len(opts.Tags) > 0 {
+		tags, err := renderTags(opts.Tags, file)
+		if err != nil {
+			return err
+		}
+		if tags != "" {
+			input.Tagging = aws.String(tags)
+		}
+	}
+	return nil
+}
+
+// ContentType guesses the content type for a file without a configured one.
+func ContentType(name string) string {
+	if fits.IsFITS(name) {
+		return "application/fits"
+	}
+	return mime.TypeByExtension(filepath.Ext(name))
+}
+
+// Key renders a key template for file. The result is cleaned and relative,
+// empty path segments such as from a missing header are dropped.
+func Key(text string, file File) (string, error) {
+	tmpl, err := template.New("key").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse key template: %w", err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, newTemplateData(file))
+	if err != nil {
+		return "", fmt.Errorf("failed to render key template: %w", err)
+	}
+	key := strings.TrimPrefix(path.Clean("/"+buf.String()), "/")
+	if key == "" {
+		return "", fmt.Errorf("key template rendered an empty key for %s", file.Path)
+	}
+	return key, nil
+}
+
+//nolint:gochecknoglobals
+var headerSegment = regexp.MustCompile(`^\{\{-?\s*(?:\.FITS\.([A-Za-z0-9_]+)|index\s+\.FITS\s+"([^"]+)")\s*-?\}\}$`)
+
+// KeyFields recovers the header values a key template wrote into key, from
+// the path segments that are a single header field such as
+// {{ .FITS.OBJECT }}. It returns nil if key does not have as many segments
+// as the template, i.e. because a header was missing.
+func KeyFields(text, key string) fits.Header {
+	segments := strings.Split(strings.Trim(text, "/"), "/")
+	parts := strings.Split(key, "/")
+	if len(segments) != len(parts) {
+		return nil
+	}
+	header := fits.Header{}
+	for i, segment := range segments {
+		match := headerSegment.FindStringSubmatch(strings.TrimSpace(segment))
+		if match == nil {
+			continue
+		}
+		header[match[1]+match[2]] = parts[i]
+	}
+	return header
+}
+
+func newTemplateData(file File) templateData {
+	data := templateData{
+		Path: file.Path,
+		Dir:  path.Dir(file.Path),
+		Name: path.Base(file.Path),
+		Ext:  path.Ext(file.Path),
+		FITS: file.Header,
+	}
+	if data.FITS == nil {
+		data.FITS = fits.Header{}
+	}
+	return data
+}
+
+func renderTags(tags map[string]string, file File) (string, error) {
+	data := newTemplateData(file)
+
+	values := url.Values{}
+	for key, text := range tags {
+		tmpl, err := template.New(key).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse tag %s: %w", key, err)
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, data)
+		if err != nil {
+			return "", fmt.Errorf("failed to render tag %s: %w", key, err)
+		}
+		// Tags with no value, such as a header missing from a sidecar, are
+		// left off rather than stored empty
+		if value := sanitizeTag(buf.String()); value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values.Encode(), nil
+}
+
+// sanitizeTag replaces characters S3 does not allow in tag values.
+func sanitizeTag(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-=._:/@", r):
+			return r
+		default:
+			return '_'
+		}
+	}, strings.TrimSpace(value))
+}
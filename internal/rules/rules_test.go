@@ -0,0 +1,216 @@
+package rules_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/analysis"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/rules"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestGlob(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		glob  string
+		name  string
+		match bool
+	}{
+		{"*.fits", "frame.fits", true},
+		{"*.fits", "M31/frame.fits", false},
+		{"**/*.fits", "M31/2026-09-12/frame.fits", true},
+		{"M31/**", "m31/LIGHT/frame.fits", true},
+		{"DARK*", "DARKFLAT", true},
+		{"LIGHT", "DARK", false},
+		{"frame_????.fits", "frame_0001.fits", true},
+	}
+	for _, tt := range tests {
+		if got := rules.Glob(tt.glob, tt.name); got != tt.match {
+			t.Errorf("Glob(%q, %q) = %v, want %v", tt.glob, tt.name, got, tt.match)
+		}
+	}
+}
+
+func TestMatchAndApply(t *testing.T) {
+	t.Parallel()
+	cfg := []config.Rule{
+		{
+			Match:  config.RuleMatch{Headers: map[string]string{"IMAGETYP": "DARK*"}},
+			Object: config.ObjectOptions{StorageClass: "GLACIER_IR", Tags: map[string]string{"imagetype": "{{ .FITS.IMAGETYP }}"}},
+		},
+		{
+			Match:  config.RuleMatch{Extensions: []string{".fits"}},
+			Object: config.ObjectOptions{StorageClass: "STANDARD_IA", Tags: map[string]string{"target": "{{ .Dir }}", "empty": "{{ .FITS.OBJECT }}"}},
+		},
+	}
+
+	dark := rules.File{Path: "darks/dark.fits", Header: fits.Header{"IMAGETYP": "DARK"}}
+	rule := rules.Match(cfg, dark)
+	if rule != &cfg[0] {
+		t.Fatalf("expected dark rule to match")
+	}
+
+	light := rules.File{Path: "M31/light.fits", Header: fits.Header{"IMAGETYP": "LIGHT"}}
+	rule = rules.Match(cfg, light)
+	if rule != &cfg[1] {
+		t.Fatalf("expected extension rule to match")
+	}
+
+	input := &s3.PutObjectInput{}
+	if err := rules.Apply(rule.Object, light, input); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if input.StorageClass != "STANDARD_IA" {
+		t.Errorf("unexpected storage class %q", input.StorageClass)
+	}
+	tags, err := url.ParseQuery(*input.Tagging)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tags.Get("target") != "M31" || tags.Has("empty") {
+		t.Errorf("unexpected tags %v", tags)
+	}
+
+	if rules.Match(cfg, rules.File{Path: "notes.txt"}) != nil {
+		t.Errorf("expected no rule to match")
+	}
+}
+
+func TestKey(t *testing.T) {
+	t.Parallel()
+	file := rules.File{
+		Path:   "2024-05-01/M31/frame_001.fits",
+		Header: fits.Header{"OBJECT": "M 31", "IMAGETYP": "LIGHT"},
+	}
+	tests := map[string]string{
+		"{{ .FITS.IMAGETYP }}/{{ .Name }}":                  "LIGHT/frame_001.fits",
+		"/{{ .Dir }}//{{ .Name }}":                          "2024-05-01/M31/frame_001.fits",
+		"{{ .FITS.FILTER }}/{{ .FITS.OBJECT }}/{{ .Name }}": "M 31/frame_001.fits",
+	}
+	for text, want := range tests {
+		got, err := rules.Key(text, file)
+		if err != nil {
+			t.Errorf("Key(%q) returned error: %v", text, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("Key(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestKeyFields(t *testing.T) {
+	t.Parallel()
+	text := `{{ .FITS.OBJECT }}/{{ index .FITS "FILTER" }}/night-{{ .FITS.NIGHT }}/{{ .Name }}`
+	header := rules.KeyFields(text, "M 31/Ha/night-1/frame_001.fits")
+	if header["OBJECT"] != "M 31" || header["FILTER"] != "Ha" || len(header) != 2 {
+		t.Errorf("unexpected fields %v", header)
+	}
+	// A missing header drops its segment, so the fields can't be told apart
+	if header := rules.KeyFields(text, "M 31/night-1/frame_001.fits"); header != nil {
+		t.Errorf("expected no fields, got %v", header)
+	}
+}
+
+func TestMatchQuality(t *testing.T) {
+	t.Parallel()
+	cfg := []config.Rule{
+		{
+			Match:  config.RuleMatch{Quality: config.QualityMatch{MinStars: 50, MaxHFR: 4}},
+			Object: config.ObjectOptions{Prefix: "rejected/"},
+		},
+	}
+	tests := []struct {
+		name  string
+		stats *analysis.Stats
+		match bool
+	}{
+		{"good", &analysis.Stats{Stars: 400, HFR: 2.1}, false},
+		{"clouds", &analysis.Stats{Stars: 12, HFR: 2.3}, true},
+		{"out of focus", &analysis.Stats{Stars: 300, HFR: 5.2}, true},
+		{"not analyzed", nil, false},
+	}
+	for _, tt := range tests {
+		file := rules.File{Path: "M31/light.fits", Quality: tt.stats}
+		if got := rules.Match(cfg, file) != nil; got != tt.match {
+			t.Errorf("%s: matched %v, want %v", tt.name, got, tt.match)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+	cfg := []config.Rule{
+		{
+			Match:  config.RuleMatch{Extensions: []string{".fits"}},
+			Object: config.ObjectOptions{StorageClass: "STANDARD_IA", Tags: map[string]string{"target": "{{ .FITS.OBJECT }}"}},
+		},
+		{
+			Match:  config.RuleMatch{Headers: map[string]string{"TELESCOP": "RedCat*"}, MinSize: 1 << 20},
+			Object: config.ObjectOptions{Bucket: "redcat", Tags: map[string]string{"scope": "redcat"}, PostUpload: config.PostUploadKeep},
+		},
+		{
+			Match:  config.RuleMatch{Time: config.TimeMatch{Before: "2025-01-01T00:00:00Z"}},
+			Object: config.ObjectOptions{StorageClass: "GLACIER_IR", Compression: config.CompressionGzip},
+		},
+	}
+	file := rules.File{
+		Path:   "M31/light.fits",
+		Header: fits.Header{"TELESCOP": "RedCat 51", "OBJECT": "M31", "DATE-OBS": "2026-10-01T03:00:00.123"},
+		Size:   32 << 20,
+		// DATE-OBS takes precedence over the modification time
+		ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	opts, matched := rules.Resolve(config.RuleModeFirst, cfg, file)
+	if len(matched) != 1 || matched[0] != &cfg[0] || opts.Bucket != "" {
+		t.Fatalf("first mode applied %d rules, options %+v", len(matched), opts)
+	}
+
+	opts, matched = rules.Resolve(config.RuleModeAll, cfg, file)
+	if len(matched) != 2 {
+		t.Fatalf("all mode applied %d rules, want 2", len(matched))
+	}
+	if opts.Bucket != "redcat" || opts.StorageClass != "STANDARD_IA" || opts.PostUpload != config.PostUploadKeep || len(opts.Tags) != 2 {
+		t.Errorf("unexpected merged options %+v", opts)
+	}
+	if len(cfg[0].Object.Tags) != 1 {
+		t.Errorf("merging modified the tags of the config: %v", cfg[0].Object.Tags)
+	}
+
+	small := file
+	small.Size = 1024
+	small.Header = fits.Header{"TELESCOP": "RedCat 51"}
+	opts, matched = rules.Resolve(config.RuleModeAll, cfg, small)
+	if len(matched) != 2 || opts.Bucket != "" || opts.StorageClass != "GLACIER_IR" || opts.Compression != config.CompressionGzip {
+		t.Errorf("unexpected options for a small old file %+v from %d rules", opts, len(matched))
+	}
+}
+
+func TestAdmits(t *testing.T) {
+	t.Parallel()
+	ruleList := []config.Rule{
+		{Match: config.RuleMatch{Extensions: []string{".jpg"}, Paths: []string{"allsky/**"}}},
+		{Match: config.RuleMatch{Paths: []string{"flats/**"}}},
+		{Match: config.RuleMatch{Extensions: []string{".xisf"}, Headers: map[string]string{"IMAGETYP": "LIGHT"}}},
+	}
+	tests := []struct {
+		path  string
+		admit bool
+	}{
+		{"allsky/2026-09-13/0001.jpg", true},
+		{"M31/0001.jpg", false},
+		// Rules without extensions only refine files picked up otherwise
+		{"flats/0001.fits", false},
+		// Headers are not known when files are picked up
+		{"M31/0001.xisf", true},
+	}
+	for _, tt := range tests {
+		if got := rules.Admits(ruleList, tt.path); got != tt.admit {
+			t.Errorf("Admits(%q) = %v, want %v", tt.path, got, tt.admit)
+		}
+	}
+}
@@ -0,0 +1,606 @@
+// Package s3test runs an in-memory S3 for tests. It answers the path-style
+// requests the uploader makes, without checking signatures.
+package s3test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5" //nolint:gosec // ETags are MD5 sums
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+)
+
+// Operation names, as passed to the failure hook and counted by Count.
+const (
+	OpHeadBucket     = "HeadBucket"
+	OpListObjects    = "ListObjectsV2"
+	OpListUploads    = "ListMultipartUploads"
+	OpDeleteObjects  = "DeleteObjects"
+	OpHeadObject     = "HeadObject"
+	OpGetObject      = "GetObject"
+	OpPutObject      = "PutObject"
+	OpDeleteObject   = "DeleteObject"
+	OpCreateUpload   = "CreateMultipartUpload"
+	OpUploadPart     = "UploadPart"
+	OpListParts      = "ListParts"
+	OpCompleteUpload = "CompleteMultipartUpload"
+	OpAbortUpload    = "AbortMultipartUpload"
+)
+
+const metadataPrefix = "X-Amz-Meta-"
+
+// Object is a stored object.
+type Object struct {
+	Data            []byte
+	ContentType     string
+	ContentEncoding string
+	Metadata        map[string]string
+	ETag            string
+	Modified        time.Time
+}
+
+type part struct {
+	data     []byte
+	etag     string
+	checksum http.Header
+}
+
+type upload struct {
+	bucket    string
+	key       string
+	object    Object
+	parts     map[int]*part
+	initiated time.Time
+}
+
+// Server is an in-memory S3.
+type Server struct {
+	URL string
+
+	lock    sync.Mutex
+	buckets map[string]map[string]*Object
+	uploads map[string]*upload
+	counts  map[string]int
+	fail    func(op string, r *http.Request) int
+	nextID  int
+}
+
+// New starts a server with the given buckets, which is closed when the test
+// ends.
+func New(t testing.TB, buckets ...string) *Server {
+	t.Helper()
+	s := &Server{
+		buckets: map[string]map[string]*Object{},
+		uploads: map[string]*upload{},
+		counts:  map[string]int{},
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = map[string]*Object{}
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	s.URL = server.URL
+	return s
+}
+
+// S3 returns the configuration of a client of bucket on the server.
+func (s *Server) S3(bucket string) config.S3 {
+	return config.S3{
+		Region:     "us-east-1",
+		Bucket:     bucket,
+		Prefix:     "/",
+		Endpoint:   s.URL,
+		Addressing: config.AddressingPath,
+		Checksum:   config.ChecksumNone,
+		Encryption: config.Encryption{Mode: config.EncryptionModeNone},
+		Credentials: config.Credentials{
+			AccessKeyID:     "test",
+			SecretAccessKey: "test",
+		},
+	}
+}
+
+// FailWhen makes requests fail with the HTTP status fn returns for them,
+// until it is called again. Requests for which it returns 0 and all requests
+// with a nil fn are answered.
+func (s *Server) FailWhen(fn func(op string, r *http.Request) int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fail = fn
+}
+
+// Count returns how many requests of op the server answered.
+func (s *Server) Count(op string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counts[op]
+}
+
+// Object returns the object at key.
+func (s *Server) Object(bucket, key string) (Object, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	object, ok := s.buckets[bucket][key]
+	if !ok {
+		return Object{}, false
+	}
+	return *object, true
+}
+
+// Put stores an object directly.
+func (s *Server) Put(bucket, key string, object Object) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if object.ETag == "" {
+		object.ETag = etag(object.Data)
+	}
+	if object.Modified.IsZero() {
+		object.Modified = time.Now()
+	}
+	s.buckets[bucket][key] = &object
+}
+
+// Keys returns the keys in bucket, sorted.
+func (s *Server) Keys(bucket string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.Sorted(maps.Keys(s.buckets[bucket]))
+}
+
+// Uploads returns how many multipart uploads are in progress.
+func (s *Server) Uploads() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.uploads)
+}
+
+func etag(data []byte) string {
+	//nolint:gosec // ETags are MD5 sums
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	op := operation(r, key, query)
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts[op]++
+	if s.fail != nil {
+		if status := s.fail(op, r); status != 0 {
+			writeError(w, status, errorCode(status))
+			return
+		}
+	}
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch op {
+	case OpHeadBucket:
+	case OpListObjects:
+		s.listObjects(w, bucket, objects, query.Get("prefix"))
+	case OpListUploads:
+		s.listUploads(w, bucket)
+	case OpDeleteObjects:
+		deleteObjects(w, objects, body)
+	case OpHeadObject, OpGetObject:
+		getObject(w, r, objects[key], op == OpGetObject)
+	case OpPutObject:
+		s.putObject(w, r, objects, key, body)
+	case OpDeleteObject:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case OpCreateUpload:
+		s.createUpload(w, r, bucket, key)
+	default:
+		s.multipart(w, r, op, objects, body)
+	}
+}
+
+// operation names the S3 operation of r.
+func operation(r *http.Request, key string, query map[string][]string) string {
+	has := func(name string) bool { _, ok := query[name]; return ok }
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		return OpHeadBucket
+	case key == "" && r.Method == http.MethodGet && has("uploads"):
+		return OpListUploads
+	case key == "" && r.Method == http.MethodGet:
+		return OpListObjects
+	case key == "" && r.Method == http.MethodPost:
+		return OpDeleteObjects
+	case r.Method == http.MethodPost && has("uploads"):
+		return OpCreateUpload
+	case r.Method == http.MethodPut && has("uploadId"):
+		return OpUploadPart
+	case r.Method == http.MethodGet && has("uploadId"):
+		return OpListParts
+	case r.Method == http.MethodPost && has("uploadId"):
+		return OpCompleteUpload
+	case r.Method == http.MethodDelete && has("uploadId"):
+		return OpAbortUpload
+	case r.Method == http.MethodHead:
+		return OpHeadObject
+	case r.Method == http.MethodGet:
+		return OpGetObject
+	case r.Method == http.MethodPut:
+		return OpPutObject
+	default:
+		return OpDeleteObject
+	}
+}
+
+// readBody reads the body of r, decoding the aws-chunked encoding the SDK
+// uses for trailing checksums.
+func readBody(r *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil || r.Header.Get("X-Amz-Decoded-Content-Length") == "" {
+		return data, err
+	}
+	var decoded []byte
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return decoded, nil
+		}
+		chunk := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, chunk[:n]...)
+	}
+}
+
+// errorCode returns the S3 error code of an injected failure.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusForbidden:
+		return "AccessDenied"
+	case http.StatusInternalServerError:
+		return "InternalError"
+	case http.StatusServiceUnavailable:
+		return "SlowDown"
+	default:
+		return "InvalidRequest"
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(data)
+}
+
+// objectFrom reads what a put or a created upload stores from the headers.
+func objectFrom(r *http.Request) Object {
+	object := Object{
+		ContentType: r.Header.Get("Content-Type"),
+		Metadata:    map[string]string{},
+		Modified:    time.Now(),
+	}
+	var encodings []string
+	for _, encoding := range strings.Split(r.Header.Get("Content-Encoding"), ",") {
+		if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	object.ContentEncoding = strings.Join(encodings, ", ")
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, metadataPrefix) {
+			object.Metadata[strings.ToLower(name[len(metadataPrefix):])] = values[0]
+		}
+	}
+	return object
+}
+
+// precondition reports whether a write may replace what is at key.
+func precondition(r *http.Request, objects map[string]*Object, key string) bool {
+	_, exists := objects[key]
+	return r.Header.Get("If-None-Match") != "*" || !exists
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string, body []byte) {
+	if !precondition(r, objects, key) {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	object := objectFrom(r)
+	object.Data = body
+	object.ETag = etag(body)
+	objects[key] = &object
+	w.Header().Set("ETag", object.ETag)
+}
+
+func getObject(w http.ResponseWriter, r *http.Request, object *Object, get bool) {
+	if object == nil {
+		if get {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != object.ETag {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	header := w.Header()
+	header.Set("ETag", object.ETag)
+	header.Set("Last-Modified", object.Modified.UTC().Format(http.TimeFormat))
+	if object.ContentType != "" {
+		header.Set("Content-Type", object.ContentType)
+	}
+	if object.ContentEncoding != "" {
+		header.Set("Content-Encoding", object.ContentEncoding)
+	}
+	for name, value := range object.Metadata {
+		header.Set(metadataPrefix+name, value)
+	}
+	data, status := object.Data, http.StatusOK
+	if start, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok && get {
+		from, to, _ := strings.Cut(start, "-")
+		first, _ := strconv.Atoi(from)
+		last := len(data) - 1
+		if to != "" {
+			last, _ = strconv.Atoi(to)
+		}
+		last = min(last, len(data)-1)
+		if first > last {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+		data, status = data[first:last+1], http.StatusPartialContent
+	}
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if get {
+		_, _ = w.Write(data)
+	}
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []listEntry
+}
+
+type listEntry struct {
+	Key          string
+	Size         int
+	ETag         string
+	LastModified string
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, bucket string, objects map[string]*Object, prefix string) {
+	result := listBucketResult{Name: bucket, Prefix: prefix}
+	for _, key := range slices.Sorted(maps.Keys(objects)) {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		object := objects[key]
+		result.Contents = append(result.Contents, listEntry{
+			Key:          key,
+			Size:         len(object.Data),
+			ETag:         object.ETag,
+			LastModified: object.Modified.UTC().Format(time.RFC3339),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []struct {
+		Key string
+	}
+}
+
+func deleteObjects(w http.ResponseWriter, objects map[string]*Object, body []byte) {
+	var request deleteRequest
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var result deleteResult
+	for _, object := range request.Objects {
+		delete(objects, object.Key)
+		result.Deleted = append(result.Deleted, struct{ Key string }{object.Key})
+	}
+	writeXML(w, result)
+}
+
+type listUploadsResult struct {
+	XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+	Bucket      string
+	IsTruncated bool
+	Uploads     []uploadEntry `xml:"Upload"`
+}
+
+type uploadEntry struct {
+	Key       string
+	UploadId  string //nolint:revive,stylecheck // the S3 element name
+	Initiated string
+}
+
+func (s *Server) listUploads(w http.ResponseWriter, bucket string) {
+	result := listUploadsResult{Bucket: bucket}
+	for _, id := range slices.Sorted(maps.Keys(s.uploads)) {
+		upload := s.uploads[id]
+		if upload.bucket == bucket {
+			result.Uploads = append(result.Uploads, uploadEntry{Key: upload.key, UploadId: id, Initiated: upload.initiated.UTC().Format(time.RFC3339)})
+		}
+	}
+	writeXML(w, result)
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string //nolint:revive,stylecheck // the S3 element name
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = &upload{bucket: bucket, key: key, object: objectFrom(r), parts: map[int]*part{}, initiated: time.Now()}
+	writeXML(w, initiateResult{Bucket: bucket, Key: key, UploadId: id})
+}
+
+type listPartsResult struct {
+	XMLName     xml.Name `xml:"ListPartsResult"`
+	Bucket      string
+	Key         string
+	UploadId    string //nolint:revive,stylecheck // the S3 element name
+	IsTruncated bool
+	Parts       []partEntry `xml:"Part"`
+}
+
+type partEntry struct {
+	PartNumber     int
+	ETag           string
+	Size           int
+	ChecksumCRC32  string `xml:",omitempty"`
+	ChecksumCRC32C string `xml:",omitempty"`
+	ChecksumSHA1   string `xml:",omitempty"`
+	ChecksumSHA256 string `xml:",omitempty"`
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+// multipart answers the requests on an upload in progress.
+func (s *Server) multipart(w http.ResponseWriter, r *http.Request, op string, objects map[string]*Object, body []byte) {
+	id := r.URL.Query().Get("uploadId")
+	upload, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch op {
+	case OpUploadPart:
+		number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		p := &part{data: body, etag: etag(body), checksum: http.Header{}}
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Checksum-") && name != "X-Amz-Checksum-Algorithm" {
+				p.checksum.Set(name, values[0])
+				w.Header().Set(name, values[0])
+			}
+		}
+		upload.parts[number] = p
+		w.Header().Set("ETag", p.etag)
+	case OpListParts:
+		result := listPartsResult{Bucket: upload.bucket, Key: upload.key, UploadId: id}
+		for _, number := range slices.Sorted(maps.Keys(upload.parts)) {
+			p := upload.parts[number]
+			result.Parts = append(result.Parts, partEntry{
+				PartNumber:     number,
+				ETag:           p.etag,
+				Size:           len(p.data),
+				ChecksumCRC32:  p.checksum.Get("X-Amz-Checksum-Crc32"),
+				ChecksumCRC32C: p.checksum.Get("X-Amz-Checksum-Crc32c"),
+				ChecksumSHA1:   p.checksum.Get("X-Amz-Checksum-Sha1"),
+				ChecksumSHA256: p.checksum.Get("X-Amz-Checksum-Sha256"),
+			})
+		}
+		writeXML(w, result)
+	case OpCompleteUpload:
+		var request completeRequest
+		if err := xml.Unmarshal(body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		if !precondition(r, objects, upload.key) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		object := upload.object
+		var sums []byte
+		for i, requested := range request.Parts {
+			p, ok := upload.parts[requested.PartNumber]
+			if !ok || p.etag != requested.ETag || requested.PartNumber != i+1 {
+				writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object.Data = append(object.Data, p.data...)
+			sum, _ := hex.DecodeString(strings.Trim(p.etag, `"`))
+			sums = append(sums, sum...)
+		}
+		object.ETag = fmt.Sprintf(`"%s-%d"`, strings.Trim(etag(sums), `"`), len(request.Parts))
+		object.Modified = time.Now()
+		objects[upload.key] = &object
+		delete(s.uploads, id)
+		writeXML(w, completeResult{Bucket: upload.bucket, Key: upload.key, ETag: object.ETag})
+	case OpAbortUpload:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
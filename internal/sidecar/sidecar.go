@@ -0,0 +1,124 @@
+package sidecar
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+)
+
+//nolint:gochecknoglobals
+var logger = logging.For("sidecar")
+
+// settle is how long a sidecar shared by the directory must go unmodified
+// before it is uploaded with a frame, so a session log is not read halfway
+// through a write. It matches the debounce of the watcher.
+const settle = 5 * time.Second
+
+// Group returns the frame at path followed by every sidecar file that
+// belongs to it according to the configured rules. Sidecars shared by the
+// directory that were modified within the last few seconds are left out,
+// the next frame or the complete marker picks them up.
+func Group(path string, rules []config.Sidecar) []string {
+	group := []string{path}
+	if len(rules) == 0 {
+		return group
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		logger.Error("failed to read directory for sidecars", "path", path, "error", err)
+		return group
+	}
+
+	// A sidecar named after the frame, e.g. frame.json or frame.fits.txt
+	// both belong to frame.fits
+	prefix := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + "."
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == filepath.Base(path) {
+			continue
+		}
+		for _, rule := range rules {
+			if !slices.Contains(rule.Extensions, filepath.Ext(entry.Name())) {
+				continue
+			}
+			if strings.HasPrefix(entry.Name(), prefix) || (rule.Match == config.SidecarMatchDirectory && settled(entry)) {
+				group = append(group, filepath.Join(filepath.Dir(path), entry.Name()))
+				break
+			}
+		}
+	}
+	return group
+}
+
+// settled reports whether entry has not been modified for a while.
+func settled(entry os.DirEntry) bool {
+	info, err := entry.Info()
+	return err == nil && time.Since(info.ModTime()) >= settle
+}
+
+// Owned returns the frame of a group and the sidecars named after it, which
+// belong to the frame alone. The others are shared by the directory, such as
+// the session log N.I.N.A. keeps appending to, and must stay where they are
+// when the frame is moved or deleted. They are handled on their own once the
+// directory is complete.
+func Owned(group []string) []string {
+	if len(group) == 0 {
+		return nil
+	}
+	frame := group[0]
+	prefix := strings.TrimSuffix(filepath.Base(frame), filepath.Ext(frame)) + "."
+	owned := []string{frame}
+	for _, path := range group[1:] {
+		if filepath.Dir(path) == filepath.Dir(frame) && strings.HasPrefix(filepath.Base(path), prefix) {
+			owned = append(owned, path)
+		}
+	}
+	return owned
+}
+
+// Leftovers returns the sidecar files remaining in dir, regardless of
+// whether a frame is still present to group them with.
+func Leftovers(dir string, rules []config.Sidecar) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Error("failed to read directory for sidecars", "path", dir, "error", err)
+		return nil
+	}
+
+	var leftovers []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if IsSidecar(entry.Name(), rules) {
+			leftovers = append(leftovers, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return leftovers
+}
+
+// IsSidecar reports whether the file name matches any sidecar rule.
+func IsSidecar(name string, rules []config.Sidecar) bool {
+	for _, rule := range rules {
+		if slices.Contains(rule.Extensions, filepath.Ext(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Size returns the total size of the files of a group that still exist.
+func Size(group []string) int64 {
+	var size int64
+	for _, path := range group {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
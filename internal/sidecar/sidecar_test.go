@@ -0,0 +1,64 @@
+package sidecar_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/sidecar"
+)
+
+func TestGroup(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Minute)
+	for _, name := range []string{"a.fits", "a.json", "a.fits.txt", "b.fits", "b.json", "session.csv", "writing.csv"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if name != "writing.csv" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	frame := filepath.Join(dir, "a.fits")
+	paths := func(names ...string) []string {
+		var paths []string
+		for _, name := range names {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+		return paths
+	}
+
+	basename := []config.Sidecar{{Extensions: []string{".json", ".txt"}, Match: config.SidecarMatchBasename}}
+	if got, want := sidecar.Group(frame, basename), paths("a.fits", "a.fits.txt", "a.json"); !slices.Equal(got, want) {
+		t.Fatalf("basename group = %v, want %v", got, want)
+	}
+
+	// A file still being written is left for a later frame
+	directory := []config.Sidecar{{Extensions: []string{".csv"}, Match: config.SidecarMatchDirectory}}
+	group := sidecar.Group(frame, directory)
+	if want := paths("a.fits", "session.csv"); !slices.Equal(group, want) {
+		t.Fatalf("directory group = %v, want %v", group, want)
+	}
+	if got := sidecar.Owned(group); !slices.Equal(got, paths("a.fits")) {
+		t.Fatalf("shared sidecar is owned by the frame: %v", got)
+	}
+
+	both := slices.Concat(basename, directory)
+	group = sidecar.Group(frame, both)
+	if got, want := sidecar.Owned(group), paths("a.fits", "a.fits.txt", "a.json"); !slices.Equal(got, want) {
+		t.Fatalf("owned = %v, want %v", got, want)
+	}
+	if got := sidecar.Leftovers(dir, both); len(got) != 5 {
+		t.Fatalf("leftovers = %v", got)
+	}
+	if got := sidecar.Group(frame, nil); !slices.Equal(got, paths("a.fits")) {
+		t.Fatalf("group without rules = %v", got)
+	}
+}
@@ -0,0 +1,42 @@
+package uploader
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileCache remembers what was learned from reading files, by path, so a
+// retried upload of a file that has not changed since does not read it all
+// again.
+type fileCache[T any] struct {
+	entries sync.Map
+}
+
+type cachedFile[T any] struct {
+	size    int64
+	modTime time.Time
+	value   T
+}
+
+// get returns the value for the file at path, calling read only if the file
+// changed since the value was stored. Errors are not remembered.
+func (c *fileCache[T]) get(path string, info os.FileInfo, read func() (T, error)) (T, error) {
+	if cached, ok := c.entries.Load(path); ok {
+		cached := cached.(cachedFile[T])
+		if cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+			return cached.value, nil
+		}
+	}
+	value, err := read()
+	if err != nil {
+		return value, err
+	}
+	c.entries.Store(path, cachedFile[T]{size: info.Size(), modTime: info.ModTime(), value: value})
+	return value, nil
+}
+
+// forget drops what was learned about the file at path once it is uploaded.
+func (c *fileCache[T]) forget(path string) {
+	c.entries.Delete(path)
+}
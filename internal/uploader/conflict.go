@@ -0,0 +1,129 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// MetadataSHA256 is the user metadata key holding the hex SHA-256 of the
+// uploaded file.
+const MetadataSHA256 = "sha256"
+
+// MetadataSourceSHA256 is the user metadata key holding the hex SHA-256 of
+// the file itself, set when pipeline stages changed it before it was
+// encoded, i.e. by injecting header keywords.
+const MetadataSourceSHA256 = "source-sha256"
+
+// maxRenameAttempts bounds the search for a free key under the rename policy.
+const maxRenameAttempts = 1000
+
+// ErrObjectExists is returned when the conflict policy refuses to replace a
+// differing object. Retrying will not help.
+var ErrObjectExists = errors.New("a different object already exists at the key")
+
+// fileSHA256 hashes r and rewinds it.
+func fileSHA256(r io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// resolveConflict applies the conflict policy to input, possibly changing its
+// key or making the write conditional. It reports whether the upload can be
+// skipped because an identical object already exists.
+func (u *uploadJob) resolveConflict(ctx context.Context, input *s3.PutObjectInput, size int64, sum string) (bool, error) {
+	policy := u.config.Uploader.Conflict
+	if policy == config.ConflictOverwrite {
+		return false, nil
+	}
+
+	exists, identical, err := u.compareObject(ctx, aws.ToString(input.Bucket), aws.ToString(input.Key), size, sum, false)
+	if err != nil {
+		return false, err
+	}
+	if identical {
+		return true, nil
+	}
+
+	switch policy {
+	case config.ConflictSkip, config.ConflictOverwrite:
+		return false, nil
+	case config.ConflictFail:
+		if exists {
+			return false, fmt.Errorf("%w: %s", ErrObjectExists, aws.ToString(input.Key))
+		}
+	case config.ConflictRename:
+		key := aws.ToString(input.Key)
+		for i := 1; exists && i <= maxRenameAttempts; i++ {
+			candidate := renamedKey(key, i)
+			exists, identical, err = u.compareObject(ctx, aws.ToString(input.Bucket), candidate, size, sum, false)
+			if err != nil {
+				return false, err
+			}
+			if identical {
+				return true, nil
+			}
+			input.Key = aws.String(candidate)
+		}
+		if exists {
+			return false, fmt.Errorf("%w: no free key found for %s", ErrObjectExists, key)
+		}
+	}
+
+	// Guard against another writer creating the key between the check and
+	// the write
+	input.IfNoneMatch = aws.String("*")
+	return false, nil
+}
+
+// compareObject reports whether an object exists at key and whether it has
+// the given size and checksum. With source set, sum is that of the file
+// itself, which objects whose header the pipeline changed record apart from
+// the checksum of what a download restores. Encoded objects and those are
+// compared by checksum alone. Objects uploaded without a checksum are never
+// identical, as the same size says nothing about the content.
+func (u *uploadJob) compareObject(ctx context.Context, bucket, key string, size int64, sum string, source bool) (bool, bool, error) {
+	headInput := &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	u.encryption.applyHead(headInput)
+	out, err := u.s3Client.HeadObject(ctx, headInput)
+	if isAPIError(err, "NotFound") || isAPIError(err, "NoSuchKey") {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, fmt.Errorf("failed to check for existing object: %w", err)
+	}
+	remote, ok := out.Metadata[MetadataSHA256]
+	if original, changed := out.Metadata[MetadataSourceSHA256]; source && changed {
+		return true, original == sum, nil
+	}
+	if encoding := aws.ToString(out.ContentEncoding); encoding != "" && !strings.EqualFold(encoding, encodingIdentity) {
+		// The stored size is the encoded one, only the checksum of the
+		// original tells
+		return true, ok && remote == sum, nil
+	}
+	if aws.ToInt64(out.ContentLength) != size {
+		return true, false, nil
+	}
+	return true, ok && remote == sum, nil
+}
+
+// renamedKey inserts a numeric suffix before the extension, so frame.fits
+// becomes frame-1.fits.
+func renamedKey(key string, n int) string {
+	ext := path.Ext(key)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(key, ext), n, ext)
+}
@@ -0,0 +1,42 @@
+package uploader_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/s3test"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+)
+
+func TestConflictSkip(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	u, dir := newUploader(t, server, "bucket", func(cfg *config.Config) { cfg.Uploader.Conflict = config.ConflictSkip })
+	path := filepath.Join(dir, "a.fits")
+	data := writeRandom(t, path, 1024)
+	sum := sha256.Sum256(data)
+
+	// An object of the same size without a checksum may differ
+	server.Put("bucket", "a.fits", s3test.Object{Data: make([]byte, len(data))})
+	if err := u.Upload(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	object, _ := server.Object("bucket", "a.fits")
+	if !bytes.Equal(object.Data, data) || server.Count(s3test.OpPutObject) != 1 {
+		t.Fatal("object without a checksum was taken as identical")
+	}
+
+	// One with the same checksum is not uploaded again
+	server.Put("bucket", "a.fits", s3test.Object{Data: data, Metadata: map[string]string{uploader.MetadataSHA256: hex.EncodeToString(sum[:])}})
+	if err := u.Upload(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	if server.Count(s3test.OpPutObject) != 1 {
+		t.Fatal("identical object uploaded again")
+	}
+}
@@ -0,0 +1,109 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/bandwidth"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const defaultRoleSessionName = "nina-s3-uploader"
+
+// loadAWSConfig builds the AWS config from the configured credentials and
+// returns a description of the credential source for the startup check.
+func loadAWSConfig(ctx context.Context, cfg config.S3, limiter *bandwidth.Limiter) (aws.Config, string, error) {
+	creds := cfg.Credentials
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return aws.Config{}, "", err
+	}
+	opts := []func(*awsConfig.LoadOptions) error{
+		awsConfig.WithRegion(cfg.Region),
+		awsConfig.WithHTTPClient(httpClient),
+	}
+	source := "default credential chain"
+
+	if creds.Profile != "" {
+		opts = append(opts, awsConfig.WithSharedConfigProfile(creds.Profile))
+		source = fmt.Sprintf("profile %s", creds.Profile)
+	}
+
+	accessKeyID, err := readSecret(creds.AccessKeyID, creds.AccessKeyIDFile)
+	if err != nil {
+		return aws.Config{}, "", fmt.Errorf("failed to read access key ID: %w", err)
+	}
+	secretAccessKey, err := readSecret(creds.SecretAccessKey, creds.SecretAccessKeyFile)
+	if err != nil {
+		return aws.Config{}, "", fmt.Errorf("failed to read secret access key: %w", err)
+	}
+	sessionToken, err := readSecret(creds.SessionToken, creds.SessionTokenFile)
+	if err != nil {
+		return aws.Config{}, "", fmt.Errorf("failed to read session token: %w", err)
+	}
+	if accessKeyID != "" {
+		opts = append(opts, awsConfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, sessionToken)))
+		source = "static key"
+	}
+
+	awsCfg, err := awsConfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, "", err
+	}
+	// Wrapped after loading, as loading applies AWS_CA_BUNDLE to the client's
+	// transport, which the wrapper would hide
+	awsCfg.HTTPClient = limiter.Client(awsCfg.HTTPClient)
+
+	switch {
+	case creds.AssumeRole.RoleARN != "":
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), creds.AssumeRole.RoleARN,
+			func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = sessionName(creds.AssumeRole.SessionName)
+				if creds.AssumeRole.ExternalID != "" {
+					o.ExternalID = aws.String(creds.AssumeRole.ExternalID)
+				}
+				if creds.AssumeRole.Duration > 0 {
+					o.Duration = creds.AssumeRole.Duration
+				}
+			})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+		source = fmt.Sprintf("assume role %s via %s", creds.AssumeRole.RoleARN, source)
+	case creds.WebIdentity.RoleARN != "":
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(awsCfg), creds.WebIdentity.RoleARN,
+			stscreds.IdentityTokenFile(creds.WebIdentity.TokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = sessionName(creds.WebIdentity.SessionName)
+			})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+		source = fmt.Sprintf("web identity %s", creds.WebIdentity.RoleARN)
+	}
+
+	return awsCfg, source, nil
+}
+
+// readSecret returns value, or the trimmed contents of file when set.
+func readSecret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func sessionName(name string) string {
+	if name == "" {
+		return defaultRoleSessionName
+	}
+	return name
+}
@@ -0,0 +1,293 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fsutil"
+	"github.com/USA-RedDragon/nina-s3-uploader/pkg/pipeline"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Content encodings a download can reverse
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+)
+
+// ErrChecksumMismatch is returned when a downloaded object does not match the
+// checksum recorded when it was uploaded.
+var ErrChecksumMismatch = errors.New("Downloaded object does not match its checksum")
+
+// ErrUnsupportedEncoding is returned for objects stored with a content
+// encoding the downloader cannot reverse.
+var ErrUnsupportedEncoding = errors.New("Unsupported content encoding")
+
+// ObjectInfo is what a HEAD request tells about an object.
+type ObjectInfo struct {
+	Size     int64
+	ETag     string
+	Encoding string
+	Metadata map[string]string
+}
+
+// Head returns the size, encoding and metadata of the object at key.
+func (u *Uploader) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	input := &s3.HeadObjectInput{Bucket: aws.String(u.config.S3.Bucket), Key: aws.String(key)}
+	u.encryption.applyHead(input)
+	out, err := u.s3Client.HeadObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to head object: %w", err)
+	}
+	return &ObjectInfo{
+		Size:     aws.ToInt64(out.ContentLength),
+		ETag:     aws.ToString(out.ETag),
+		Encoding: strings.ToLower(aws.ToString(out.ContentEncoding)),
+		Metadata: out.Metadata,
+	}, nil
+}
+
+// Download downloads the object at key to dst. An interrupted download is
+// resumed where it stopped as long as the object has not changed since. Any
+// content encoding is reversed and the result is checked against the
+// checksum recorded at upload before it replaces dst. It reports false,
+// without downloading anything, if dst already matches the object.
+func (u *Uploader) Download(ctx context.Context, key, dst string) (bool, error) {
+	info, err := u.Head(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	decoders, err := u.decoders(info.Encoding)
+	if err != nil {
+		return false, err
+	}
+	if downloaded(dst, info) {
+		return false, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0o755)
+	if err != nil {
+		return false, err
+	}
+	partial := partialPath(dst, info.ETag)
+	removeStalePartials(dst, partial)
+	err = u.fetch(ctx, key, info, partial)
+	if err != nil {
+		return false, err
+	}
+	err = finishDownload(partial, dst, info, decoders)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// downloaded reports whether dst already holds the object by checksum.
+// Objects uploaded without one are downloaded again, as the same size says
+// nothing about the content.
+func downloaded(dst string, info *ObjectInfo) bool {
+	sum, ok := info.Metadata[MetadataSHA256]
+	if !ok {
+		return false
+	}
+	file, err := os.Open(dst)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	local, err := fileSHA256(file)
+	return err == nil && local == sum
+}
+
+// partialPath names the partial download of dst after the ETag of the
+// object, so a partial download of an object that was since replaced is
+// not resumed.
+func partialPath(dst, etag string) string {
+	sum := sha256.Sum256([]byte(etag))
+	return dst + "." + hex.EncodeToString(sum[:])[:12] + fsutil.PartialSuffix
+}
+
+// removeStalePartials removes partial downloads of dst other than keep.
+func removeStalePartials(dst, keep string) {
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		return
+	}
+	prefix := filepath.Base(dst) + "."
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, fsutil.PartialSuffix) || name == filepath.Base(keep) {
+			continue
+		}
+		path := filepath.Join(filepath.Dir(dst), name)
+		if err := os.Remove(path); err != nil {
+			logger.Warn("failed to remove stale partial download", "path", path, "error", err)
+		}
+	}
+}
+
+// fetch appends the bytes of the object that partial is missing.
+func (u *Uploader) fetch(ctx context.Context, key string, info *ObjectInfo, partial string) error {
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > info.Size {
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if offset, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if offset == info.Size {
+		return file.Close()
+	}
+
+	input := &s3.GetObjectInput{Bucket: aws.String(u.config.S3.Bucket), Key: aws.String(key)}
+	if info.ETag != "" {
+		input.IfMatch = aws.String(info.ETag)
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	u.encryption.applyGet(input)
+	// The checksum recorded at upload is verified once the whole file is
+	// here, the SDK cannot verify a range against a full object checksum
+	out, err := u.s3Client.GetObject(ctx, input, func(o *s3.Options) {
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		o.DisableLogOutputChecksumValidationSkipped = true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get object: %w", err)
+	}
+	defer out.Body.Close()
+	_, err = io.Copy(file, out.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download object: %w", err)
+	}
+	return file.Close()
+}
+
+// encoded reports whether a content encoding changes the stored bytes.
+func encoded(encoding string) bool {
+	return encoding != "" && encoding != encodingIdentity
+}
+
+// decoders returns the decoders that reverse encoding, a list of content
+// encodings in the order they were applied, in the order to apply them.
+// Gzip can always be reversed, the other encodings only by a stage of the
+// configured pipeline, i.e. with the key of the encrypt stage.
+func (u *Uploader) decoders(encoding string) ([]pipeline.Decoder, error) {
+	if !encoded(encoding) {
+		return nil, nil
+	}
+	var decoders []pipeline.Decoder
+	encodings := strings.Split(encoding, ",")
+	for _, name := range slices.Backward(encodings) {
+		name = strings.TrimSpace(name)
+		if name == encodingIdentity {
+			continue
+		}
+		decoder := u.pipeline.Decoder(name)
+		if decoder == nil && name == encodingGzip {
+			decoder, _ = pipeline.Gzip().(pipeline.Decoder)
+		}
+		if decoder == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, name)
+		}
+		decoders = append(decoders, decoder)
+	}
+	return decoders, nil
+}
+
+// finishDownload decodes partial into dst, verifying the checksum on the
+// way. A partial download that fails verification is removed so the next
+// attempt starts over.
+func finishDownload(partial, dst string, info *ObjectInfo, decoders []pipeline.Decoder) error {
+	sum, verify := info.Metadata[MetadataSHA256]
+	if len(decoders) == 0 {
+		file, err := os.Open(partial)
+		if err != nil {
+			return err
+		}
+		local, err := fileSHA256(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if verify && local != sum {
+			os.Remove(partial)
+			return fmt.Errorf("%w: %s", ErrChecksumMismatch, dst)
+		}
+		return os.Rename(partial, dst)
+	}
+
+	decoded, err := decode(partial, dst, decoders)
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	file, err := os.Open(decoded)
+	if err != nil {
+		return err
+	}
+	local, err := fileSHA256(file)
+	file.Close()
+	if err == nil && verify && local != sum {
+		err = fmt.Errorf("%w: %s", ErrChecksumMismatch, dst)
+	}
+	if err == nil {
+		err = os.Rename(decoded, dst)
+	}
+	if err != nil {
+		os.Remove(decoded)
+		os.Remove(partial)
+		return err
+	}
+	return os.Remove(partial)
+}
+
+// decode reverses the content encodings of partial into a temporary file
+// next to dst and returns its path.
+func decode(partial, dst string, decoders []pipeline.Decoder) (string, error) {
+	source, err := os.Open(partial)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	var reader io.Reader = source
+	for _, decoder := range decoders {
+		reader, err = decoder.Decode(reader)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode object: %w", err)
+		}
+	}
+	destination, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*"+fsutil.PartialSuffix)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(destination, reader) //nolint:gosec // the object was encoded by the uploader
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destination.Name())
+		return "", fmt.Errorf("failed to decode object: %w", err)
+	}
+	return destination.Name(), nil
+}
@@ -0,0 +1,114 @@
+package uploader_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fsutil"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/s3test"
+)
+
+func TestDownloadResume(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	u, dir := newUploader(t, server, "bucket", nil)
+	path := filepath.Join(dir, "a.fits")
+	data := writeRandom(t, path, 64*1024)
+	if err := u.Upload(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var ranges []string
+	failing := true
+	server.FailWhen(func(op string, r *http.Request) int {
+		if op != s3test.OpGetObject {
+			return 0
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		if failing {
+			return http.StatusForbidden
+		}
+		return 0
+	})
+
+	// A failed download leaves its partial file behind, half of which is
+	// taken to have arrived before an interruption
+	dst := filepath.Join(t.TempDir(), "restore", "a.fits")
+	if _, err := u.Download(context.Background(), "a.fits", dst); err == nil {
+		t.Fatal("download succeeded despite a failed request")
+	}
+	partials, _ := filepath.Glob(dst + ".*" + fsutil.PartialSuffix)
+	if len(partials) != 1 {
+		t.Fatalf("partial downloads %v", partials)
+	}
+	if err := os.WriteFile(partials[0], data[:len(data)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	failing, ranges = false, nil
+	lock.Unlock()
+	downloaded, err := u.Download(context.Background(), "a.fits", dst)
+	if err != nil || !downloaded {
+		t.Fatalf("resumed download: %v, downloaded %v", err, downloaded)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=32768-" {
+		t.Fatalf("resumed download requested %q", ranges)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("resumed download differs from the file: %v", err)
+	}
+	if partials, _ := filepath.Glob(dst + ".*" + fsutil.PartialSuffix); len(partials) != 0 {
+		t.Fatalf("partial downloads left behind: %v", partials)
+	}
+
+	// A file that is already there is not downloaded again
+	downloaded, err = u.Download(context.Background(), "a.fits", dst)
+	if err != nil || downloaded {
+		t.Fatalf("second download: %v, downloaded %v", err, downloaded)
+	}
+}
+
+func TestDownloadGzip(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	u, dir := newUploader(t, server, "bucket", func(cfg *config.Config) {
+		cfg.Rules = []config.Rule{{Object: config.ObjectOptions{Compression: config.CompressionGzip}}}
+	})
+	path := filepath.Join(dir, "a.fits")
+	data := bytes.Repeat([]byte("M31 "), 16*1024)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Upload(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	object, _ := server.Object("bucket", "a.fits")
+	if object.ContentEncoding != "gzip" || len(object.Data) >= len(data) {
+		t.Fatalf("object stored with encoding %q and %d bytes", object.ContentEncoding, len(object.Data))
+	}
+	// The stored size is the compressed one, the checksum still matches
+	exists, identical, err := u.Compare(context.Background(), "bucket", "a.fits", path)
+	if err != nil || !exists || !identical {
+		t.Fatalf("compressed object compared as exists %v, identical %v: %v", exists, identical, err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "a.fits")
+	if _, err := u.Download(context.Background(), "a.fits", dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("download was not decoded: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/md5" //nolint:gosec // SSE-C requires the MD5 digest of the key
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const sseCustomerAlgorithm = "AES256"
+
+// encryption holds the resolved server-side encryption settings so the
+// SSE-C key file is only read once.
+type encryption struct {
+	config         config.Encryption
+	customerKey    string
+	customerKeyMD5 string
+}
+
+func newEncryption(cfg config.Encryption) (*encryption, error) {
+	enc := &encryption{config: cfg}
+	if cfg.Mode != config.EncryptionModeSSEC {
+		return enc, nil
+	}
+
+	data, err := os.ReadFile(cfg.CustomerKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSE-C customer key: %w", err)
+	}
+	key := data
+	if len(key) != 32 {
+		key, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil {
+			return nil, fmt.Errorf("SSE-C customer key must be 32 raw bytes or base64 encoded: %w", err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("SSE-C customer key must be 256 bits, got %d bits", len(key)*8)
+	}
+
+	sum := md5.Sum(key) //nolint:gosec // SSE-C requires the MD5 digest of the key
+	enc.customerKey = base64.StdEncoding.EncodeToString(key)
+	enc.customerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	return enc, nil
+}
+
+func (e *encryption) applyPut(input *s3.PutObjectInput) {
+	switch e.config.Mode {
+	case config.EncryptionModeSSES3:
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	case config.EncryptionModeSSEKMS:
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		if e.config.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(e.config.KMSKeyID)
+		}
+		if e.config.BucketKey {
+			input.BucketKeyEnabled = aws.Bool(true)
+		}
+	case config.EncryptionModeSSEC:
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(e.customerKey)
+		input.SSECustomerKeyMD5 = aws.String(e.customerKeyMD5)
+	case config.EncryptionModeNone:
+	}
+}
+
+// applyHead sets the SSE-C key, without which S3 refuses to HEAD an SSE-C
+// object. The other modes need nothing on reads.
+func (e *encryption) applyHead(input *s3.HeadObjectInput) {
+	if e.config.Mode == config.EncryptionModeSSEC {
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(e.customerKey)
+		input.SSECustomerKeyMD5 = aws.String(e.customerKeyMD5)
+	}
+}
+
+func (e *encryption) applyUploadPart(input *s3.UploadPartInput) {
+	if e.config.Mode == config.EncryptionModeSSEC {
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(e.customerKey)
+		input.SSECustomerKeyMD5 = aws.String(e.customerKeyMD5)
+	}
+}
+
+func (e *encryption) applyListParts(input *s3.ListPartsInput) {
+	if e.config.Mode == config.EncryptionModeSSEC {
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(e.customerKey)
+		input.SSECustomerKeyMD5 = aws.String(e.customerKeyMD5)
+	}
+}
+
+func (e *encryption) applyComplete(input *s3.CompleteMultipartUploadInput) {
+	if e.config.Mode == config.EncryptionModeSSEC {
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(e.customerKey)
+		input.SSECustomerKeyMD5 = aws.String(e.customerKeyMD5)
+	}
+}
+
+// applyGet sets the SSE-C key, without which S3 refuses to return an SSE-C
+// object. S3 decrypts the other modes itself.
+func (e *encryption) applyGet(input *s3.GetObjectInput) {
+	if e.config.Mode == config.EncryptionModeSSEC {
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(e.customerKey)
+		input.SSECustomerKeyMD5 = aws.String(e.customerKeyMD5)
+	}
+}
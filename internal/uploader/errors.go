@@ -0,0 +1,74 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// permanentErrorCodes are S3 error codes that retrying will not fix, mostly
+// authentication, permission and request validity problems. Other 403s, such
+// as an expired token or a skewed clock, and throttling, KMS's included, go
+// away on their own.
+//
+//nolint:gochecknoglobals
+var permanentErrorCodes = []string{
+	"AccessDenied",
+	"AccountProblem",
+	"AllAccessDisabled",
+	"InvalidAccessKeyId",
+	"InvalidToken",
+	"SignatureDoesNotMatch",
+	"NoSuchBucket",
+	"InvalidBucketName",
+	"InvalidArgument",
+	"InvalidRequest",
+	"InvalidStorageClass",
+	"InvalidTag",
+	"EntityTooLarge",
+	"KeyTooLongError",
+	"MetadataTooLarge",
+	"KMS.AccessDeniedException",
+	"KMS.DisabledException",
+	"KMS.InvalidKeyUsageException",
+	"KMS.KMSInvalidStateException",
+	"KMS.NotFoundException",
+}
+
+// IsPermanent classifies an upload error. Permanent errors, such as missing
+// permissions, will fail again on retry. Everything else, such as network
+// errors, throttling and server errors, is treated as transient.
+func IsPermanent(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrObjectExists) || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return slices.Contains(permanentErrorCodes, apiErr.ErrorCode())
+	}
+	return false
+}
+
+// IsUnreachable reports whether an upload or probe failed because the S3
+// endpoint could not be reached at all, as opposed to the endpoint answering
+// with an error.
+func IsUnreachable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var sendErr *smithyhttp.RequestSendError
+	if errors.As(err, &sendErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
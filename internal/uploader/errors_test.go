@@ -0,0 +1,34 @@
+package uploader_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+	"github.com/aws/smithy-go"
+)
+
+func TestIsPermanent(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&smithy.GenericAPIError{Code: "AccessDenied"}, true},
+		{&smithy.GenericAPIError{Code: "KMS.NotFoundException"}, true},
+		{&smithy.GenericAPIError{Code: "KMS.ThrottlingException"}, false},
+		{&smithy.GenericAPIError{Code: "SlowDown"}, false},
+		{&smithy.GenericAPIError{Code: "ExpiredToken"}, false},
+		{&smithy.GenericAPIError{Code: "RequestTimeTooSkewed"}, false},
+		{&smithy.GenericAPIError{Code: "InternalError"}, false},
+		{fmt.Errorf("failed to upload file: %w", os.ErrNotExist), true},
+		{errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		if got := uploader.IsPermanent(tt.err); got != tt.want {
+			t.Errorf("IsPermanent(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package uploader
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// AbortStaleUploads aborts incomplete multipart uploads that have made no
+// progress within the configured stale period, both those with local state
+// and those orphaned under the configured prefix of any bucket the rules
+// upload to, so their parts stop accruing storage costs.
+func (u *Uploader) AbortStaleUploads(ctx context.Context) error {
+	staleAfter := u.config.Uploader.Multipart.StaleAfter
+	job := &uploadJob{s3Client: u.s3Client, states: u.states}
+	if err := u.staging.RemoveStale(staleAfter); err != nil {
+		logger.Warn("failed to remove stale staged files", "error", err)
+	}
+
+	states, err := u.states.List()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(states))
+	for _, state := range states {
+		if time.Since(state.Updated) < staleAfter {
+			known[state.UploadID] = true
+			continue
+		}
+		logger.Info("aborting stale multipart upload", "key", state.Key, "updated", state.Updated)
+		job.abort(ctx, state)
+	}
+
+	for _, bucket := range u.config.Buckets() {
+		err := u.abortOrphaned(ctx, bucket, known)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abortOrphaned aborts the stale uploads under the configured prefix in
+// bucket that have no local state.
+func (u *Uploader) abortOrphaned(ctx context.Context, bucket string, known map[string]bool) error {
+	staleAfter := u.config.Uploader.Multipart.StaleAfter
+	paginator := s3.NewListMultipartUploadsPaginator(u.s3Client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(strings.TrimPrefix(u.config.S3.Prefix, "/")),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, upload := range page.Uploads {
+			if known[aws.ToString(upload.UploadId)] || time.Since(aws.ToTime(upload.Initiated)) < staleAfter {
+				continue
+			}
+			logger.Info("aborting orphaned multipart upload", "bucket", bucket, "key", aws.ToString(upload.Key), "initiated", aws.ToTime(upload.Initiated))
+			_, err := u.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil && !isAPIError(err, "NoSuchUpload") {
+				logger.Warn("failed to abort multipart upload", "bucket", bucket, "key", aws.ToString(upload.Key), "error", err)
+			}
+		}
+	}
+	return nil
+}
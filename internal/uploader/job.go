@@ -1,62 +1,255 @@
 package uploader
 
 import (
+	"cmp"
 	"context"
+	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/analysis"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/catalog"
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/quiet"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/rules"
+	"github.com/USA-RedDragon/nina-s3-uploader/pkg/pipeline"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 type uploadJob struct {
-	path      string
-	s3Client  *s3.Client
-	s3Manager *manager.Uploader
-	config    *config.Config
+	path string
+	// rel is the path the object key is derived from
+	rel string
+	// logger identifies the file on every line logged about it
+	logger     *slog.Logger
+	s3Client   *s3.Client
+	states     *stateStore
+	staging    *stagedStore
+	config     *config.Config
+	encryption *encryption
+	quiet      *quiet.Gate
+	// metadata is stored with the object in addition to the FITS header
+	metadata map[string]string
+	// location, if set, is where the object goes in place of the key the
+	// rules give it
+	location *Location
+	// entry collects what the catalog records about the attempt
+	entry catalog.Entry
+	// postUpload is the post-upload action the rules chose, empty for the
+	// configured one
+	postUpload config.PostUploadAction
+	pipeline   pipeline.Pipeline
+	sums       *fileCache[string]
+	analyses   *fileCache[analysis.Stats]
+	// bodySHA256 is the checksum of the staged file, empty if the file is
+	// uploaded as is. The staged file is kept until the upload succeeds
+	bodySHA256 string
 }
 
-func (u *uploadJob) Run() error {
+func (u *uploadJob) Run(ctx context.Context) error {
 	file, err := os.Open(u.path)
 	if err != nil {
-		slog.Error("failed to open file", "path", u.path, "error", err)
+		u.logger.Error("failed to open file", "path", u.path, "error", err)
 		return err
 	}
 	defer file.Close()
-	if strings.HasPrefix(u.path, u.config.Uploader.Local.Directory) {
-		u.path = strings.TrimPrefix(u.path, u.config.Uploader.Local.Directory)
-	} else if strings.HasPrefix(u.path, u.config.Uploader.Directory) {
-		u.path = strings.TrimPrefix(u.path, u.config.Uploader.Directory)
+	info, err := file.Stat()
+	if err != nil {
+		u.logger.Error("failed to stat file", "path", u.path, "error", err)
+		return err
+	}
+	u.entry.Size = info.Size()
+	res, err := u.resolve(file, info)
+	ruleFile, opts, key := res.file, res.options, res.key
+	u.entry.Header = ruleFile.Header
+	if err != nil {
+		u.logger.Error("failed to build object key", "path", u.path, "error", err)
+		return err
+	}
+	bucket := cmp.Or(opts.Bucket, u.config.S3.Bucket)
+	if u.location != nil {
+		bucket, key = u.location.Bucket, u.location.Key(path.Base(u.rel))
+	}
+	u.entry.Bucket = bucket
+	u.postUpload = opts.PostUpload
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if contentType := rules.ContentType(u.rel); contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if slices.ContainsFunc(res.matched, func(rule *config.Rule) bool { return !rule.Match.Quality.IsZero() }) {
+		u.logger.Info("frame failed quality thresholds", "path", u.path, "key", key, "stars", ruleFile.Quality.Stars, "hfr", ruleFile.Quality.HFR, "median", ruleFile.Quality.Median)
+	}
+	err = rules.Apply(opts, ruleFile, input)
+	if err != nil {
+		u.logger.Error("failed to apply rule", "path", u.path, "error", err)
+		return err
+	}
+
+	u.encryption.applyPut(input)
+	input.ChecksumAlgorithm = checksumAlgorithm(u.config.S3.Checksum)
+
+	// What the source reported and the analysis measured is recorded in the
+	// catalog too, the header is recorded on its own
+	measured := maps.Clone(u.metadata)
+	if ruleFile.Quality != nil {
+		measured = ruleFile.Quality.Metadata()
+		maps.Copy(measured, u.metadata)
+	}
+	u.entry.Metadata = measured
+
+	header, staged := ruleFile.Header, map[string]string{}
+	body, size := file, info.Size()
+	if stages := u.stages(opts.Compression); len(stages) > 0 {
+		pf := &pipeline.File{Name: u.rel, Header: maps.Clone(ruleFile.Header), Metadata: staged}
+		body, err = u.stage(ctx, file, info, stages, opts.Compression, pf)
+		if err != nil {
+			u.logger.Error("failed to stage file", "path", u.path, "error", err)
+			return err
+		}
+		defer body.Close()
+		stat, err := body.Stat()
+		if err != nil {
+			u.logger.Error("failed to stat staged file", "path", u.path, "error", err)
+			return err
+		}
+		size = stat.Size()
+		header = pf.Header
+		if encodings := stages.Encodings(); len(encodings) > 0 {
+			input.ContentEncoding = aws.String(strings.Join(encodings, ", "))
+		}
+		u.logger.Debug("staged file", "path", u.path, "size", info.Size(), "staged-size", size, "encoding", aws.ToString(input.ContentEncoding))
 	} else {
-		slog.Error("file path does not match local or source directory", "path", u.path)
-		return nil
+		staged[MetadataSHA256], err = u.sums.get(u.path, info, func() (string, error) { return fileSHA256(file) })
+		if err != nil {
+			u.logger.Error("failed to hash file", "path", u.path, "error", err)
+			return err
+		}
 	}
+	sum := staged[MetadataSHA256]
+	u.entry.Header = header
+	u.entry.SHA256 = sum
+	input.Metadata = fits.Metadata(header)
+	maps.Copy(input.Metadata, measured)
+	maps.Copy(input.Metadata, staged)
+	input.Body = body
 
-	u.path = strings.ReplaceAll(u.path, "\\", "/")
-	key := strings.TrimPrefix(path.Join(u.config.S3.Prefix, u.path), "/")
+	skip, err := u.resolveConflict(ctx, input, size, sum)
+	if err != nil {
+		u.logger.Error("failed to resolve key conflict", "path", u.path, "error", err)
+		return err
+	}
+	key = aws.ToString(input.Key)
+	u.entry.Key = key
+	if skip {
+		u.logger.Info("identical object already exists, skipping upload", "path", u.path, "key", key)
+		return nil
+	}
 
-	slog.Debug("uploading file", "path", u.path, "bucket", u.config.S3.Bucket, "prefix", u.config.S3.Prefix)
-	_, err = u.s3Manager.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(u.config.S3.Bucket),
-		Key:    aws.String(key),
-		Body:   file,
-	})
+	u.logger.Debug("uploading file", "path", u.path, "bucket", bucket, "key", key, "storage-class", input.StorageClass)
+	if size > int64(u.config.Uploader.Multipart.PartSize) {
+		u.entry.VersionID, err = u.multipartUpload(ctx, body, size, input)
+	} else {
+		input.ContentLength = aws.Int64(size)
+		var out *s3.PutObjectOutput
+		err = u.waitQuiet(ctx)
+		if err == nil {
+			out, err = u.s3Client.PutObject(ctx, input)
+		}
+		if err == nil {
+			u.entry.VersionID = aws.ToString(out.VersionId)
+		}
+	}
 	if err != nil {
-		slog.Error("failed to upload file", "path", u.path, "error", err)
+		u.logger.Error("failed to upload file", "path", u.path, "error", err)
 		return err
 	} else {
-		err = s3.NewObjectExistsWaiter(u.s3Client).Wait(
-			context.TODO(), &s3.HeadObjectInput{Bucket: aws.String(u.config.S3.Bucket), Key: aws.String(key)}, time.Minute)
+		headInput := &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+		u.encryption.applyHead(headInput)
+		err = s3.NewObjectExistsWaiter(u.s3Client).Wait(ctx, headInput, time.Minute)
 		if err != nil {
-			slog.Error("failed to wait for object to exist", "path", u.path, "error", err)
+			u.logger.Error("failed to wait for object to exist", "path", u.path, "error", err)
 			return err
 		}
 	}
-	slog.Debug("uploaded file", "path", u.path, "bucket", u.config.S3.Bucket, "prefix", u.config.S3.Prefix)
+	u.logger.Debug("uploaded file", "path", u.path, "bucket", bucket, "key", key)
 	return nil
 }
+
+// waitQuiet holds the upload while a quiet window is open.
+func (u *uploadJob) waitQuiet(ctx context.Context) error {
+	if until := u.quiet.Until(); until.After(time.Now()) {
+		u.logger.Debug("pausing upload for quiet window", "path", u.path, "until", until)
+	}
+	return u.quiet.Wait(ctx)
+}
+
+// resolved is what the rules decided for a file.
+type resolved struct {
+	file    rules.File
+	options config.ObjectOptions
+	// matched are the rules the options came from
+	matched []*config.Rule
+	key     string
+}
+
+// resolve reads the FITS header from file for the key template, rules and
+// metadata, and analyzes the image if configured, then evaluates the rules
+// and returns the object key, leaving file at its start.
+func (u *uploadJob) resolve(file io.ReadSeeker, info os.FileInfo) (resolved, error) {
+	res := resolved{file: rules.File{Path: u.rel, Size: info.Size(), ModTime: info.ModTime()}}
+	if fits.IsFITS(u.rel) {
+		var err error
+		res.file.Header, err = fits.ReadHeader(file)
+		if err != nil {
+			u.logger.Warn("failed to read FITS header", "path", u.path, "error", err)
+		}
+		if analysis.Wanted(u.config.Uploader.Analysis, res.file.Header) {
+			// The analysis reads the whole image, it is done once for a
+			// file however often its key is resolved or its upload retried
+			stats, err := u.analyses.get(u.path, info, func() (analysis.Stats, error) {
+				return analysis.Analyze(u.config.Uploader.Analysis, file, res.file.Header)
+			})
+			if err != nil {
+				u.logger.Warn("failed to analyze frame", "path", u.path, "error", err)
+			} else {
+				u.logger.Debug("analyzed frame", "path", u.path, "median", stats.Median, "noise", stats.Noise, "stars", stats.Stars, "hfr", stats.HFR, "fwhm", stats.FWHM)
+				res.file.Quality = &stats
+			}
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return res, err
+		}
+	}
+	res.options, res.matched = rules.Resolve(u.config.RuleMode, u.config.Rules, res.file)
+	var err error
+	res.key, err = objectKey(u.config, res.file, res.options)
+	return res, err
+}
+
+// objectKey maps a file to its S3 key, rendering the key template of the
+// rules or the configured one if either is set, below the prefix of the
+// rules.
+func objectKey(cfg *config.Config, file rules.File, opts config.ObjectOptions) (string, error) {
+	rel := file.Path
+	if text := cmp.Or(opts.KeyTemplate, cfg.S3.KeyTemplate); text != "" {
+		var err error
+		rel, err = rules.Key(text, file)
+		if err != nil {
+			return "", err
+		}
+	}
+	rel = path.Join(opts.Prefix, rel)
+	return strings.TrimPrefix(path.Join(cfg.S3.Prefix, rel), "/"), nil
+}
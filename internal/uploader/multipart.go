@@ -0,0 +1,321 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxUploadParts is the S3 limit on parts in a multipart upload.
+const maxUploadParts = 10000
+
+// multipartUpload uploads file in parts, recording each completed part so an
+// interrupted upload, even one from before a restart, resumes instead of
+// starting over. It returns the version ID of the object, if versioned.
+func (u *uploadJob) multipartUpload(ctx context.Context, file *os.File, size int64, input *s3.PutObjectInput) (string, error) {
+	partSize := int64(u.config.Uploader.Multipart.PartSize)
+	numParts := (size + partSize - 1) / partSize
+	if numParts > maxUploadParts {
+		return "", fmt.Errorf("file needs %d parts, more than the S3 limit of %d, increase the part size", numParts, maxUploadParts)
+	}
+
+	state, err := u.prepareMultipart(ctx, input, size, partSize)
+	if err != nil {
+		return "", err
+	}
+
+	done := make(map[int32]bool, len(state.Parts))
+	for _, part := range state.Parts {
+		done[part.Number] = true
+	}
+	if len(done) > 0 {
+		u.logger.Info("resuming multipart upload", "path", u.path, "key", state.Key, "completed-parts", len(done), "parts", numParts)
+	}
+
+	var lock sync.Mutex
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(u.config.Uploader.Multipart.Concurrency)
+	for number := int32(1); int64(number) <= numParts; number++ {
+		if done[number] {
+			continue
+		}
+		offset := int64(number-1) * partSize
+		length := min(partSize, size-offset)
+		group.Go(func() error {
+			if err := u.waitQuiet(groupCtx); err != nil {
+				return err
+			}
+			partInput := &s3.UploadPartInput{
+				Bucket:            input.Bucket,
+				Key:               input.Key,
+				UploadId:          aws.String(state.UploadID),
+				PartNumber:        aws.Int32(number),
+				Body:              io.NewSectionReader(file, offset, length),
+				ContentLength:     aws.Int64(length),
+				ChecksumAlgorithm: input.ChecksumAlgorithm,
+			}
+			u.encryption.applyUploadPart(partInput)
+			out, err := u.s3Client.UploadPart(groupCtx, partInput)
+			if err != nil {
+				return fmt.Errorf("failed to upload part %d: %w", number, err)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			state.Parts = append(state.Parts, completedPart{
+				Number:   number,
+				ETag:     aws.ToString(out.ETag),
+				Checksum: partChecksum(input.ChecksumAlgorithm, out.ChecksumCRC32, out.ChecksumCRC32C, out.ChecksumSHA1, out.ChecksumSHA256),
+				Size:     length,
+			})
+			err = u.states.Save(state)
+			if err != nil {
+				// The part is uploaded, only the ability to resume is lost
+				u.logger.Warn("failed to save multipart state", "path", u.path, "error", err)
+			}
+			return nil
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		u.logger.Warn("multipart upload interrupted, progress saved", "path", u.path, "completed-parts", len(state.Parts), "parts", numParts)
+		return "", err
+	}
+
+	slices.SortFunc(state.Parts, func(a, b completedPart) int { return int(a.Number - b.Number) })
+	parts := make([]types.CompletedPart, 0, len(state.Parts))
+	for _, part := range state.Parts {
+		parts = append(parts, part.completed(input.ChecksumAlgorithm))
+	}
+	completeInput := &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		IfNoneMatch:     input.IfNoneMatch,
+	}
+	u.encryption.applyComplete(completeInput)
+	out, err := u.s3Client.CompleteMultipartUpload(ctx, completeInput)
+	if err != nil {
+		if isAPIError(err, "NoSuchUpload") {
+			deleteErr := u.states.Delete(state.Bucket, state.Key)
+			if deleteErr != nil {
+				u.logger.Warn("failed to delete multipart state", "path", u.path, "error", deleteErr)
+			}
+		}
+		return "", fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	err = u.states.Delete(state.Bucket, state.Key)
+	if err != nil {
+		u.logger.Warn("failed to delete multipart state", "path", u.path, "error", err)
+	}
+	return aws.ToString(out.VersionId), nil
+}
+
+// prepareMultipart returns the saved state of a matching in-progress upload
+// with its parts checked against S3, or starts a new upload.
+func (u *uploadJob) prepareMultipart(ctx context.Context, input *s3.PutObjectInput, size, partSize int64) (*multipartState, error) {
+	bucket, key := aws.ToString(input.Bucket), aws.ToString(input.Key)
+	state, err := u.states.Load(bucket, key)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		state = nil
+	case err != nil:
+		u.logger.Warn("failed to load multipart state, starting over", "path", u.path, "error", err)
+		state = nil
+	case state.Size != size || state.PartSize != partSize || state.SHA256 != input.Metadata[MetadataSHA256] || state.BodySHA256 != u.bodySHA256:
+		// The file changed since the upload started, or was staged into
+		// different bytes, so the parts are useless
+		u.logger.Info("file changed since multipart upload started, starting over", "path", u.path)
+		u.abort(ctx, state)
+		state = nil
+	case state.Checksum != u.config.S3.Checksum:
+		// Parts of an upload created with one checksum cannot be completed
+		// with another
+		u.logger.Info("checksum changed since multipart upload started, starting over", "path", u.path)
+		u.abort(ctx, state)
+		state = nil
+	}
+
+	if state != nil {
+		parts, err := u.listParts(ctx, state)
+		switch {
+		case isAPIError(err, "NoSuchUpload"):
+			u.logger.Info("multipart upload no longer exists, starting over", "path", u.path)
+			err = u.states.Delete(bucket, key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to delete multipart state: %w", err)
+			}
+		case err != nil:
+			return nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+		default:
+			state.Parts = parts
+			return state, nil
+		}
+	}
+
+	createInput := createMultipartInput(input)
+	out, err := u.s3Client.CreateMultipartUpload(ctx, createInput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	state = &multipartState{
+		Bucket:     bucket,
+		Key:        key,
+		UploadID:   aws.ToString(out.UploadId),
+		Size:       size,
+		SHA256:     input.Metadata[MetadataSHA256],
+		BodySHA256: u.bodySHA256,
+		Checksum:   u.config.S3.Checksum,
+		PartSize:   partSize,
+		Created:    time.Now(),
+	}
+	err = u.states.Save(state)
+	if err != nil {
+		u.logger.Warn("failed to save multipart state", "path", u.path, "error", err)
+	}
+	return state, nil
+}
+
+// listParts returns the parts S3 has for the upload whose size matches what
+// this upload would send, S3 being the source of truth over the local state.
+func (u *uploadJob) listParts(ctx context.Context, state *multipartState) ([]completedPart, error) {
+	var parts []completedPart
+	listInput := &s3.ListPartsInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+	}
+	u.encryption.applyListParts(listInput)
+	paginator := s3.NewListPartsPaginator(u.s3Client, listInput)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			number := aws.ToInt32(part.PartNumber)
+			offset := int64(number-1) * state.PartSize
+			if aws.ToInt64(part.Size) != min(state.PartSize, state.Size-offset) {
+				continue
+			}
+			parts = append(parts, completedPart{
+				Number:   number,
+				ETag:     aws.ToString(part.ETag),
+				Checksum: partChecksum(checksumAlgorithm(state.Checksum), part.ChecksumCRC32, part.ChecksumCRC32C, part.ChecksumSHA1, part.ChecksumSHA256),
+				Size:     aws.ToInt64(part.Size),
+			})
+		}
+	}
+	return parts, nil
+}
+
+// abort cancels the upload in S3 and forgets its state. Failures are only
+// logged as the janitor will abort the upload once it is stale.
+func (u *uploadJob) abort(ctx context.Context, state *multipartState) {
+	_, err := u.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+	})
+	if err != nil && !isAPIError(err, "NoSuchUpload") {
+		logger.Warn("failed to abort multipart upload", "key", state.Key, "error", err)
+	}
+	err = u.states.Delete(state.Bucket, state.Key)
+	if err != nil {
+		logger.Warn("failed to delete multipart state", "key", state.Key, "error", err)
+	}
+}
+
+func createMultipartInput(input *s3.PutObjectInput) *s3.CreateMultipartUploadInput {
+	return &s3.CreateMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		CacheControl:         input.CacheControl,
+		ContentEncoding:      input.ContentEncoding,
+		ContentType:          input.ContentType,
+		Metadata:             input.Metadata,
+		StorageClass:         input.StorageClass,
+		Tagging:              input.Tagging,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		BucketKeyEnabled:     input.BucketKeyEnabled,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		ChecksumAlgorithm:    input.ChecksumAlgorithm,
+	}
+}
+
+// checksumAlgorithm returns the SDK's name of the configured checksum, empty
+// for none.
+func checksumAlgorithm(checksum config.Checksum) types.ChecksumAlgorithm {
+	switch checksum {
+	case config.ChecksumCRC32:
+		return types.ChecksumAlgorithmCrc32
+	case config.ChecksumCRC32C:
+		return types.ChecksumAlgorithmCrc32c
+	case config.ChecksumSHA1:
+		return types.ChecksumAlgorithmSha1
+	case config.ChecksumSHA256:
+		return types.ChecksumAlgorithmSha256
+	case config.ChecksumNone:
+	}
+	return ""
+}
+
+// partChecksum returns the checksum of algorithm out of those S3 reported
+// for a part.
+func partChecksum(algorithm types.ChecksumAlgorithm, crc32, crc32c, sha1, sha256 *string) string {
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		return aws.ToString(crc32)
+	case types.ChecksumAlgorithmCrc32c:
+		return aws.ToString(crc32c)
+	case types.ChecksumAlgorithmSha1:
+		return aws.ToString(sha1)
+	case types.ChecksumAlgorithmSha256:
+		return aws.ToString(sha256)
+	default:
+		return ""
+	}
+}
+
+// completed returns the part for completing an upload with checksums of
+// algorithm.
+func (p completedPart) completed(algorithm types.ChecksumAlgorithm) types.CompletedPart {
+	part := types.CompletedPart{PartNumber: aws.Int32(p.Number), ETag: aws.String(p.ETag)}
+	if p.Checksum == "" {
+		return part
+	}
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		part.ChecksumCRC32 = aws.String(p.Checksum)
+	case types.ChecksumAlgorithmCrc32c:
+		part.ChecksumCRC32C = aws.String(p.Checksum)
+	case types.ChecksumAlgorithmSha1:
+		part.ChecksumSHA1 = aws.String(p.Checksum)
+	case types.ChecksumAlgorithmSha256:
+		part.ChecksumSHA256 = aws.String(p.Checksum)
+	default:
+	}
+	return part
+}
+
+func isAPIError(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
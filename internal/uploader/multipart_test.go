@@ -0,0 +1,217 @@
+package uploader_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/s3test"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/uploader"
+)
+
+const partSize = 1024 * 1024
+
+// newUploader returns an uploader of files in a temporary watched directory
+// to bucket on server, and the directory. configure, if not nil, adjusts the
+// configuration first.
+func newUploader(t *testing.T, server *s3test.Server, bucket string, configure func(*config.Config)) (*uploader.Uploader, string) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		S3: server.S3(bucket),
+		Uploader: config.Uploader{
+			Directory:      filepath.Join(dir, "watched"),
+			Local:          config.Local{Directory: filepath.Join(dir, "local")},
+			StateDirectory: filepath.Join(dir, "state"),
+			Conflict:       config.ConflictOverwrite,
+			Multipart:      config.Multipart{PartSize: partSize, Concurrency: 1},
+		},
+		Catalog:  config.Catalog{Disabled: true},
+		RuleMode: config.RuleModeFirst,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := os.MkdirAll(cfg.Uploader.Directory, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	u, err := uploader.NewUploader(cfg, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, cfg.Uploader.Directory
+}
+
+// partRecorder records the parts uploaded and fails the given part once.
+type partRecorder struct {
+	lock  sync.Mutex
+	parts []int
+	fail  int
+}
+
+func (p *partRecorder) hook(op string, r *http.Request) int {
+	if op != s3test.OpUploadPart {
+		return 0
+	}
+	number, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if number == p.fail {
+		p.fail = 0
+		return http.StatusBadRequest
+	}
+	p.parts = append(p.parts, number)
+	return 0
+}
+
+func (p *partRecorder) take() []int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	parts := p.parts
+	p.parts = nil
+	slices.Sort(parts)
+	return parts
+}
+
+func writeRandom(t *testing.T, path string, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMultipartResume(t *testing.T) {
+	t.Parallel()
+	for _, checksum := range []config.Checksum{config.ChecksumNone, config.ChecksumCRC32} {
+		t.Run(string(checksum), func(t *testing.T) {
+			t.Parallel()
+			server := s3test.New(t, "bucket")
+			u, dir := newUploader(t, server, "bucket", func(cfg *config.Config) { cfg.S3.Checksum = checksum })
+			path := filepath.Join(dir, "a.fits")
+			data := writeRandom(t, path, 3*partSize+partSize/2)
+
+			recorder := &partRecorder{fail: 3}
+			server.FailWhen(recorder.hook)
+			if err := u.Upload(context.Background(), path); err == nil {
+				t.Fatal("upload succeeded despite a failed part")
+			}
+			if got := recorder.take(); !slices.Equal(got, []int{1, 2}) {
+				t.Fatalf("parts before the failure %v", got)
+			}
+			if server.Uploads() != 1 {
+				t.Fatalf("expected the upload to be left to resume, %d in progress", server.Uploads())
+			}
+
+			// The completed parts are reused
+			if err := u.Upload(context.Background(), path); err != nil {
+				t.Fatal(err)
+			}
+			if got := recorder.take(); !slices.Equal(got, []int{3, 4}) {
+				t.Fatalf("resumed upload sent parts %v", got)
+			}
+			object, ok := server.Object("bucket", "a.fits")
+			if !ok || !bytes.Equal(object.Data, data) {
+				t.Fatal("resumed upload stored different data")
+			}
+			if server.Uploads() != 0 || server.Count(s3test.OpCreateUpload) != 1 {
+				t.Fatalf("%d uploads created, %d left", server.Count(s3test.OpCreateUpload), server.Uploads())
+			}
+		})
+	}
+}
+
+func TestMultipartRestartOnChange(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	u, dir := newUploader(t, server, "bucket", nil)
+	path := filepath.Join(dir, "a.fits")
+	writeRandom(t, path, 2*partSize+1)
+
+	recorder := &partRecorder{fail: 2}
+	server.FailWhen(recorder.hook)
+	if err := u.Upload(context.Background(), path); err == nil {
+		t.Fatal("upload succeeded despite a failed part")
+	}
+	recorder.take()
+
+	// Parts of a file that changed since are useless
+	data := writeRandom(t, path, 2*partSize+1)
+	if err := u.Upload(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorder.take(); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Fatalf("restarted upload sent parts %v", got)
+	}
+	if server.Count(s3test.OpAbortUpload) != 1 || server.Uploads() != 0 {
+		t.Fatalf("stale upload not aborted, %d aborts, %d left", server.Count(s3test.OpAbortUpload), server.Uploads())
+	}
+	object, ok := server.Object("bucket", "a.fits")
+	if !ok || !bytes.Equal(object.Data, data) {
+		t.Fatal("restarted upload stored different data")
+	}
+}
+
+func TestMultipartResumeEncrypted(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	keyFile := filepath.Join(t.TempDir(), "pipeline.key")
+	if err := os.WriteFile(keyFile, bytes.Repeat([]byte{7}, 32), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	u, dir := newUploader(t, server, "bucket", func(cfg *config.Config) {
+		cfg.Uploader.Pipeline = []config.PipelineStage{{Stage: "encrypt", Options: map[string]string{"key-file": keyFile}}}
+	})
+	path := filepath.Join(dir, "a.fits")
+	data := writeRandom(t, path, 3*partSize+partSize/2)
+
+	recorder := &partRecorder{fail: 3}
+	server.FailWhen(recorder.hook)
+	if err := u.Upload(context.Background(), path); err == nil {
+		t.Fatal("upload succeeded despite a failed part")
+	}
+	recorder.take()
+
+	// The staged ciphertext is kept, so its parts are reused despite the
+	// random nonce, even once the file was copied to the local directory
+	local := filepath.Join(filepath.Dir(dir), "local", "a.fits")
+	if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(local, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Upload(context.Background(), local); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorder.take(); !slices.Equal(got, []int{3, 4}) {
+		t.Fatalf("resumed upload sent parts %v", got)
+	}
+	if server.Count(s3test.OpCreateUpload) != 1 {
+		t.Fatalf("%d uploads created", server.Count(s3test.OpCreateUpload))
+	}
+	if staged, _ := os.ReadDir(filepath.Join(filepath.Dir(dir), "state", "staged")); len(staged) != 0 {
+		t.Fatalf("staged files left after the upload: %d", len(staged))
+	}
+
+	dst := filepath.Join(t.TempDir(), "a.fits")
+	if _, err := u.Download(context.Background(), "a.fits", dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("resumed encrypted upload does not decrypt to the file: %v", err)
+	}
+}
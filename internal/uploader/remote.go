@@ -0,0 +1,103 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxDeleteKeys is the most keys a DeleteObjects request accepts.
+const maxDeleteKeys = 1000
+
+// Object is an object in the bucket.
+type Object struct {
+	Key  string
+	Size int64
+}
+
+// ListObjects lists every object in bucket below the configured prefix.
+func (u *Uploader) ListObjects(ctx context.Context, bucket string) ([]Object, error) {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket)}
+	// The prefix is a directory, archive must not list archive-old
+	if prefix := strings.Trim(u.config.S3.Prefix, "/"); prefix != "" {
+		input.Prefix = aws.String(prefix + "/")
+	}
+	var objects []Object
+	paginator := s3.NewListObjectsV2Paginator(u.s3Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, Object{Key: aws.ToString(object.Key), Size: aws.ToInt64(object.Size)})
+		}
+	}
+	return objects, nil
+}
+
+// Checksum returns the SHA-256 of the file at path, which is kept until the
+// file is uploaded so the upload does not read it again.
+func (u *Uploader) Checksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	return u.sums.get(path, info, func() (string, error) { return fileSHA256(file) })
+}
+
+// Compare reports whether an object exists at key in bucket and whether it
+// was uploaded from the file at path, by size and checksum.
+func (u *Uploader) Compare(ctx context.Context, bucket, key, path string) (bool, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, false, err
+	}
+	sum, err := fileSHA256(file)
+	if err != nil {
+		return false, false, err
+	}
+	return u.newJob(path, "").compareObject(ctx, bucket, key, info.Size(), sum, true)
+}
+
+// DeleteObjects deletes the objects at keys and returns the error of each
+// key that could not be deleted.
+func (u *Uploader) DeleteObjects(ctx context.Context, keys []string) map[string]error {
+	errs := make(map[string]error)
+	for start := 0; start < len(keys); start += maxDeleteKeys {
+		batch := keys[start:min(start+maxDeleteKeys, len(keys))]
+		objects := make([]types.ObjectIdentifier, 0, len(batch))
+		for _, key := range batch {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+		out, err := u.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(u.config.S3.Bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			for _, key := range batch {
+				errs[key] = fmt.Errorf("failed to delete objects: %w", err)
+			}
+			continue
+		}
+		for _, failed := range out.Errors {
+			errs[aws.ToString(failed.Key)] = fmt.Errorf("failed to delete object: %s", aws.ToString(failed.Message))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,256 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/pkg/pipeline"
+)
+
+const stagedDir = "staged"
+
+// newPipeline builds the configured pipeline stages.
+func newPipeline(stages []config.PipelineStage) (pipeline.Pipeline, error) {
+	p := make(pipeline.Pipeline, 0, len(stages))
+	for _, stage := range stages {
+		built, err := pipeline.New(stage.Stage, stage.Options)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, built)
+	}
+	return p, nil
+}
+
+// stages returns the pipeline a file passes through, nil if it is uploaded
+// as is: the configured stages with the checksum of the file recorded first
+// and that of what a download restores recorded before the first stage that
+// encodes the file, where gzip is added too if the rules compress the file
+// and the pipeline does not already.
+func (u *uploadJob) stages(compression config.Compression) pipeline.Pipeline {
+	compress := compression == config.CompressionGzip && !slices.Contains(u.pipeline.Encodings(), pipeline.EncodingGzip)
+	if len(u.pipeline) == 0 && !compress {
+		return nil
+	}
+	split := slices.IndexFunc(u.pipeline, func(stage pipeline.Stage) bool { return stage.Encoding() != "" })
+	if split < 0 {
+		split = len(u.pipeline)
+	}
+	stages := pipeline.Pipeline{pipeline.SHA256(MetadataSourceSHA256)}
+	stages = append(stages, u.pipeline[:split]...)
+	stages = append(stages, pipeline.SHA256(MetadataSHA256))
+	if compress {
+		stages = append(stages, pipeline.Gzip())
+	}
+	return append(stages, u.pipeline[split:]...)
+}
+
+// stagedRecord describes a staged file, which is kept until the file is
+// uploaded so every attempt, even after a restart, sends the same bytes.
+// Stages that differ on every run, such as encryption, would otherwise keep
+// a multipart upload from resuming.
+type stagedRecord struct {
+	Rel     string    `json:"rel"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod-time"`
+	// SHA256 is the checksum of the file, which tells whether a copy with
+	// another modification time, such as the one in the local directory,
+	// is the same file
+	SHA256 string `json:"sha256"`
+	// Stages identifies the pipeline the file went through
+	Stages     string            `json:"stages"`
+	BodySize   int64             `json:"body-size"`
+	BodySHA256 string            `json:"body-sha256"`
+	Header     map[string]string `json:"header,omitempty"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// stagedStore keeps the staged file of each file whose upload has yet to
+// succeed, beside a JSON record of it. Files are known by their path
+// relative to the watched directory, so a file moved to the local directory
+// after failed attempts finds what they staged.
+type stagedStore struct {
+	dir string
+}
+
+func newStagedStore(dir string) (*stagedStore, error) {
+	dir = filepath.Join(dir, stagedDir)
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	return &stagedStore{dir: dir}, nil
+}
+
+// paths returns the staged file and record of the file at rel.
+func (s *stagedStore) paths(rel string) (string, string) {
+	sum := sha256.Sum256([]byte(rel))
+	name := filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+	return name + ".body", name + ".json"
+}
+
+// open returns the staged file and record of the file want describes if
+// they were staged from the same file through the same stages. sum returns
+// the checksum of the file, for when its modification time differs.
+func (s *stagedStore) open(want stagedRecord, sum func() (string, error)) (*os.File, *stagedRecord) {
+	body, record := s.paths(want.Rel)
+	data, err := os.ReadFile(record)
+	if err != nil {
+		return nil, nil
+	}
+	var staged stagedRecord
+	if json.Unmarshal(data, &staged) != nil || staged.Rel != want.Rel || staged.Size != want.Size || staged.Stages != want.Stages {
+		return nil, nil
+	}
+	if !staged.ModTime.Equal(want.ModTime) {
+		if sum, err := sum(); err != nil || sum != staged.SHA256 {
+			return nil, nil
+		}
+	}
+	file, err := os.Open(body)
+	if err != nil {
+		return nil, nil
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != staged.BodySize {
+		file.Close()
+		return nil, nil
+	}
+	return file, &staged
+}
+
+// save records the staged file at tmp, moving it into place.
+func (s *stagedStore) save(tmp string, record stagedRecord) error {
+	body, path := s.paths(record.Rel)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal staged file record: %w", err)
+	}
+	// A record is only written for a body in place, so a crash between the
+	// two leaves no record of the wrong body
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(tmp, body); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Remove deletes the staged file of the file at rel, if any.
+func (s *stagedStore) Remove(rel string) {
+	body, record := s.paths(rel)
+	for _, name := range []string{record, body} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("failed to remove staged file", "rel", rel, "error", err)
+		}
+	}
+}
+
+// RemoveStale deletes staged files and leftovers of interrupted staging
+// older than staleAfter, such as those of files that moved since.
+func (s *stagedStore) RemoveStale(staleAfter time.Duration) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || time.Since(info.ModTime()) < staleAfter {
+			continue
+		}
+		logger.Info("removing stale staged file", "name", entry.Name(), "modified", info.ModTime())
+		err = os.Remove(filepath.Join(s.dir, entry.Name()))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("failed to remove staged file", "name", entry.Name(), "error", err)
+		}
+	}
+	return nil
+}
+
+// stage passes file through p into a staged file, which the caller closes,
+// and rewinds both. A file staged through the same stages by an earlier
+// attempt is reused, along with the header and metadata the stages set. It
+// sets the SHA-256 of the staged file, which tells a resumed multipart
+// upload whether it holds the bytes its parts came from.
+func (u *uploadJob) stage(ctx context.Context, file *os.File, info os.FileInfo, p pipeline.Pipeline, compression config.Compression, pf *pipeline.File) (*os.File, error) {
+	want := stagedRecord{
+		Rel:     u.rel,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Stages:  fmt.Sprintf("%v %s", u.config.Uploader.Pipeline, compression),
+	}
+	sum := func() (string, error) {
+		return u.sums.get(u.path, info, func() (string, error) { return fileSHA256(file) })
+	}
+	if staged, record := u.staging.open(want, sum); staged != nil {
+		u.logger.Debug("reusing staged file", "path", u.path)
+		u.bodySHA256 = record.BodySHA256
+		pf.Header = record.Header
+		maps.Copy(pf.Metadata, record.Metadata)
+		return staged, nil
+	}
+
+	staged, err := os.CreateTemp(u.staging.dir, "stage-*")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		staged.Close()
+		os.Remove(staged.Name())
+		return nil, fmt.Errorf("failed to stage file: %w", err)
+	}
+	r, err := p.Wrap(ctx, file, pf)
+	if err != nil {
+		return fail(err)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(staged, hash), r)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	// Files cannot be renamed while open on Windows
+	if err := staged.Close(); err != nil {
+		return fail(err)
+	}
+	want.SHA256 = pf.Metadata[MetadataSourceSHA256]
+	if pf.Metadata[MetadataSourceSHA256] == pf.Metadata[MetadataSHA256] {
+		// The stages before the encoding left the file as it was
+		delete(pf.Metadata, MetadataSourceSHA256)
+	}
+	u.bodySHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	want.BodySize = size
+	want.BodySHA256 = u.bodySHA256
+	want.Header = pf.Header
+	want.Metadata = pf.Metadata
+	name := staged.Name()
+	if err := u.staging.save(name, want); err != nil {
+		// The staged file is still good for this attempt, and is removed
+		// once stale
+		u.logger.Warn("failed to keep staged file", "path", u.path, "error", err)
+	} else {
+		name, _ = u.staging.paths(u.rel)
+	}
+	staged, err = os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open staged file: %w", err)
+	}
+	return staged, nil
+}
@@ -0,0 +1,139 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+)
+
+const multipartStateDir = "multipart"
+
+// multipartState is the locally persisted progress of a multipart upload.
+type multipartState struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	UploadID string `json:"upload-id"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	// BodySHA256 is the checksum of the staged file the parts are cut from
+	BodySHA256 string `json:"body-sha256,omitempty"`
+	// Checksum is the checksum the upload was created with, states from
+	// before it was configurable have none and start over
+	Checksum config.Checksum `json:"checksum"`
+	PartSize int64           `json:"part-size"`
+	Created  time.Time       `json:"created"`
+	Updated  time.Time       `json:"updated"`
+	Parts    []completedPart `json:"parts"`
+}
+
+type completedPart struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+	// Checksum is the part's checksum of the upload's algorithm
+	Checksum string `json:"checksum,omitempty"`
+	Size     int64  `json:"size"`
+}
+
+// stateStore keeps one JSON file per in-progress multipart upload.
+type stateStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+func newStateStore(dir string) (*stateStore, error) {
+	dir = filepath.Join(dir, multipartStateDir)
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	return &stateStore{dir: dir}, nil
+}
+
+func (s *stateStore) path(bucket, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Load returns the state for the object. The error matches os.ErrNotExist
+// if there is none.
+func (s *stateStore) Load(bucket, key string) (*multipartState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := os.ReadFile(s.path(bucket, key))
+	if err != nil {
+		return nil, err
+	}
+	var state multipartState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal multipart state: %w", err)
+	}
+	return &state, nil
+}
+
+// Save atomically writes the state so a crash never leaves a torn file.
+func (s *stateStore) Save(state *multipartState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state.Updated = time.Now()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal multipart state: %w", err)
+	}
+	path := s.path(state.Bucket, state.Key)
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *stateStore) Delete(bucket, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := os.Remove(s.path(bucket, key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns every stored state, skipping files that cannot be read.
+func (s *stateStore) List() ([]*multipartState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]*multipartState, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var state multipartState
+		if json.Unmarshal(data, &state) != nil {
+			continue
+		}
+		states = append(states, &state)
+	}
+	return states, nil
+}
@@ -0,0 +1,110 @@
+package uploader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// newHTTPClient builds the HTTP client used for S3 and STS requests with the
+// configured TLS and proxy settings.
+func newHTTPClient(cfg config.S3) (*awshttp.BuildableClient, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		//nolint:gosec // opt-in for lab deployments with self-signed certificates
+		InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+	}
+
+	if cfg.TLS.CAFile != "" {
+		pem, err := os.ReadFile(cfg.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy URL: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.TLSClientConfig = tlsConfig
+		tr.Proxy = proxy
+	}), nil
+}
+
+// endpointURL adds a scheme to endpoints configured as a bare host name.
+func endpointURL(endpoint string) string {
+	if endpoint == "" || strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	return "https://" + endpoint
+}
+
+// legacyEndpoint is the endpoint earlier versions defaulted to. It is
+// treated as unset, so the SDK resolves the endpoint of the region.
+const legacyEndpoint = "s3.amazonaws.com"
+
+// baseEndpoint returns the URL of the configured endpoint, empty for AWS's
+// own resolution.
+func baseEndpoint(endpoint string) string {
+	if endpoint == "" || endpointHost(endpoint) == legacyEndpoint {
+		return ""
+	}
+	return endpointURL(endpoint)
+}
+
+// endpointHost returns the host name of endpoint, lowercased.
+func endpointHost(endpoint string) string {
+	u, err := url.Parse(endpointURL(endpoint))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// awsEndpoint reports whether endpoint is one of AWS's own.
+func awsEndpoint(endpoint string) bool {
+	host := endpointHost(endpoint)
+	return strings.HasSuffix(host, ".amazonaws.com") || strings.HasSuffix(host, ".amazonaws.com.cn")
+}
+
+// usePathStyle resolves the configured addressing. Most S3-compatible stores
+// only support path-style requests, while AWS prefers virtual-hosted ones.
+func usePathStyle(cfg config.S3) bool {
+	switch cfg.Addressing {
+	case config.AddressingPath:
+		return true
+	case config.AddressingVirtual:
+		return false
+	case config.AddressingAuto:
+	}
+	return cfg.Endpoint != "" && !awsEndpoint(cfg.Endpoint)
+}
@@ -1,69 +1,406 @@
 package uploader
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/analysis"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/bandwidth"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/catalog"
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/fits"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/quiet"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/rules"
+	"github.com/USA-RedDragon/nina-s3-uploader/pkg/pipeline"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsConfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
+//nolint:gochecknoglobals
+var logger = logging.For("uploader")
+
 type Uploader struct {
-	config    *config.Config
-	s3Client  *s3.Client
-	s3Manager *manager.Uploader
-	upload    *uploadJob
-	lock      sync.Mutex
+	config     *config.Config
+	s3Client   *s3.Client
+	states     *stateStore
+	staging    *stagedStore
+	encryption *encryption
+	// quiet pauses uploads between parts, nil never pauses
+	quiet *quiet.Gate
+	// catalog records every upload attempt, nil if disabled
+	catalog *catalog.Catalog
+	// pipeline holds the configured stages each file passes through
+	pipeline pipeline.Pipeline
+	// credentialsSource describes where the credentials were configured from
+	credentialsSource string
+	// buckets remembers the bucket of each file whose last upload failed, by
+	// path relative to the watched directory, for MarkDeadLettered
+	buckets sync.Map
+	// sums and analyses keep the checksums and analyses of files whose
+	// upload has yet to succeed
+	sums     *fileCache[string]
+	analyses *fileCache[analysis.Stats]
+	upload   *uploadJob
+	lock     sync.Mutex
 }
 
-func NewUploader(cfg *config.Config) (*Uploader, error) {
-	awsCfg, err := awsConfig.LoadDefaultConfig(context.TODO())
+// NewUploader creates an uploader whose requests share the given bandwidth
+// limiter, which pauses between parts while the quiet gate is quiet and
+// records the files it handles in catalog. Any of them may be nil.
+func NewUploader(cfg *config.Config, limiter *bandwidth.Limiter, gate *quiet.Gate, catalog *catalog.Catalog) (*Uploader, error) {
+	awsCfg, credentialsSource, err := loadAWSConfig(context.TODO(), cfg.S3, limiter)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
+	enc, err := newEncryption(cfg.S3.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption config: %w", err)
+	}
+
+	stages, err := newPipeline(cfg.Uploader.Pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build pipeline: %w", err)
+	}
+
 	ret := &Uploader{
-		config: cfg,
+		config:            cfg,
+		pipeline:          stages,
+		encryption:        enc,
+		quiet:             gate,
+		catalog:           catalog,
+		sums:              &fileCache[string]{},
+		analyses:          &fileCache[analysis.Stats]{},
+		credentialsSource: credentialsSource,
 		s3Client: s3.NewFromConfig(awsCfg, func(o *s3.Options) {
 			o.Region = cfg.S3.Region
-			if cfg.S3.Endpoint != "" {
-				o.BaseEndpoint = aws.String(cfg.S3.Endpoint)
-				o.UsePathStyle = true
+			if endpoint := baseEndpoint(cfg.S3.Endpoint); endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+			}
+			o.UsePathStyle = usePathStyle(cfg.S3)
+			if cfg.S3.Checksum == config.ChecksumNone {
+				// The SDK adds a CRC32 to every upload it can otherwise
+				o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
 			}
 		}),
 	}
 
-	ret.s3Manager = manager.NewUploader(ret.s3Client, func(o *manager.Uploader) {
-		o.PartSize = 16 * 1024 * 1024 // 16MB
-		o.LeavePartsOnError = false
-		o.Concurrency = 5
-	})
+	ret.states, err = newStateStore(cfg.Uploader.StateDirectory)
+	if err != nil {
+		return nil, err
+	}
+	ret.staging, err = newStagedStore(cfg.Uploader.StateDirectory)
+	if err != nil {
+		return nil, err
+	}
 
 	return ret, nil
 }
 
-func (u *Uploader) Upload(path string) error {
+// Check verifies that credentials can be resolved and that the bucket is
+// reachable, reporting which credential source was used.
+func (u *Uploader) Check(ctx context.Context) error {
+	creds, err := u.s3Client.Options().Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve credentials from %s: %w", u.credentialsSource, err)
+	}
+	logger.Info("resolved S3 credentials", "source", u.credentialsSource, "provider", creds.Source)
+
+	_, err = u.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(u.config.S3.Bucket)})
+	if err != nil {
+		return fmt.Errorf("failed to access bucket %s with credentials from %s: %w", u.config.S3.Bucket, u.credentialsSource, err)
+	}
+	logger.Info("S3 connectivity check passed", "bucket", u.config.S3.Bucket, "endpoint", u.config.S3.Endpoint)
+	return nil
+}
+
+// Probe checks whether the S3 endpoint can be reached with a single
+// HeadBucket request. Use IsUnreachable to tell a dead link apart from an
+// endpoint that answered with an error.
+func (u *Uploader) Probe(ctx context.Context) error {
+	_, err := u.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(u.config.S3.Bucket)}, func(o *s3.Options) {
+		o.RetryMaxAttempts = 1
+	})
+	return err
+}
+
+// Upload uploads a single file from the watched or local directory.
+// Cancelling ctx interrupts the upload, a multipart upload keeps its
+// completed parts to resume from.
+func (u *Uploader) Upload(ctx context.Context, path string) error {
+	_, err := u.uploadWith(ctx, path, nil)
+	return err
+}
+
+// Result describes a completed upload.
+type Result struct {
+	Bucket string
+	Key    string
+	Size   int64
+	SHA256 string
+	Header fits.Header
+	// PostUpload is the post-upload action the rules chose, empty for the
+	// configured one
+	PostUpload config.PostUploadAction
+}
+
+// Location is a bucket and a directory of keys in it. Sidecars and complete
+// markers are written into the location of their frames, under their own
+// file name.
+type Location struct {
+	Bucket string
+	Dir    string
+}
+
+// Location returns the location the object was uploaded into.
+func (r Result) Location() Location {
+	return Location{Bucket: r.Bucket, Dir: path.Dir(r.Key)}
+}
+
+// Key returns the key of the file name in the location.
+func (l Location) Key(name string) string {
+	return path.Join(l.Dir, name)
+}
+
+// uploadWith is Upload storing metadata with the object.
+func (u *Uploader) uploadWith(ctx context.Context, path string, metadata map[string]string) (Result, error) {
+	rel, ok := u.config.Uploader.RelativePath(path)
+	if !ok {
+		logger.Error("file path does not match local or source directory", "path", path)
+		return Result{}, nil
+	}
+	return u.uploadAs(ctx, path, rel, metadata, nil)
+}
+
+// UploadAs uploads the file at path as if it were at rel below the watched
+// directory, which the object key is derived from.
+func (u *Uploader) UploadAs(ctx context.Context, path, rel string) (Result, error) {
+	return u.uploadAs(ctx, path, rel, nil, nil)
+}
+
+// UploadInto uploads the file at path, as if it were at rel below the
+// watched directory, into loc under its own file name whatever key the rules
+// would give it. The rules still decide everything else about the object.
+func (u *Uploader) UploadInto(ctx context.Context, path, rel string, loc Location) error {
+	_, err := u.uploadAs(ctx, path, rel, nil, &loc)
+	return err
+}
+
+// uploadAs is UploadAs storing metadata with the object in addition to its
+// FITS header, and uploading into loc unless it is nil.
+func (u *Uploader) uploadAs(ctx context.Context, path, rel string, metadata map[string]string, loc *Location) (Result, error) {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
 	if u.upload == nil {
-		u.upload = &uploadJob{
-			path:      path,
-			s3Client:  u.s3Client,
-			config:    u.config,
-			s3Manager: u.s3Manager,
+		u.upload = u.newJob(path, rel)
+		u.upload.metadata = metadata
+		u.upload.location = loc
+		err := u.upload.Run(ctx)
+		u.record(u.upload, err)
+		entry := u.upload.entry
+		result := Result{
+			Bucket:     entry.Bucket,
+			Key:        entry.Key,
+			Size:       entry.Size,
+			SHA256:     entry.SHA256,
+			Header:     entry.Header,
+			PostUpload: u.upload.postUpload,
 		}
-		err := u.upload.Run()
 		u.upload = nil
 		if err != nil {
-			return fmt.Errorf("failed to upload file: %w", err)
+			return Result{}, fmt.Errorf("failed to upload file: %w", err)
 		}
-		return nil
+		u.sums.forget(path)
+		u.analyses.forget(path)
+		u.staging.Remove(rel)
+		return result, nil
 	} else {
-		return fmt.Errorf("upload already in progress")
+		return Result{}, fmt.Errorf("upload already in progress")
+	}
+}
+
+// record adds the outcome of job to the catalog. Uploads interrupted by
+// shutdown are not attempts of their own.
+func (u *Uploader) record(job *uploadJob, err error) {
+	if err != nil {
+		u.buckets.Store(job.rel, job.entry.Bucket)
+	} else {
+		u.buckets.Delete(job.rel)
+	}
+	if u.catalog == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	entry := job.entry
+	entry.Status = catalog.StatusUploaded
+	if err != nil {
+		entry.Status = catalog.StatusFailed
+		entry.Error = err.Error()
+	}
+	if err := u.catalog.Record(entry); err != nil {
+		job.logger.Warn("failed to record file in catalog", "path", job.path, "error", err)
+	}
+}
+
+// MarkDeadLettered records in the catalog that a group was given up on and
+// drops what was kept for retrying it.
+func (u *Uploader) MarkDeadLettered(group []string, reason string) {
+	for _, path := range group {
+		u.sums.forget(path)
+		u.analyses.forget(path)
+	}
+	for _, path := range group {
+		rel, ok := u.config.Uploader.RelativePath(path)
+		if !ok {
+			continue
+		}
+		u.staging.Remove(rel)
+		if u.catalog == nil {
+			continue
+		}
+		bucket := u.config.S3.Bucket
+		if last, ok := u.buckets.Load(rel); ok {
+			bucket = last.(string)
+		}
+		err := u.catalog.SetStatus(bucket, rel, catalog.StatusDeadLettered, reason)
+		if err != nil {
+			logger.Warn("failed to record dead-lettered file in catalog", "path", path, "error", err, logging.File(u.config.Uploader, path))
+		}
+	}
+}
+
+// ObjectKey returns the key the file at path would be uploaded to as rel,
+// without uploading it.
+func (u *Uploader) ObjectKey(path, rel string) (string, error) {
+	target, err := u.Destination(path, rel)
+	return target.Key, err
+}
+
+// Target is where and how a file would be uploaded.
+type Target struct {
+	Bucket string
+	Key    string
+	// Staged is set if the file would pass through pipeline stages, i.e. be
+	// compressed or have its header changed, so the size of the object says
+	// nothing about whether it matches the file
+	Staged bool
+}
+
+// Location returns the location the file would be uploaded into.
+func (t Target) Location() Location {
+	return Location{Bucket: t.Bucket, Dir: path.Dir(t.Key)}
+}
+
+// Destination returns where the file at path would be uploaded to as rel,
+// without uploading it.
+func (u *Uploader) Destination(path, rel string) (Target, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Target{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return Target{}, err
+	}
+	job := u.newJob(path, rel)
+	res, err := job.resolve(file, info)
+	return Target{
+		Bucket: cmp.Or(res.options.Bucket, u.config.S3.Bucket),
+		Key:    res.key,
+		Staged: len(job.stages(res.options.Compression)) > 0,
+	}, err
+}
+
+func (u *Uploader) newJob(path, rel string) *uploadJob {
+	return &uploadJob{
+		path:       path,
+		rel:        rel,
+		logger:     logger.With(logging.File(u.config.Uploader, path)),
+		s3Client:   u.s3Client,
+		config:     u.config,
+		states:     u.states,
+		staging:    u.staging,
+		encryption: u.encryption,
+		quiet:      u.quiet,
+		pipeline:   u.pipeline,
+		sums:       u.sums,
+		analyses:   u.analyses,
+		entry:      catalog.Entry{Path: path, Rel: rel, Bucket: u.config.S3.Bucket},
+	}
+}
+
+// UploadGroup uploads a frame followed by its sidecars, stopping at the first
+// failure. The sidecars are uploaded into the location of the frame, so they
+// stay beside it whatever key template and rules placed it. Sidecars that
+// have disappeared in the meantime, e.g. because another group already
+// uploaded a shared one, are skipped. Metadata is stored with the frame in
+// addition to its FITS header. It returns the result of the frame, whose
+// post-upload action applies to the whole group.
+func (u *Uploader) UploadGroup(ctx context.Context, paths []string, metadata map[string]string) (Result, error) {
+	result, err := u.uploadWith(ctx, paths[0], metadata)
+	if err != nil {
+		return Result{}, err
+	}
+	for _, path := range paths[1:] {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		rel, ok := u.config.Uploader.RelativePath(path)
+		if !ok {
+			logger.Error("file path does not match local or source directory", "path", path)
+			continue
+		}
+		err := u.UploadInto(ctx, path, rel, result.Location())
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	return result, nil
+}
+
+// MarkerLocation returns the location for the complete marker of dir when
+// none of its frames were uploaded since the start: dir mirrored below the
+// prefixes, in the bucket the rules choose for the marker.
+func (u *Uploader) MarkerLocation(dir string) (Location, error) {
+	rel, ok := u.config.Uploader.RelativePath(filepath.Join(dir, u.config.Uploader.CompleteMarker.Name))
+	if !ok {
+		return Location{}, fmt.Errorf("directory %s does not match local or source directory", dir)
+	}
+	opts, _ := rules.Resolve(u.config.RuleMode, u.config.Rules, rules.File{Path: rel, ModTime: time.Now()})
+	key := strings.TrimPrefix(path.Join(u.config.S3.Prefix, opts.Prefix, rel), "/")
+	return Location{Bucket: cmp.Or(opts.Bucket, u.config.S3.Bucket), Dir: path.Dir(key)}, nil
+}
+
+// WriteMarker uploads a marker object with the given body into loc.
+func (u *Uploader) WriteMarker(ctx context.Context, loc Location, body []byte) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(loc.Bucket),
+		Key:         aws.String(loc.Key(u.config.Uploader.CompleteMarker.Name)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	u.encryption.applyPut(input)
+	_, err := u.s3Client.PutObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to write marker: %w", err)
 	}
+	return nil
 }
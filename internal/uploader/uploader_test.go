@@ -0,0 +1,107 @@
+package uploader_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/s3test"
+)
+
+func TestUploadGroupKeyTemplate(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	u, dir := newUploader(t, server, "bucket", func(cfg *config.Config) {
+		cfg.S3.Prefix = "archive"
+		cfg.S3.KeyTemplate = "frames/{{ .Name }}"
+		cfg.Uploader.CompleteMarker.Name = "_COMPLETE"
+	})
+	if err := os.MkdirAll(filepath.Join(dir, "night"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	frame := filepath.Join(dir, "night", "a.fits")
+	writeRandom(t, frame, 1024)
+	sidecar := filepath.Join(dir, "night", "a.json")
+	writeRandom(t, sidecar, 16)
+
+	// The sidecar follows the frame rather than rendering its own key
+	result, err := u.UploadGroup(context.Background(), []string{frame, sidecar}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Key != "archive/frames/a.fits" {
+		t.Fatalf("frame uploaded to %q", result.Key)
+	}
+	if got, want := server.Keys("bucket"), []string{"archive/frames/a.fits", "archive/frames/a.json"}; !slices.Equal(got, want) {
+		t.Fatalf("keys %v, want %v", got, want)
+	}
+
+	if err := u.WriteMarker(context.Background(), result.Location(), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Object("bucket", "archive/frames/_COMPLETE"); !ok {
+		t.Fatalf("marker not written beside the frame: %v", server.Keys("bucket"))
+	}
+}
+
+func TestUploadGroupRulePrefix(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	// The rule only matches the frame, as a quality rule only matches
+	// analyzed frames, yet the sidecar follows it
+	u, dir := newUploader(t, server, "bucket", func(cfg *config.Config) {
+		cfg.Rules = []config.Rule{{Match: config.RuleMatch{Extensions: []string{".fits"}}, Object: config.ObjectOptions{Prefix: "rejected"}}}
+	})
+	frame := filepath.Join(dir, "a.fits")
+	writeRandom(t, frame, 1024)
+	sidecar := filepath.Join(dir, "a.json")
+	writeRandom(t, sidecar, 16)
+
+	if _, err := u.UploadGroup(context.Background(), []string{frame, sidecar}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.Keys("bucket"), []string{"rejected/a.fits", "rejected/a.json"}; !slices.Equal(got, want) {
+		t.Fatalf("keys %v, want %v", got, want)
+	}
+}
+
+func TestCompareInjectedHeader(t *testing.T) {
+	t.Parallel()
+	server := s3test.New(t, "bucket")
+	u, dir := newUploader(t, server, "bucket", func(cfg *config.Config) {
+		cfg.Uploader.Pipeline = []config.PipelineStage{{Stage: "fits-header", Options: map[string]string{"OBSERVER": "Someone"}}}
+	})
+	var header strings.Builder
+	for _, card := range []string{"SIMPLE  =                    T", "OBJECT  = 'M31     '", "END"} {
+		header.WriteString(fmt.Sprintf("%-80s", card))
+	}
+	path := filepath.Join(dir, "a.fits")
+	data := header.String() + strings.Repeat(" ", 2880-header.Len()) + strings.Repeat("\x01", 2880)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Upload(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	object, _ := server.Object("bucket", "a.fits")
+	if string(object.Data) == data {
+		t.Fatal("header was not injected")
+	}
+
+	// The object differs from the file but was uploaded from it
+	exists, identical, err := u.Compare(context.Background(), "bucket", "a.fits", path)
+	if err != nil || !exists || !identical {
+		t.Fatalf("compared as exists %v, identical %v: %v", exists, identical, err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Replace(data, "M31", "M42", 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, identical, err := u.Compare(context.Background(), "bucket", "a.fits", path); err != nil || identical {
+		t.Fatalf("changed file compared as identical: %v", err)
+	}
+}
@@ -2,7 +2,6 @@ package watcher
 
 import (
 	"fmt"
-	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -10,10 +9,15 @@ import (
 	"time"
 
 	"github.com/USA-RedDragon/nina-s3-uploader/internal/config"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/logging"
+	"github.com/USA-RedDragon/nina-s3-uploader/internal/rules"
 	"github.com/fsnotify/fsnotify"
 	"github.com/puzpuzpuz/xsync/v3"
 )
 
+//nolint:gochecknoglobals
+var logger = logging.For("watcher")
+
 type Watcher struct {
 	config    *config.Config
 	fsWatcher *fsnotify.Watcher
@@ -52,13 +56,13 @@ func (u *Watcher) Start() error {
 			if !ok {
 				return fmt.Errorf("watcher channel closed")
 			}
-			slog.Debug("event", "event", event)
+			logger.Debug("event", "event", event)
 			go u.processEvent(event)
 		case err, ok := <-u.fsWatcher.Errors:
 			if !ok {
 				return fmt.Errorf("watcher channel closed")
 			}
-			slog.Error("error", "error", err)
+			logger.Error("error", "error", err)
 		}
 	}
 }
@@ -72,11 +76,11 @@ func (u *Watcher) Add(path string) error {
 	if err != nil {
 		return fmt.Errorf("failed to walk directory: %w", err)
 	}
-	slog.Debug("walked", "dirs", dirs)
+	logger.Debug("walked", "dirs", dirs)
 	for _, dir := range dirs {
 		if !slices.Contains(u.fsWatcher.WatchList(), dir) {
 			err := u.fsWatcher.Add(dir)
-			slog.Info("watching", "path", dir)
+			logger.Info("watching", "path", dir)
 			if err != nil {
 				return fmt.Errorf("failed to add directory to watcher: %w", err)
 			}
@@ -89,7 +93,7 @@ func (u *Watcher) Add(path string) error {
 func (u *Watcher) debounce(path string, callback UploadCallback) {
 	t, ok := u.debounces.LoadAndStore(path, time.Now())
 	if ok {
-		slog.Debug("debouncing", "path", path)
+		logger.Debug("debouncing", "path", path, logging.File(u.config.Uploader, path))
 		return
 	}
 	go func() {
@@ -113,21 +117,21 @@ func (u *Watcher) processEvent(event fsnotify.Event) {
 	case fsnotify.Create:
 		fstat, err := os.Stat(event.Name)
 		if err != nil {
-			slog.Error("failed to stat", "path", event.Name, "error", err)
+			logger.Error("failed to stat", "path", event.Name, "error", err)
 			return
 		}
 		if fstat.IsDir() {
 			u.Add(event.Name)
 		} else {
 			// This is probably a new file, so we should upload it
-			if slices.Contains(u.config.Uploader.Extensions, filepath.Ext(event.Name)) {
-				slog.Info("new file", "path", event.Name)
+			if Watched(u.config, u.config.Uploader.Directory, event.Name) {
+				logger.Info("new file", "path", event.Name, logging.File(u.config.Uploader, event.Name))
 			}
 		}
 	case fsnotify.Write:
-		slog.Info("modified", "path", event.Name)
-		if slices.Contains(u.config.Uploader.Extensions, filepath.Ext(event.Name)) {
-			slog.Info("wrote file", "path", event.Name)
+		logger.Info("modified", "path", event.Name)
+		if Watched(u.config, u.config.Uploader.Directory, event.Name) {
+			logger.Info("wrote file", "path", event.Name, logging.File(u.config.Uploader, event.Name))
 			u.debounce(event.Name, u.callback)
 		}
 	case fsnotify.Remove:
@@ -139,6 +143,24 @@ func (u *Watcher) processEvent(event fsnotify.Event) {
 	}
 }
 
+// Watched reports whether a file under root is one to upload, having one of
+// the extensions and matching an include glob if any are configured, or
+// being picked up by a rule.
+func Watched(cfg *config.Config, root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if rules.Admits(cfg.Rules, rel) {
+		return true
+	}
+	if !slices.Contains(cfg.Uploader.Extensions, filepath.Ext(path)) {
+		return false
+	}
+	return len(cfg.Uploader.Include) == 0 || slices.ContainsFunc(cfg.Uploader.Include, func(glob string) bool { return rules.Glob(glob, rel) })
+}
+
 func walkdir(dir string) ([]string, error) {
 	var dirs []string
 	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
@@ -19,6 +19,6 @@ func main() {
 	rootCmd := cmd.NewCommand(version, commit)
 	if err := rootCmd.Execute(); err != nil {
 		slog.Error("Encountered an error.", "error", err.Error())
-		os.Exit(1)
+		os.Exit(cmd.ExitCode(err))
 	}
 }
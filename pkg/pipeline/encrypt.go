@@ -0,0 +1,193 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	StageEncrypt    = "encrypt"
+	EncodingEncrypt = "x-aes256gcm-stream"
+)
+
+// The encrypted stream is a header of magic and a random nonce prefix,
+// followed by the file in AES-256-GCM sealed chunks. Each chunk is sealed
+// with the prefix, its number and whether it is the last, so chunks cannot
+// be reordered, dropped or truncated without the decryption failing.
+const (
+	encryptMagic      = "NS3E\x01"
+	noncePrefixSize   = 7
+	encryptHeaderSize = len(encryptMagic) + noncePrefixSize
+	keySize           = 32
+)
+
+var (
+	ErrInvalidKey       = errors.New("Encryption key must be 32 bytes, raw or base64")
+	ErrDecryptionFailed = errors.New("Failed to decrypt object")
+	ErrTooLarge         = errors.New("File too large to encrypt")
+)
+
+type encryptStage struct {
+	aead cipher.AEAD
+}
+
+// Encrypt encrypts the file with AES-256-GCM under key, so the bucket only
+// ever holds ciphertext. The output differs on every run.
+func Encrypt(key []byte) (Stage, error) {
+	if len(key) != keySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return encryptStage{aead: aead}, nil
+}
+
+// newEncrypt reads the key from the key-file option, which holds 32 raw
+// bytes or their base64 encoding.
+func newEncrypt(options map[string]string) (Stage, error) {
+	path, ok := options["key-file"]
+	if !ok || len(options) != 1 {
+		return nil, fmt.Errorf("%w: encrypt takes a key-file", ErrInvalidOptions)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %w", err)
+	}
+	key := data
+	if len(key) != keySize {
+		key, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+	}
+	return Encrypt(key)
+}
+
+func (encryptStage) Encoding() string {
+	return EncodingEncrypt
+}
+
+func (s encryptStage) Wrap(_ context.Context, r io.Reader, _ *File) (io.Reader, error) {
+	header := make([]byte, encryptHeaderSize)
+	copy(header, encryptMagic)
+	if _, err := rand.Read(header[len(encryptMagic):]); err != nil {
+		return nil, err
+	}
+	reader := &chunkReader{
+		source: r,
+		size:   chunkSize,
+		transform: func(c *chunkReader, chunk []byte, last bool) ([]byte, error) {
+			return s.aead.Seal(nil, c.nonce(last), chunk, nil), nil
+		},
+	}
+	reader.prefix = header[len(encryptMagic):]
+	reader.out.Write(header)
+	return reader, nil
+}
+
+func (s encryptStage) Decode(r io.Reader) (io.Reader, error) {
+	header := make([]byte, encryptHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encryptMagic)]) != encryptMagic {
+		return nil, fmt.Errorf("%w: not encrypted by this stage", ErrDecryptionFailed)
+	}
+	reader := &chunkReader{
+		source: r,
+		size:   chunkSize + s.aead.Overhead(),
+		transform: func(c *chunkReader, chunk []byte, last bool) ([]byte, error) {
+			plain, err := s.aead.Open(nil, c.nonce(last), chunk, nil)
+			if err != nil {
+				return nil, fmt.Errorf("%w: chunk %d: %w", ErrDecryptionFailed, c.counter, err)
+			}
+			return plain, nil
+		},
+	}
+	reader.prefix = header[len(encryptMagic):]
+	return reader, nil
+}
+
+// chunkReader transforms its source in chunks of size, reading one byte
+// ahead so it knows which chunk is the last.
+type chunkReader struct {
+	source    io.Reader
+	size      int
+	transform func(c *chunkReader, chunk []byte, last bool) ([]byte, error)
+	prefix    []byte
+	counter   uint32
+	pending   []byte
+	out       bytes.Buffer
+	done      bool
+}
+
+// nonce returns the nonce of the current chunk.
+func (c *chunkReader) nonce(last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, c.prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, c.counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for c.out.Len() == 0 && !c.done {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	if c.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.out.Read(p)
+}
+
+// next transforms the next chunk into out.
+func (c *chunkReader) next() error {
+	want := c.size + 1
+	if cap(c.pending) < want {
+		c.pending = append(make([]byte, 0, want), c.pending...)
+	}
+	n, err := io.ReadFull(c.source, c.pending[len(c.pending):want])
+	c.pending = c.pending[:len(c.pending)+n]
+	last := false
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return err
+	}
+	chunk := c.pending
+	if !last {
+		chunk = c.pending[:c.size]
+	}
+	out, err := c.transform(c, chunk, last)
+	if err != nil {
+		return err
+	}
+	c.out.Write(out)
+	if last {
+		c.done = true
+		return nil
+	}
+	if c.counter == ^uint32(0) {
+		return ErrTooLarge
+	}
+	c.counter++
+	c.pending = append(c.pending[:0], c.pending[c.size:]...)
+	return nil
+}
@@ -0,0 +1,153 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const StageFITSHeader = "fits-header"
+
+const (
+	fitsBlockSize = 2880
+	fitsCardSize  = 80
+	// maxHeaderBlocks bounds how far a header is searched for its END card
+	maxHeaderBlocks = 1000
+)
+
+var ErrInvalidFITS = errors.New("Invalid FITS header")
+
+//nolint:gochecknoglobals
+var fitsKeyword = regexp.MustCompile(`^[A-Z0-9_-]{1,8}$`)
+
+type fitsHeaderStage struct {
+	// cards are the formatted cards by keyword
+	cards map[string][]byte
+	// values are the values as a header reader returns them
+	values map[string]string
+}
+
+// FITSHeader sets keywords in the primary header of FITS files to values,
+// replacing existing cards and adding the others before the END card. Values
+// that are numbers or the logicals T and F are written as such, the others
+// as strings. Files without a FITS header pass through unchanged.
+func FITSHeader(keywords map[string]string) (Stage, error) {
+	stage := fitsHeaderStage{cards: map[string][]byte{}, values: map[string]string{}}
+	for keyword, value := range keywords {
+		keyword = strings.ToUpper(keyword)
+		if !fitsKeyword.MatchString(keyword) || slices.Contains([]string{"SIMPLE", "BITPIX", "NAXIS", "EXTEND", "END"}, keyword) || strings.HasPrefix(keyword, "NAXIS") {
+			return nil, fmt.Errorf("%w: cannot set keyword %q", ErrInvalidOptions, keyword)
+		}
+		card, err := fitsCard(keyword, value)
+		if err != nil {
+			return nil, err
+		}
+		stage.cards[keyword] = card
+		stage.values[keyword] = value
+	}
+	return stage, nil
+}
+
+// fitsCard formats a card in the fixed format.
+func fitsCard(keyword, value string) ([]byte, error) {
+	for _, r := range value {
+		if r < ' ' || r > '~' {
+			return nil, fmt.Errorf("%w: value of %s is not printable ASCII", ErrInvalidOptions, keyword)
+		}
+	}
+	var text string
+	_, numErr := strconv.ParseFloat(value, 64)
+	if numErr == nil || value == "T" || value == "F" {
+		text = fmt.Sprintf("%-8s= %20s", keyword, value)
+	} else {
+		text = fmt.Sprintf("%-8s= '%-8s'", keyword, strings.ReplaceAll(value, "'", "''"))
+	}
+	if len(text) > fitsCardSize {
+		return nil, fmt.Errorf("%w: value of %s does not fit in a card", ErrInvalidOptions, keyword)
+	}
+	return fmt.Appendf(nil, "%-80s", text), nil
+}
+
+func (fitsHeaderStage) Encoding() string {
+	return ""
+}
+
+func (s fitsHeaderStage) Wrap(_ context.Context, r io.Reader, file *File) (io.Reader, error) {
+	if file.Header == nil || len(s.cards) == 0 {
+		return r, nil
+	}
+	return &fitsHeaderReader{stage: s, source: r, file: file}, nil
+}
+
+// fitsHeaderReader rewrites the header on the first read.
+type fitsHeaderReader struct {
+	stage  fitsHeaderStage
+	source io.Reader
+	file   *File
+	output io.Reader
+}
+
+func (f *fitsHeaderReader) Read(p []byte) (int, error) {
+	if f.output == nil {
+		header, err := f.rewrite()
+		if err != nil {
+			return 0, err
+		}
+		f.output = io.MultiReader(bytes.NewReader(header), f.source)
+	}
+	return f.output.Read(p)
+}
+
+// rewrite reads the header from the source and returns it with the cards
+// set, padded to whole blocks.
+func (f *fitsHeaderReader) rewrite() ([]byte, error) {
+	var cards [][]byte
+	set := map[string]bool{}
+	block := make([]byte, fitsBlockSize)
+	for range maxHeaderBlocks {
+		if _, err := io.ReadFull(f.source, block); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidFITS, err)
+		}
+		for i := 0; i < fitsBlockSize; i += fitsCardSize {
+			card := block[i : i+fitsCardSize]
+			keyword := strings.TrimSpace(string(card[:8]))
+			if keyword == "END" {
+				return f.finish(cards, set), nil
+			}
+			if replacement, ok := f.stage.cards[keyword]; ok && string(card[8:10]) == "= " {
+				card = replacement
+				set[keyword] = true
+			}
+			cards = append(cards, slices.Clone(card))
+		}
+	}
+	return nil, fmt.Errorf("%w: no END card", ErrInvalidFITS)
+}
+
+// finish adds the cards that were not replaced and the END card, and pads
+// the header with blanks to whole blocks.
+func (f *fitsHeaderReader) finish(cards [][]byte, set map[string]bool) []byte {
+	// Blank cards before END are padding, the new cards take their place
+	for len(cards) > 0 && len(bytes.TrimSpace(cards[len(cards)-1])) == 0 {
+		cards = cards[:len(cards)-1]
+	}
+	for _, keyword := range slices.Sorted(maps.Keys(f.stage.cards)) {
+		if !set[keyword] {
+			cards = append(cards, f.stage.cards[keyword])
+		}
+	}
+	cards = append(cards, fmt.Appendf(nil, "%-80s", "END"))
+	header := bytes.Join(cards, nil)
+	if rem := len(header) % fitsBlockSize; rem != 0 {
+		header = append(header, bytes.Repeat([]byte(" "), fitsBlockSize-rem)...)
+	}
+	maps.Copy(f.file.Header, f.stage.values)
+	return header
+}
@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+)
+
+const (
+	StageGzip    = "gzip"
+	EncodingGzip = "gzip"
+)
+
+// chunkSize is how much of its input a stage reads at a time.
+const chunkSize = 64 * 1024
+
+type gzipStage struct{}
+
+// Gzip compresses the file. The output depends only on the input, so an
+// interrupted multipart upload of it resumes.
+func Gzip() Stage {
+	return gzipStage{}
+}
+
+func (gzipStage) Encoding() string {
+	return EncodingGzip
+}
+
+func (gzipStage) Wrap(_ context.Context, r io.Reader, _ *File) (io.Reader, error) {
+	reader := &gzipReader{source: r, chunk: make([]byte, chunkSize)}
+	reader.writer = gzip.NewWriter(&reader.buf)
+	return reader, nil
+}
+
+func (gzipStage) Decode(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// gzipReader compresses its source as it is read, without a goroutine.
+type gzipReader struct {
+	source io.Reader
+	writer *gzip.Writer
+	buf    bytes.Buffer
+	chunk  []byte
+	done   bool
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	for g.buf.Len() == 0 && !g.done {
+		n, err := g.source.Read(g.chunk)
+		if n > 0 {
+			if _, err := g.writer.Write(g.chunk[:n]); err != nil {
+				return 0, err
+			}
+		}
+		switch {
+		case err == io.EOF:
+			g.done = true
+			if err := g.writer.Close(); err != nil {
+				return 0, err
+			}
+		case err != nil:
+			return 0, err
+		}
+	}
+	if g.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return g.buf.Read(p)
+}
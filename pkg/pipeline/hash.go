@@ -0,0 +1,43 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+type sha256Stage struct {
+	key string
+}
+
+// SHA256 records the hex SHA-256 of the bytes passing through it in the
+// metadata under key once they have all been read. It does not change them.
+func SHA256(key string) Stage {
+	return sha256Stage{key: key}
+}
+
+func (sha256Stage) Encoding() string {
+	return ""
+}
+
+func (s sha256Stage) Wrap(_ context.Context, r io.Reader, file *File) (io.Reader, error) {
+	return &hashReader{source: r, hash: sha256.New(), key: s.key, file: file}, nil
+}
+
+type hashReader struct {
+	source io.Reader
+	hash   hash.Hash
+	key    string
+	file   *File
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.source.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF {
+		h.file.Metadata[h.key] = hex.EncodeToString(h.hash.Sum(nil))
+	}
+	return n, err
+}
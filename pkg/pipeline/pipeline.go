@@ -0,0 +1,159 @@
+// Package pipeline transforms files on their way to S3 as a chain of
+// streaming stages, such as hashing, compression, encryption, throttling,
+// progress reporting and FITS header injection.
+//
+// Each stage wraps the io.Reader of the stage before it. Stages that encode
+// the content, which a download has to reverse, report their content encoding
+// and come after the stages that change what a download restores. Custom
+// stages are registered by name and can then be configured in
+// uploader.pipeline like the built-in ones.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrUnknownStage   = errors.New("Unknown pipeline stage")
+	ErrInvalidOptions = errors.New("Invalid pipeline stage options")
+)
+
+// File describes the file flowing through a pipeline. Stages may update the
+// header and add metadata as they go, values set at the end of the stream
+// are only complete once the output has been read to EOF.
+type File struct {
+	// Name is the path relative to the watched directory, with forward slashes
+	Name string
+	// Header holds the FITS header keywords, nil for other files
+	Header map[string]string
+	// Metadata is stored with the object
+	Metadata map[string]string
+}
+
+// Stage is one step of a pipeline.
+type Stage interface {
+	// Wrap returns a reader of the output of the stage for the input r.
+	Wrap(ctx context.Context, r io.Reader, file *File) (io.Reader, error)
+	// Encoding is the content encoding the stage applies, i.e. gzip, or
+	// empty if the output is what a download restores.
+	Encoding() string
+}
+
+// Decoder is implemented by encoding stages that a download can reverse.
+type Decoder interface {
+	// Decode returns a reader of the input of the stage for its output r.
+	Decode(r io.Reader) (io.Reader, error)
+}
+
+// Pipeline is a chain of stages, applied in order.
+type Pipeline []Stage
+
+// Wrap chains the stages over r.
+func (p Pipeline) Wrap(ctx context.Context, r io.Reader, file *File) (io.Reader, error) {
+	if file.Metadata == nil {
+		file.Metadata = map[string]string{}
+	}
+	for _, stage := range p {
+		var err error
+		r, err = stage.Wrap(ctx, r, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Encodings returns the content encodings of the stages in the order they
+// are applied.
+func (p Pipeline) Encodings() []string {
+	var encodings []string
+	for _, stage := range p {
+		if encoding := stage.Encoding(); encoding != "" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	return encodings
+}
+
+// Decoder returns the stage that reverses encoding, or nil.
+func (p Pipeline) Decoder(encoding string) Decoder {
+	for _, stage := range slices.Backward(p) {
+		if decoder, ok := stage.(Decoder); ok && stage.Encoding() == encoding {
+			return decoder
+		}
+	}
+	return nil
+}
+
+// Factory creates a stage from the options it is configured with.
+type Factory func(options map[string]string) (Stage, error)
+
+//nolint:gochecknoglobals
+var (
+	factories     = map[string]Factory{}
+	factoriesLock sync.RWMutex
+)
+
+// Register makes a stage available by name, replacing any stage of the same
+// name. It is meant to be called from init functions.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	factories[name] = factory
+}
+
+// Registered reports whether a stage of name is registered.
+func Registered(name string) bool {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+	_, ok := factories[name]
+	return ok
+}
+
+// Names returns the names of the registered stages, sorted.
+func Names() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the registered stage of name with options.
+func New(name string, options map[string]string) (Stage, error) {
+	factoriesLock.RLock()
+	factory, ok := factories[name]
+	factoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStage, name)
+	}
+	stage, err := factory(options)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline stage %s: %w", name, err)
+	}
+	return stage, nil
+}
+
+//nolint:gochecknoinits
+func init() {
+	Register(StageGzip, func(options map[string]string) (Stage, error) {
+		if len(options) > 0 {
+			return nil, fmt.Errorf("%w: gzip takes no options", ErrInvalidOptions)
+		}
+		return Gzip(), nil
+	})
+	Register(StageThrottle, newThrottle)
+	Register(StageEncrypt, newEncrypt)
+	Register(StageFITSHeader, func(options map[string]string) (Stage, error) {
+		return FITSHeader(options)
+	})
+}
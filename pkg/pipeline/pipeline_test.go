@@ -0,0 +1,180 @@
+package pipeline_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/nina-s3-uploader/pkg/pipeline"
+)
+
+// run passes input through p and returns the output.
+func run(t *testing.T, p pipeline.Pipeline, file *pipeline.File, input []byte) []byte {
+	t.Helper()
+	r, err := p.Wrap(context.Background(), bytes.NewReader(input), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+// decode reverses the encodings of p on output.
+func decode(t *testing.T, p pipeline.Pipeline, output []byte) ([]byte, error) {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(output)
+	encodings := p.Encodings()
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		r, err = p.Decoder(encodings[i]).Decode(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	encrypt, err := pipeline.Encrypt(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sizes around the chunk size exercise the detection of the last chunk
+	for _, size := range []int{0, 1, 64 * 1024, 64*1024 + 1, 300 * 1024} {
+		input := bytes.Repeat([]byte("M31 "), size/4+1)[:size]
+		want := sha256.Sum256(input)
+		var read int64
+		p := pipeline.Pipeline{
+			pipeline.SHA256("sha256"),
+			pipeline.Gzip(),
+			encrypt,
+			pipeline.Progress(func(n int64) { read = n }),
+		}
+		file := &pipeline.File{Name: "a.fits"}
+		output := run(t, p, file, input)
+		if file.Metadata["sha256"] != hex.EncodeToString(want[:]) {
+			t.Fatalf("size %d: recorded sha256 %q", size, file.Metadata["sha256"])
+		}
+		if read != int64(len(output)) {
+			t.Fatalf("size %d: progress reported %d of %d bytes", size, read, len(output))
+		}
+		if got := strings.Join(p.Encodings(), ", "); got != "gzip, x-aes256gcm-stream" {
+			t.Fatalf("encodings %q", got)
+		}
+		decoded, err := decode(t, p, output)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Fatalf("size %d: round trip changed the file", size)
+		}
+
+		// Dropping the last chunk must not go unnoticed
+		if len(output) > 64*1024 {
+			_, err := decode(t, p, output[:len(output)-100])
+			if !errors.Is(err, pipeline.ErrDecryptionFailed) {
+				t.Fatalf("size %d: truncated output decoded with %v", size, err)
+			}
+		}
+	}
+}
+
+func TestGzipDeterministic(t *testing.T) {
+	t.Parallel()
+	input := bytes.Repeat([]byte("flat "), 50000)
+	p := pipeline.Pipeline{pipeline.Gzip()}
+	first := run(t, p, &pipeline.File{}, input)
+	second := run(t, p, &pipeline.File{}, input)
+	if !bytes.Equal(first, second) || len(first) >= len(input) {
+		t.Fatal("gzip output should be smaller and the same on every run")
+	}
+}
+
+func TestFITSHeader(t *testing.T) {
+	t.Parallel()
+	card := func(text string) string { return text + strings.Repeat(" ", 80-len(text)) }
+	header := card("SIMPLE  =                    T") +
+		card("OBJECT  = 'M31     '") +
+		card("END")
+	header += strings.Repeat(" ", 2880-len(header))
+	data := strings.Repeat("\x01", 2880)
+
+	stage, err := pipeline.FITSHeader(map[string]string{"object": "M 31", "observer": "O'Brien", "siteelev": "120.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &pipeline.File{Name: "a.fits", Header: map[string]string{"OBJECT": "M31"}}
+	output := string(run(t, pipeline.Pipeline{stage}, file, []byte(header+data)))
+	if len(output) != len(header)+len(data) || !strings.HasSuffix(output, data) {
+		t.Fatalf("header is not whole blocks followed by the data, %d bytes", len(output))
+	}
+	for _, want := range []string{
+		card("SIMPLE  =                    T"),
+		card("OBJECT  = 'M 31    '"),
+		card("OBSERVER= 'O''Brien'"),
+		card("SITEELEV=                120.5"),
+		card("END"),
+	} {
+		if !strings.Contains(output[:2880], want) {
+			t.Fatalf("header is missing %q", want)
+		}
+	}
+	if file.Header["OBJECT"] != "M 31" || file.Header["OBSERVER"] != "O'Brien" {
+		t.Fatalf("header not updated: %v", file.Header)
+	}
+
+	// Other files pass through
+	other := run(t, pipeline.Pipeline{stage}, &pipeline.File{Name: "a.json"}, []byte("{}"))
+	if string(other) != "{}" {
+		t.Fatalf("non-FITS file changed to %q", other)
+	}
+
+	if _, err := pipeline.FITSHeader(map[string]string{"NAXIS1": "1"}); !errors.Is(err, pipeline.ErrInvalidOptions) {
+		t.Fatalf("expected structural keywords to be refused, got %v", err)
+	}
+}
+
+type upper struct{}
+
+func (upper) Encoding() string { return "" }
+
+func (upper) Wrap(_ context.Context, r io.Reader, _ *pipeline.File) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	return bytes.NewReader(bytes.ToUpper(data)), err
+}
+
+func TestRegister(t *testing.T) {
+	t.Parallel()
+	pipeline.Register("upper", func(map[string]string) (pipeline.Stage, error) { return upper{}, nil })
+	if !pipeline.Registered("upper") || !pipeline.Registered("gzip") {
+		t.Fatalf("registered stages: %v", pipeline.Names())
+	}
+	stage, err := pipeline.New("upper", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := run(t, pipeline.Pipeline{stage}, &pipeline.File{}, []byte("m31")); string(got) != "M31" {
+		t.Fatalf("custom stage returned %q", got)
+	}
+	if _, err := pipeline.New("lzma", nil); !errors.Is(err, pipeline.ErrUnknownStage) {
+		t.Fatalf("expected an unknown stage error, got %v", err)
+	}
+	if _, err := pipeline.New("throttle", map[string]string{"bytes-per-second": "fast"}); !errors.Is(err, pipeline.ErrInvalidOptions) {
+		t.Fatalf("expected invalid options, got %v", err)
+	}
+}
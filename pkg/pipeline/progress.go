@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+)
+
+type progressStage struct {
+	report func(read int64)
+}
+
+// Progress calls report with the total number of bytes read so far after
+// every read. It does not change them.
+func Progress(report func(read int64)) Stage {
+	return progressStage{report: report}
+}
+
+func (progressStage) Encoding() string {
+	return ""
+}
+
+func (s progressStage) Wrap(_ context.Context, r io.Reader, _ *File) (io.Reader, error) {
+	return &progressReader{source: r, report: s.report}, nil
+}
+
+type progressReader struct {
+	source io.Reader
+	report func(read int64)
+	read   int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.source.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		p.report(p.read)
+	}
+	return n, err
+}
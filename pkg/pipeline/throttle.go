@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/time/rate"
+)
+
+const StageThrottle = "throttle"
+
+type throttleStage struct {
+	bytesPerSecond int
+}
+
+// Throttle reads the file no faster than bytesPerSecond, i.e. to keep
+// staging a large file from competing with the camera for the disk.
+func Throttle(bytesPerSecond int) Stage {
+	return throttleStage{bytesPerSecond: bytesPerSecond}
+}
+
+func newThrottle(options map[string]string) (Stage, error) {
+	bytesPerSecond, err := strconv.Atoi(options["bytes-per-second"])
+	if err != nil || bytesPerSecond <= 0 || len(options) != 1 {
+		return nil, fmt.Errorf("%w: throttle takes a positive bytes-per-second", ErrInvalidOptions)
+	}
+	return Throttle(bytesPerSecond), nil
+}
+
+func (throttleStage) Encoding() string {
+	return ""
+}
+
+func (s throttleStage) Wrap(ctx context.Context, r io.Reader, _ *File) (io.Reader, error) {
+	// A second's worth of burst, like the upload bandwidth limit
+	limiter := rate.NewLimiter(rate.Limit(s.bytesPerSecond), s.bytesPerSecond)
+	return &throttleReader{ctx: ctx, source: r, limiter: limiter}, nil
+}
+
+type throttleReader struct {
+	ctx     context.Context
+	source  io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttleReader) Read(p []byte) (int, error) {
+	if burst := t.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.source.Read(p)
+	if n > 0 {
+		if waitErr := t.limiter.WaitN(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}